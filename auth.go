@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// 인증된 주체의 종류
+const (
+	PrincipalTypeJWT    = "jwt"
+	PrincipalTypeAPIKey = "api_key"
+
+	apiKeyHeader        = "X-API-Key"
+	principalContextKey = "principal"
+)
+
+var (
+	// Config.Auth로부터 만들어진 인증 수단들. InitAuthenticators에서 설정된다.
+	Authenticators []Authenticator
+
+	ErrInvalidAuthConfig = errors.New("잘못된 인증 설정입니다.")
+	ErrUnauthenticated   = errors.New("인증이 필요합니다. Authorization: Bearer <JWT> 혹은 X-API-Key 헤더를 전달해주세요.")
+	ErrInvalidToken      = errors.New("유효하지 않은 token입니다.")
+	ErrInvalidAPIKey     = errors.New("유효하지 않은 API key입니다.")
+)
+
+// 업로드 등의 요청을 보낸 주체. 작업의 소유자 기록과 감사 로그에 사용된다.
+type Principal struct {
+	// jwt 혹은 api_key
+	Type string `json:"type"`
+	// jwt의 sub 혹은 API key의 client 이름
+	ID string `json:"id"`
+}
+
+func (p *Principal) String() string {
+	if p == nil {
+		return "anonymous"
+	}
+	return p.Type + ":" + p.ID
+}
+
+// 요청의 credential을 검증하는 인증 수단
+type Authenticator interface {
+	// 요청에 이 인증 수단이 다루는 credential이 없으면 nil, nil을 반환한다.
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// api group의 요청에 대한 인증 설정
+type AuthConfig struct {
+	// false이면 인증하지 않는다.
+	Enabled bool
+	JWT     JWTConfig
+	// client 서비스마다 발급한 API key
+	APIKeys []APIKey
+}
+
+type JWTConfig struct {
+	// HS256, HS384, HS512 서명을 검증할 shared secret
+	Secret string
+	// RS*, PS*, ES* 서명을 검증할 공개키들의 JWKS 파일
+	JWKSFile string
+	// 지정하면 iss claim이 같아야한다.
+	Issuer string
+	// 지정하면 aud claim에 포함되어야한다.
+	Audience string
+}
+
+type APIKey struct {
+	// 감사 로그 등에 기록될 client 서비스의 이름
+	Client string
+	Key    string
+}
+
+func (c *AuthConfig) Validate() error {
+	keys := make(map[string]bool, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		if key.Client == "" || key.Key == "" {
+			return fmt.Errorf("%w apiKeys[%d]: client와 key는 필수입니다", ErrInvalidAuthConfig, i)
+		}
+		if keys[key.Key] {
+			return fmt.Errorf("%w apiKeys[%d]: 중복된 key입니다. client=%s", ErrInvalidAuthConfig, i, key.Client)
+		}
+		keys[key.Key] = true
+	}
+	if c.Enabled && c.JWT.Secret == "" && c.JWT.JWKSFile == "" && len(c.APIKeys) == 0 {
+		return fmt.Errorf("%w 인증을 사용하려면 jwt.secret, jwt.jwksFile, apiKeys 중 하나 이상이 필요합니다", ErrInvalidAuthConfig)
+	}
+	return nil
+}
+
+// 설정된 인증 수단들을 만든다.
+func NewAuthenticators(c *AuthConfig) ([]Authenticator, error) {
+	authenticators := make([]Authenticator, 0)
+	if len(c.APIKeys) > 0 {
+		authenticators = append(authenticators, &APIKeyAuthenticator{Keys: c.APIKeys})
+	}
+	if c.JWT.Secret != "" || c.JWT.JWKSFile != "" {
+		authenticator, err := NewJWTAuthenticator(&c.JWT)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, authenticator)
+	}
+	return authenticators, nil
+}
+
+// X-API-Key 헤더의 key로 client 서비스를 인증한다.
+type APIKeyAuthenticator struct {
+	Keys []APIKey
+}
+
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	for _, candidate := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate.Key)) == 1 {
+			return &Principal{Type: PrincipalTypeAPIKey, ID: candidate.Client}, nil
+		}
+	}
+	return nil, ErrInvalidAPIKey
+}
+
+// Authorization: Bearer <JWT>의 서명과 exp, nbf, iss, aud claim을 검증하고 sub를 주체로 사용한다.
+type JWTAuthenticator struct {
+	secret []byte
+	// JWKS의 kid => 공개키(*rsa.PublicKey, *ecdsa.PublicKey)
+	keys     map[string]interface{}
+	methods  []string
+	issuer   string
+	audience string
+}
+
+func NewJWTAuthenticator(c *JWTConfig) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{issuer: c.Issuer, audience: c.Audience}
+	if c.Secret != "" {
+		a.secret = []byte(c.Secret)
+		a.methods = append(a.methods, "HS256", "HS384", "HS512")
+	}
+	if c.JWKSFile != "" {
+		data, err := ioutil.ReadFile(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys, err = parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+		a.methods = append(a.methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+		logrus.Infof("JWKS를 읽었습니다. path=%s, key 수=%d", c.JWKSFile, len(a.keys))
+	}
+	return a, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return nil, nil
+	}
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: a.methods}
+	if _, err := parser.ParseWithClaims(strings.TrimPrefix(header, "Bearer "), claims, a.keyFunc); err != nil {
+		return nil, fmt.Errorf("%w %v", ErrInvalidToken, err)
+	}
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return nil, fmt.Errorf("%w iss가 올바르지 않습니다", ErrInvalidToken)
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return nil, fmt.Errorf("%w aud가 올바르지 않습니다", ErrInvalidToken)
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("%w sub가 없습니다", ErrInvalidToken)
+	}
+	return &Principal{Type: PrincipalTypeJWT, ID: subject}, nil
+}
+
+// token의 alg와 kid에 맞는 검증 key를 찾는다.
+func (a *JWTAuthenticator) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return a.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	// key가 하나뿐이면 kid가 없어도 사용한다.
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("알 수 없는 kid입니다. kid=%s", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// JWKS(RFC 7517)에서 서명 검증용 RSA, EC 공개키들을 읽는다.
+func parseJWKS(data []byte) (map[string]interface{}, error) {
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("%w JWKS를 해석할 수 없습니다. %v", ErrInvalidAuthConfig, err)
+	}
+	keys := make(map[string]interface{}, len(jwks.Keys))
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var (
+			key interface{}
+			err error
+		)
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaPublicKey()
+		case "EC":
+			key, err = k.ecdsaPublicKey()
+		default:
+			logrus.Warnf("지원하지 않는 JWK의 kty입니다. kid=%s, kty=%s", k.Kid, k.Kty)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w keys[%d]: %v", ErrInvalidAuthConfig, i, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w JWKS에 사용할 수 있는 key가 없습니다", ErrInvalidAuthConfig)
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := decodeJWKInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeJWKInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() < 3 {
+		return nil, errors.New("잘못된 RSA exponent입니다")
+	}
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func (k *jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("지원하지 않는 crv입니다. crv=%s", k.Crv)
+	}
+	x, err := decodeJWKInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeJWKInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("곡선 위의 점이 아닙니다")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("잘못된 base64url 값입니다. value=%s", s)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Config.Auth가 활성화되어있으면 Authenticators 중 하나로 인증된 요청만 허용한다.
+// 인증된 주체는 PrincipalOf로 얻을 수 있다.
+func AuthMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !Config.Auth.Enabled {
+			return handlerFunc(c)
+		}
+		for _, authenticator := range Authenticators {
+			principal, err := authenticator.Authenticate(c.Request())
+			if err != nil {
+				logrus.Warnf("인증에 실패했습니다. uri=%s, err=%s", c.Request().RequestURI, err)
+				return c.JSON(401, BaseResponse{Message: err.Error()})
+			}
+			if principal != nil {
+				c.Set(principalContextKey, principal)
+				return handlerFunc(c)
+			}
+		}
+		return c.JSON(401, BaseResponse{Message: ErrUnauthenticated.Error()})
+	}
+}
+
+// 요청을 인증한 주체. 인증하지 않은 경우 nil
+func PrincipalOf(c echo.Context) *Principal {
+	principal, _ := c.Get(principalContextKey).(*Principal)
+	return principal
+}
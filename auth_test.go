@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func authenticateTestRequest(a Authenticator, header, value string) (*Principal, error) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	return a.Authenticate(req)
+}
+
+func jwkInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	a := &APIKeyAuthenticator{Keys: []APIKey{{Client: "khumu-command-center", Key: "secret-key"}}}
+
+	principal, err := authenticateTestRequest(a, apiKeyHeader, "secret-key")
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Type: PrincipalTypeAPIKey, ID: "khumu-command-center"}, principal)
+
+	_, err = authenticateTestRequest(a, apiKeyHeader, "wrong")
+	assert.ErrorIs(t, err, ErrInvalidAPIKey)
+
+	principal, err = authenticateTestRequest(a, "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, principal)
+}
+
+func TestJWTAuthenticator_Secret(t *testing.T) {
+	a, err := NewJWTAuthenticator(&JWTConfig{Secret: "jwt-secret", Issuer: "khumu", Audience: "bumblebee"})
+	assert.NoError(t, err)
+	secret := []byte("jwt-secret")
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "user-1", "iss": "khumu", "aud": []string{"bumblebee", "other"}, "exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	principal, err := authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, secret, "", claims()))
+	assert.NoError(t, err)
+	assert.Equal(t, &Principal{Type: PrincipalTypeJWT, ID: "user-1"}, principal)
+
+	for name, token := range map[string]string{
+		"다른_secret": signTestJWT(t, jwt.SigningMethodHS256, []byte("other"), "", claims()),
+		"만료": func() string {
+			c := claims()
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"다른_iss": func() string {
+			c := claims()
+			c["iss"] = "other"
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"다른_aud": func() string {
+			c := claims()
+			c["aud"] = "other"
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"다른_aud_배열": func() string {
+			c := claims()
+			c["aud"] = []string{"other", "another"}
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"aud_없음": func() string {
+			c := claims()
+			delete(c, "aud")
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"sub_없음": func() string {
+			c := claims()
+			delete(c, "sub")
+			return signTestJWT(t, jwt.SigningMethodHS256, secret, "", c)
+		}(),
+		"alg_none": signTestJWT(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims()),
+		"형식_오류":    "abc.def",
+	} {
+		_, err := authenticateTestRequest(a, "Authorization", "Bearer "+token)
+		assert.ErrorIs(t, err, ErrInvalidToken, name)
+	}
+
+	principal, err = authenticateTestRequest(a, "Authorization", "Basic abcd")
+	assert.NoError(t, err)
+	assert.Nil(t, principal)
+}
+
+func TestJWTAuthenticator_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": jwkInt(rsaKey.N), "e": jwkInt(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": jwkInt(ecKey.X), "y": jwkInt(ecKey.Y)},
+		{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"},
+	}})
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwksFile, jwks, 0644))
+
+	a, err := NewJWTAuthenticator(&JWTConfig{JWKSFile: jwksFile})
+	assert.NoError(t, err)
+	claims := jwt.MapClaims{"sub": "service-a", "exp": time.Now().Add(time.Hour).Unix()}
+
+	principal, err := authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodRS256, rsaKey, "rsa-1", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, "service-a", principal.ID)
+	principal, err = authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodES256, ecKey, "ec-1", claims))
+	assert.NoError(t, err)
+	assert.Equal(t, "service-a", principal.ID)
+
+	// kid와 알고리즘이 맞지 않거나 알 수 없는 kid
+	_, err = authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodES256, ecKey, "rsa-1", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodRS256, rsaKey, "unknown", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	// secret이 설정되지 않았으면 HS256은 허용하지 않는다.
+	_, err = authenticateTestRequest(a, "Authorization", "Bearer "+signTestJWT(t, jwt.SigningMethodHS256, []byte("secret"), "", claims))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = parseJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "bad", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.ErrorIs(t, err, ErrInvalidAuthConfig)
+}
+
+func TestAuthConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&AuthConfig{}).Validate())
+	assert.NoError(t, (&AuthConfig{Enabled: true, JWT: JWTConfig{Secret: "s"}}).Validate())
+	assert.ErrorIs(t, (&AuthConfig{Enabled: true}).Validate(), ErrInvalidAuthConfig)
+	assert.ErrorIs(t, (&AuthConfig{APIKeys: []APIKey{{Client: "a"}}}).Validate(), ErrInvalidAuthConfig)
+	assert.ErrorIs(t, (&AuthConfig{APIKeys: []APIKey{{Client: "a", Key: "k"}, {Client: "b", Key: "k"}}}).Validate(), ErrInvalidAuthConfig)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	beforeEachOnTheFlyTest(t)
+	originalAuthenticators := Authenticators
+	t.Cleanup(func() { Authenticators = originalAuthenticators })
+	Config.Auth = AuthConfig{Enabled: true, APIKeys: []APIKey{{Client: "khumu-command-center", Key: "secret-key"}}}
+	var err error
+	Authenticators, err = NewAuthenticators(&Config.Auth)
+	assert.NoError(t, err)
+	e := NewEcho()
+
+	serve := func(method, target, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if apiKey != "" {
+			req.Header.Set(apiKeyHeader, apiKey)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, 401, serve("POST", "/api/images", "").Code)
+	assert.Equal(t, 401, serve("DELETE", "/api/images/abcd.png", "").Code)
+	assert.Equal(t, 401, serve("GET", "/api/images/abcd.png/status", "wrong").Code)
+	// on-the-fly 변환 요청은 인증 대상이 아니다.
+	assert.Equal(t, 200, serve("GET", "/api/images/abcd.png?w=10", "").Code)
+
+	Jobs.Register("auth-test", "original")
+	Jobs.SetOwner("auth-test", &Principal{Type: PrincipalTypeAPIKey, ID: "khumu-command-center"})
+	rec := serve("GET", "/api/images/auth-test/status", "secret-key")
+	assert.Equal(t, 200, rec.Code)
+	resp := struct {
+		Data Job `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, &Principal{Type: PrincipalTypeAPIKey, ID: "khumu-command-center"}, resp.Data.Owner)
+}
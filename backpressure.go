@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Config.Queue.Size를 지정하지 않았을 때 동시에 처리할 수 있는 업로드 작업 수
+	defaultQueueSize = 16
+	// Config.Queue.RetryAfter를 지정하지 않았을 때 503 응답의 Retry-After(초)
+	defaultQueueRetryAfter = 5
+)
+
+var (
+	// 처리 중인 업로드 작업의 수와 디코딩된 이미지의 크기를 제한한다. InitAdmission에서 설정된다.
+	TaskAdmission *Admission
+
+	ErrQueueFull          = errors.New("처리 중인 작업이 너무 많습니다. 잠시 후 다시 시도해주세요.")
+	ErrInvalidQueueConfig = errors.New("잘못된 queue 설정입니다.")
+)
+
+// 동시에 처리 중인 업로드 작업(Job)의 수와 그 작업들의 디코딩된 pixel 수의 합을 제한한다.
+// 작업 채널의 크기는 작업 수의 상한에 맞춰 정해지므로 수락된 작업의 task들은 채널에서 막히지 않는다.
+// 같은 이름의 이미지가 동시에 업로드될 수 있으므로 자원은 이름이 아닌 수락할 때 발급한 ID로 관리한다.
+type Admission struct {
+	mu        sync.Mutex
+	maxJobs   int
+	maxPixels int64
+	jobs      int
+	pixels    int64
+	// 마지막으로 발급한 ID
+	lastID uint64
+	// ID => 수락된 작업
+	reserved map[uint64]*reservation
+	// 자원이 반환될 때마다 닫히고 새로 만들어진다.
+	released chan struct{}
+}
+
+type reservation struct {
+	pixels int64
+	// 아직 끝나지 않은 variant 수
+	remaining int
+}
+
+// 처리 중인 작업들의 상태
+type AdmissionStats struct {
+	InFlightJobs   int   `json:"in_flight_jobs"`
+	MaxJobs        int   `json:"max_jobs"`
+	InFlightPixels int64 `json:"in_flight_pixels"`
+	// 0이면 제한하지 않음
+	MaxPixels int64 `json:"max_pixels"`
+}
+
+// maxPixels가 0이면 pixel 수는 제한하지 않는다.
+func NewAdmission(maxJobs int, maxPixels int64) *Admission {
+	return &Admission{
+		maxJobs:   maxJobs,
+		maxPixels: maxPixels,
+		reserved:  make(map[uint64]*reservation),
+		released:  make(chan struct{}),
+	}
+}
+
+// variants개의 variant를 만들어낼 작업 하나와 pixels만큼의 자원을 확보하고 작업의 ID를 발급한다.
+// 여유가 없으면 ctx가 끝날 때까지 기다린 뒤 ErrQueueFull을 반환한다.
+// 처리 중인 작업이 없으면 pixels가 상한보다 크더라도 수락한다.
+func (a *Admission) Acquire(ctx context.Context, pixels int64, variants int) (uint64, error) {
+	for {
+		a.mu.Lock()
+		if a.fitsLocked(pixels) {
+			a.jobs++
+			a.pixels += pixels
+			a.lastID++
+			id := a.lastID
+			a.reserved[id] = &reservation{pixels: pixels, remaining: variants}
+			a.mu.Unlock()
+			return id, nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, ErrQueueFull
+		}
+	}
+}
+
+func (a *Admission) fitsLocked(pixels int64) bool {
+	if a.jobs >= a.maxJobs {
+		return false
+	}
+	return a.maxPixels <= 0 || a.jobs == 0 || a.pixels+pixels <= a.maxPixels
+}
+
+// id의 작업이 확보한 자원을 반환한다. 이미 반환되었거나 발급하지 않은 id는 무시한다.
+func (a *Admission) Release(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked(id)
+}
+
+// id의 작업에서 variant n개가 끝났음을 기록한다. 모든 variant가 끝나면 작업의 자원을 반환한다.
+func (a *Admission) FinishVariants(id uint64, n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, ok := a.reserved[id]
+	if !ok {
+		return
+	}
+	r.remaining -= n
+	if r.remaining <= 0 {
+		a.releaseLocked(id)
+	}
+}
+
+func (a *Admission) releaseLocked(id uint64) {
+	r, ok := a.reserved[id]
+	if !ok {
+		return
+	}
+	delete(a.reserved, id)
+	a.jobs--
+	a.pixels -= r.pixels
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+func (a *Admission) Stats() AdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AdmissionStats{InFlightJobs: a.jobs, MaxJobs: a.maxJobs, InFlightPixels: a.pixels, MaxPixels: a.maxPixels}
+}
+
+// 디코딩된 이미지의 pixel 수. gif는 모든 프레임의 합
+func pixelsOf(task *BaseImageTask) int64 {
+	if task.GIFImageData != nil {
+		total := int64(0)
+		for _, frame := range task.GIFImageData.Image {
+			total += int64(frame.Bounds().Dx()) * int64(frame.Bounds().Dy())
+		}
+		return total
+	}
+	if task.ImageData == nil {
+		return 0
+	}
+	return int64(task.ImageData.Bounds().Dx()) * int64(task.ImageData.Bounds().Dy())
+}
+
+// 동시에 처리할 수 있는 업로드 작업 수
+func queueSize() int {
+	if Config.Queue.Size > 0 {
+		return Config.Queue.Size
+	}
+	return defaultQueueSize
+}
+
+// Config.Queue에 따라 TaskAdmission을 만든다.
+// 작업의 자원은 task들이 variant를 끝낼 때마다 호출하는 FinishAdmittedVariants로 반환된다.
+func InitAdmission() {
+	TaskAdmission = NewAdmission(queueSize(), Config.Queue.MaxInFlightPixels)
+	logrus.Infof("동시에 처리할 수 있는 업로드 작업 수=%d, pixel 수=%d", queueSize(), Config.Queue.MaxInFlightPixels)
+}
+
+// TaskAdmission이 설정되어있으면 variants개의 variant를 만들어낼 task의 작업을 수락할 수 있을 때까지
+// 최대 Config.Queue.WaitTimeout초 동안 기다린다. 수락되면 발급된 ID를 task.AdmissionID에 기록한다.
+func AcquireAdmission(ctx context.Context, task *BaseImageTask, variants int) error {
+	if TaskAdmission == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(Config.Queue.WaitTimeout)*time.Second)
+	defer cancel()
+	id, err := TaskAdmission.Acquire(ctx, pixelsOf(task), variants)
+	if err != nil {
+		return err
+	}
+	task.AdmissionID = id
+	return nil
+}
+
+// 수락한 작업을 처리하지 않게 된 경우 자원을 반환한다.
+func ReleaseAdmission(task *BaseImageTask) {
+	if TaskAdmission != nil && task.AdmissionID != 0 {
+		TaskAdmission.Release(task.AdmissionID)
+	}
+}
+
+// task의 작업에서 variant n개가 완료 혹은 실패했음을 알린다. 작업의 모든 variant가 끝나면 자원을 반환한다.
+// Jobs에 variant의 최종 상태를 기록하는 곳에서 함께 호출해야한다.
+func FinishAdmittedVariants(task *BaseImageTask, n int) {
+	if TaskAdmission != nil && task.AdmissionID != 0 {
+		TaskAdmission.FinishVariants(task.AdmissionID, n)
+	}
+}
+
+// 503으로 응답하고 Retry-After 헤더를 설정한다.
+func respondServiceUnavailable(c echo.Context, err error) error {
+	retryAfter := Config.Queue.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultQueueRetryAfter
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	logrus.Warnf("처리 중인 작업이 많아 업로드 요청을 거절합니다. stats=%+v", TaskAdmission.Stats())
+	return c.JSON(503, BaseResponse{Message: err.Error()})
+}
+
+// 작업 채널들의 현재 길이와 크기
+type QueueDepth struct {
+	Resize    ChannelDepth `json:"resize"`
+	Thumbnail ChannelDepth `json:"thumbnail"`
+	Upload    ChannelDepth `json:"upload"`
+}
+
+type ChannelDepth struct {
+	Length   int `json:"length"`
+	Capacity int `json:"capacity"`
+}
+
+func CurrentQueueDepth() QueueDepth {
+	return QueueDepth{
+		Resize:    ChannelDepth{len(ResizeTaskChan), cap(ResizeTaskChan)},
+		Thumbnail: ChannelDepth{len(ThumbnailTaskChan), cap(ThumbnailTaskChan)},
+		Upload:    ChannelDepth{len(UploadTaskChan), cap(UploadTaskChan)},
+	}
+}
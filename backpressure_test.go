@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := NewAdmission(2, 100)
+	ctx := context.Background()
+	expired, cancel := context.WithTimeout(ctx, 0)
+	defer cancel()
+
+	first, err := a.Acquire(expired, 60, 1)
+	assert.NoError(t, err)
+	// pixel 수 초과
+	_, err = a.Acquire(expired, 50, 1)
+	assert.ErrorIs(t, err, ErrQueueFull)
+	second, err := a.Acquire(expired, 40, 1)
+	assert.NoError(t, err)
+	// 작업 수 초과
+	_, err = a.Acquire(expired, 0, 1)
+	assert.ErrorIs(t, err, ErrQueueFull)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 2, MaxJobs: 2, InFlightPixels: 100, MaxPixels: 100}, a.Stats())
+
+	// 자원이 반환될 때까지 기다린다.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		a.Release(first)
+	}()
+	waiting, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	third, err := a.Acquire(waiting, 10, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 2, MaxJobs: 2, InFlightPixels: 50, MaxPixels: 100}, a.Stats())
+
+	// 처리 중인 작업이 없으면 상한보다 큰 이미지도 수락한다.
+	a.Release(second)
+	a.Release(third)
+	a.Release(first)
+	a.Release(12345)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 0, MaxJobs: 2, InFlightPixels: 0, MaxPixels: 100}, a.Stats())
+	_, err = a.Acquire(expired, 1000, 1)
+	assert.NoError(t, err)
+}
+
+func TestAdmission_FinishVariants(t *testing.T) {
+	a := NewAdmission(3, 0)
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	// 같은 이름의 이미지가 동시에 업로드되어도 각 작업은 서로 다른 ID로 자원을 확보한다.
+	first, err := a.Acquire(expired, 10, 2)
+	assert.NoError(t, err)
+	second, err := a.Acquire(expired, 20, 2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	// 모든 variant가 끝나야 자원을 반환한다.
+	a.FinishVariants(first, 1)
+	assert.Equal(t, 2, a.Stats().InFlightJobs)
+	a.FinishVariants(first, 1)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 1, MaxJobs: 3, InFlightPixels: 20}, a.Stats())
+	// 이미 반환된 작업은 다른 작업의 자원에 영향을 주지 않는다.
+	a.FinishVariants(first, 1)
+	a.Release(first)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 1, MaxJobs: 3, InFlightPixels: 20}, a.Stats())
+
+	a.FinishVariants(second, 2)
+	assert.Equal(t, AdmissionStats{InFlightJobs: 0, MaxJobs: 3, InFlightPixels: 0}, a.Stats())
+}
+
+func TestPixelsOf(t *testing.T) {
+	assert.Equal(t, int64(200), pixelsOf(&BaseImageTask{ImageData: image.NewRGBA(image.Rect(0, 0, 10, 20))}))
+	palette := color.Palette{color.Black, color.White}
+	frames := &gif.GIF{Image: []*image.Paletted{
+		image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+		image.NewPaletted(image.Rect(0, 0, 5, 5), palette),
+	}}
+	assert.Equal(t, int64(125), pixelsOf(&BaseImageTask{GIFImageData: frames}))
+}
+
+func TestInitTaskChannels(t *testing.T) {
+	originalConfig := Config
+	defer func() { Config = originalConfig }()
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, AlternateFormats: []string{"webp"}},
+		{Name: "resized_256", Path: "resized/256", Kind: VariantKindResize, Width: 256},
+		{Name: "resized_512", Path: "resized/512", Kind: VariantKindResize, Width: 512},
+	}}
+	Config.Queue.Size = 4
+	InitTaskChannels()
+	assert.Equal(t, 4, cap(ThumbnailTaskChan))
+	assert.Equal(t, 8, cap(ResizeTaskChan))
+	// 원본, thumbnail, thumbnail.webp, resized/256, resized/512
+	assert.Equal(t, 20, cap(UploadTaskChan))
+}
+
+func TestImageUploadRequestHandler_Backpressure(t *testing.T) {
+	originalConfig, originalAdmission := Config, TaskAdmission
+	originalChans := []interface{}{ResizeTaskChan, ThumbnailTaskChan, UploadTaskChan}
+	t.Cleanup(func() {
+		Config, TaskAdmission = originalConfig, originalAdmission
+		ResizeTaskChan = originalChans[0].(chan *ImageResizeTask)
+		ThumbnailTaskChan = originalChans[1].(chan *ImageGenerateThumbnailTask)
+		UploadTaskChan = originalChans[2].(chan *ImageUploadTask)
+	})
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128}}}
+	Config.Queue.Size = 1
+	Config.Queue.RetryAfter = 7
+	InitTaskChannels()
+	InitAdmission()
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	e := NewEcho()
+
+	upload := func(name string) *httptest.ResponseRecorder {
+		body := bytes.NewBuffer([]byte{})
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("image", name)
+		assert.NoError(t, err)
+		_, err = part.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.WriteField("hashing", "false"))
+		assert.NoError(t, writer.Close())
+		req := httptest.NewRequest("POST", "/api/images", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	// 워커 대신 작업을 꺼내 완료 처리한다.
+	finish := func() {
+		thumbnailTask := <-ThumbnailTaskChan
+		uploadTask := <-UploadTaskChan
+		Jobs.SetStatus(thumbnailTask.HashedFileName, "thumbnail", JobStatusDone)
+		FinishAdmittedVariants(thumbnailTask.BaseImageTask, 1)
+		Jobs.SetStatus(uploadTask.HashedFileName, "original", JobStatusDone)
+		FinishAdmittedVariants(uploadTask.BaseImageTask, 1)
+	}
+
+	assert.Equal(t, 200, upload("backpressure_a.png").Code)
+	rec := upload("backpressure_b.png")
+	assert.Equal(t, 503, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get("Retry-After"))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rec.Code)
+	health := struct {
+		Status    string         `json:"status"`
+		Queue     QueueDepth     `json:"queue"`
+		Admission AdmissionStats `json:"admission"`
+	}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &health))
+	assert.Equal(t, "OK", health.Status)
+	assert.Equal(t, ChannelDepth{Length: 1, Capacity: 1}, health.Queue.Thumbnail)
+	assert.Equal(t, ChannelDepth{Length: 1, Capacity: 2}, health.Queue.Upload)
+	assert.Equal(t, 1, health.Admission.InFlightJobs)
+
+	// 작업이 끝나면 다시 수락한다.
+	finish()
+	assert.Equal(t, 200, upload("backpressure_b.png").Code)
+
+	// waitTimeout 동안 여유가 생기길 기다린다.
+	Config.Queue.WaitTimeout = 5
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		finish()
+	}()
+	assert.Equal(t, 200, upload("backpressure_c.png").Code)
+	finish()
+	assert.Equal(t, 0, TaskAdmission.Stats().InFlightJobs)
+}
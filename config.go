@@ -1,26 +1,326 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"image/color"
+)
+
 var (
 	Config *BumblebeeConfig = &BumblebeeConfig{}
+
+	ErrInvalidVariantPreset = errors.New("잘못된 variant preset 설정입니다.")
+)
+
+// 어떤 작업 채널을 통해 variant를 만들지. 크기를 변경하는 방식은 같지만
+// 썸네일은 리사이징 작업들과 별도의 채널을 통해 처리되므로 리사이징 작업이 밀려있어도 먼저 만들어질 수 있다.
+const (
+	VariantKindThumbnail = "thumbnail"
+	VariantKindResize    = "resize"
 )
 
 type BumblebeeConfig struct {
 	Host                    string
 	Port                    int
 	NumOfTransformerWorkers int
-	GracefulShutdown        struct {
-		MaxTimeout      int
-		UploaderTimeout int
+	// X-Forwarded-For 헤더를 신뢰할 reverse proxy들의 CIDR (e.g. 10.0.0.0/8)
+	// 비어있으면 헤더를 무시하고 연결된 주소를 client IP로 사용한다.
+	TrustedProxies   []string
+	GracefulShutdown struct {
+		// 종료 신호를 받은 뒤 남은 작업들을 처리하기 위해 기다리는 최대 시간(초)
+		MaxTimeout int
 	}
-	Storage struct {
-		Aws struct {
-			Enabled    bool
-			BucketName string
-			Endpoint   string
+	Queue struct {
+		// 동시에 처리할 수 있는 업로드 작업 수. 작업 채널의 크기도 이에 맞춰 정해진다. 0이면 16
+		Size int
+		// 처리 중인 작업들의 디코딩된 이미지의 pixel 수 합의 상한. 0이면 제한하지 않는다.
+		MaxInFlightPixels int64
+		// 여유가 없을 때 업로드 요청이 기다리는 최대 시간(초). 0이면 기다리지 않는다.
+		WaitTimeout int
+		// 여유가 없어 거절할 때 503 응답의 Retry-After(초). 0이면 5
+		RetryAfter int
+		// 수락한 업로드 요청을 디스크에 기록해 재시작 후에도 처리할 수 있도록 함
+		Durable struct {
+			Enabled bool
+			Path    string
 		}
+	}
+	Job struct {
+		// 모든 variant 처리가 끝난 작업의 상태를 보관하는 시간(분)
+		Retention int
+	}
+	// 업로드할 수 있는 파일과 이미지의 크기 제한
+	Limits DecodeLimits
+	// 포맷별 인코딩 설정. 각 preset의 encoding으로 덮어쓸 수 있다.
+	Encoding EncoderOptions
+	// 업로드된 이미지의 exif, ICC profile 등을 저장할 때 어떻게 다룰지
+	Metadata MetadataPolicy
+	// ICC profile이 있는 이미지의 색을 변환된 이미지에서 어떻게 유지할지
+	ColorProfile ColorProfilePolicy
+	// 저장소 업로드가 실패했을 때의 재시도 정책. 각 preset의 retry로 덮어쓸 수 있다.
+	Retry RetryPolicy
+	// 재시도를 모두 실패한 업로드 작업을 보관할 곳
+	DeadLetter DeadLetterConfig
+	// 업로드된 이미지마다 만들어지는 variant들. 원본은 항상 업로드된다.
+	Variants []*VariantPreset
+	// GET /api/images/:name?w=&h=&fit=&format=&q= 로 요청한 크기, 포맷의 이미지를 만들어 제공할지
+	OnTheFly struct {
+		Enabled bool
+		// 요청할 수 있는 최대 w, h. 0이면 제한하지 않는다.
+		MaxWidth  int
+		MaxHeight int
+	}
+	// on-the-fly 변환 URL의 서명 설정
+	Signing URLSigningConfig
+	// client별 업로드 요청 수 제한
+	RateLimit RateLimitConfig
+	// client별 업로드 용량 제한
+	Quota QuotaConfig
+	// 업로드, 조회, 삭제 API의 인증 설정
+	Auth AuthConfig
+	// GET /metrics 로 Prometheus metric들을 제공할지
+	Metrics struct {
+		Enabled bool
+	}
+	// 업로드 요청부터 변환, 업로드 작업까지의 trace를 OpenTelemetry로 내보낼지
+	Tracing TracingConfig
+	// 관리자 API(e.g. 서명된 URL 발급) 설정
+	Admin struct {
+		// Authorization: Bearer <token> 헤더로 전달해야하는 token. 비어있으면 관리자 API를 사용할 수 없다.
+		Token string
+	}
+	Storage struct {
+		Aws  AwsStorageConfig
 		Disk struct {
 			Enabled  bool
 			RootPath string
+			// 파일 이름의 hash로 만드는 하위 디렉토리의 단계 수(0~4). 0이면 만들지 않는다.
+			ShardDepth int
+			// 업로드 응답의 root_endpoint. bumblebee의 /images/ 경로를 가리켜야한다. (e.g. http://localhost:9001/images/)
+			Endpoint string
 		}
 	}
 }
+
+// 원본 이미지로부터 만들어낼 variant 하나에 대한 설정
+type VariantPreset struct {
+	// 업로드 응답의 <Name>_url 필드에 사용된다. (e.g. thumbnail, resized_256)
+	Name string
+	// 저장소 내에서의 경로 (e.g. thumbnail, resized/256)
+	// 작업 상태 조회 시의 variant 이름으로도 사용된다.
+	Path string
+	// VariantKindThumbnail 혹은 VariantKindResize
+	Kind   string
+	Width  int
+	Height int
+	// 크기를 변경하는 방식 (width, height, fit, fill, pad, exact)
+	// 생략하면 height가 없는 경우 width, 있는 경우 fit을 사용한다.
+	Fit string
+	// fit이 pad일 때 남는 공간을 채울 색 (#rgb, #rrggbb, #rrggbbaa). 생략하면 흰색
+	Background string
+	// 출력 이미지 포맷 (png, jpeg, gif, webp, avif). 비어있으면 원본 포맷을 따른다.
+	Format string
+	// Format 외에 추가로 만들어낼 포맷들. 같은 path에 확장자만 다르게 저장된다.
+	// (e.g. thumbnail/abcd.png와 함께 thumbnail/abcd.webp)
+	AlternateFormats []string
+	// 이 preset에서만 사용할 인코딩 설정. 지정한 값만 전역 설정을 덮어쓴다.
+	Encoding EncoderOptions
+	// 이 preset에서만 사용할 업로드 재시도 정책. 지정한 값만 전역 설정을 덮어쓴다.
+	Retry RetryPolicy
+
+	// Background를 해석한 값. Validate 시에 설정된다.
+	background color.Color
+	// 전역 설정과 Encoding을 합친 값. Validate 시에 설정된다.
+	encoding EncoderOptions
+	// 전역 설정과 Retry를 합친 값. Validate 시에 설정된다.
+	retry RetryPolicy
+}
+
+// 설정 값들이 올바른지 확인한다.
+func (c *BumblebeeConfig) Validate() error {
+	if err := c.Limits.Validate(); err != nil {
+		return fmt.Errorf("limits: %w", err)
+	}
+	if err := c.Storage.Aws.Validate(); err != nil {
+		return fmt.Errorf("storage.aws: %w", err)
+	}
+	if c.Storage.Disk.ShardDepth < 0 || c.Storage.Disk.ShardDepth > maxDiskShardDepth {
+		return fmt.Errorf("%w storage.disk.shardDepth는 0~%d이어야합니다", ErrInvalidStorage, maxDiskShardDepth)
+	}
+	if err := c.Encoding.Validate(); err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+	if isTrue(c.Encoding.Jpeg.Progressive) && !IsProgressiveJPEGAvailable() {
+		return fmt.Errorf("encoding: %w", ErrProgressiveJPEGUnavailable)
+	}
+	if err := c.Metadata.Validate(); err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+	if err := c.ColorProfile.Validate(); err != nil {
+		return fmt.Errorf("colorProfile: %w", err)
+	}
+	if c.OnTheFly.MaxWidth < 0 || c.OnTheFly.MaxHeight < 0 {
+		return fmt.Errorf("%w onTheFly.maxWidth, maxHeight는 0 이상이어야합니다", ErrInvalidTransformParams)
+	}
+	if c.Queue.Size < 0 || c.Queue.MaxInFlightPixels < 0 || c.Queue.WaitTimeout < 0 || c.Queue.RetryAfter < 0 {
+		return fmt.Errorf("%w queue.size, maxInFlightPixels, waitTimeout, retryAfter는 0 이상이어야합니다", ErrInvalidQueueConfig)
+	}
+	if _, err := newIPExtractor(c.TrustedProxies); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("rateLimit: %w", err)
+	}
+	if err := c.Quota.Validate(); err != nil {
+		return fmt.Errorf("quota: %w", err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	if err := c.Signing.Validate(); err != nil {
+		return fmt.Errorf("signing: %w", err)
+	}
+	// 서명 없이 on-the-fly 변환을 허용하면 누구나 임의의 크기를 요청해 CPU와 저장소를 낭비시킬 수 있다.
+	if c.OnTheFly.Enabled && !c.Signing.Enabled {
+		return fmt.Errorf("%w on-the-fly 변환을 사용하려면 signing을 활성화해야합니다", ErrInvalidSigningConfig)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if err := c.DeadLetter.Validate(); err != nil {
+		return fmt.Errorf("deadLetter: %w", err)
+	}
+	if err := c.Tracing.Validate(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	names := make(map[string]bool, len(c.Variants))
+	paths := map[string]bool{"original": true, onTheFlyCachePath: true}
+	for i, preset := range c.Variants {
+		preset.Format = normalizeFormat(preset.Format)
+		formats := map[string]bool{preset.Format: true}
+		for j, format := range preset.AlternateFormats {
+			format = normalizeFormat(format)
+			preset.AlternateFormats[j] = format
+			if formats[format] || !IsEncodableFormat(format) {
+				return fmt.Errorf("%w variants[%d]: 중복되거나 지원하지 않는 alternate format입니다. format=%s", ErrInvalidVariantPreset, i, format)
+			}
+			formats[format] = true
+		}
+
+		switch {
+		case preset.Name == "" || preset.Path == "":
+			return fmt.Errorf("%w variants[%d]: name과 path는 필수입니다", ErrInvalidVariantPreset, i)
+		case names[preset.Name]:
+			return fmt.Errorf("%w variants[%d]: 중복된 name입니다. name=%s", ErrInvalidVariantPreset, i, preset.Name)
+		case paths[preset.Path]:
+			return fmt.Errorf("%w variants[%d]: 중복되거나 사용할 수 없는 path입니다. path=%s", ErrInvalidVariantPreset, i, preset.Path)
+		case preset.Kind != VariantKindThumbnail && preset.Kind != VariantKindResize:
+			return fmt.Errorf("%w variants[%d]: 지원하지 않는 kind입니다. kind=%s", ErrInvalidVariantPreset, i, preset.Kind)
+		case preset.Format != "" && !IsEncodableFormat(preset.Format):
+			return fmt.Errorf("%w variants[%d]: 지원하지 않는 format입니다. format=%s", ErrInvalidVariantPreset, i, preset.Format)
+		}
+		if err := preset.Encoding.Validate(); err != nil {
+			return fmt.Errorf("%w variants[%d]: %v", ErrInvalidVariantPreset, i, err)
+		}
+		preset.encoding = c.Encoding.Merge(preset.Encoding)
+		if err := preset.Retry.Validate(); err != nil {
+			return fmt.Errorf("%w variants[%d]: %v", ErrInvalidVariantPreset, i, err)
+		}
+		preset.retry = c.Retry.Merge(preset.Retry)
+		if isTrue(preset.encoding.Jpeg.Progressive) && !IsProgressiveJPEGAvailable() {
+			return fmt.Errorf("%w variants[%d]: %v", ErrInvalidVariantPreset, i, ErrProgressiveJPEGUnavailable)
+		}
+		if preset.Fit == "" {
+			preset.Fit = FitWidth
+			if preset.Height > 0 {
+				preset.Fit = FitContain
+			}
+		}
+		if preset.Background != "" {
+			background, err := ParseHexColor(preset.Background)
+			if err != nil {
+				return fmt.Errorf("%w variants[%d]: %v", ErrInvalidVariantPreset, i, err)
+			}
+			preset.background = background
+		}
+		if err := preset.ResizeOptions().Validate(); err != nil {
+			return fmt.Errorf("%w variants[%d]: %v", ErrInvalidVariantPreset, i, err)
+		}
+		for _, output := range preset.Outputs() {
+			if paths[output.Variant] {
+				return fmt.Errorf("%w variants[%d]: 중복되거나 사용할 수 없는 path입니다. path=%s", ErrInvalidVariantPreset, i, output.Variant)
+			}
+			paths[output.Variant] = true
+		}
+		names[preset.Name] = true
+	}
+
+	return nil
+}
+
+// 저장소 경로에 해당하는 variant preset을 찾는다. 없으면 nil을 반환한다.
+func (c *BumblebeeConfig) FindVariant(path string) *VariantPreset {
+	for _, preset := range c.Variants {
+		if preset.Path == path {
+			return preset
+		}
+	}
+	return nil
+}
+
+// variant 이름에 해당하는 preset과 출력을 찾는다.
+func (c *BumblebeeConfig) FindOutput(variant string) (*VariantPreset, VariantOutput, bool) {
+	for _, preset := range c.Variants {
+		for _, output := range preset.Outputs() {
+			if output.Variant == variant {
+				return preset, output, true
+			}
+		}
+	}
+	return nil, VariantOutput{}, false
+}
+
+// preset 하나가 만들어내는 이미지 파일 하나
+type VariantOutput struct {
+	// 작업 상태 조회와 durable queue에서 사용하는 이름
+	// Format은 preset의 path를 그대로 사용하고, AlternateFormats는 <path>.<format>을 사용한다.
+	Variant string
+	// 비어있으면 원본 포맷을 따른다.
+	Format string
+	// 업로드 응답에서 사용할 필드 이름 (e.g. thumbnail_url, thumbnail_webp_url)
+	ResponseField string
+}
+
+func (p *VariantPreset) Outputs() []VariantOutput {
+	outputs := []VariantOutput{{Variant: p.Path, Format: p.Format, ResponseField: p.Name + "_url"}}
+	for _, format := range p.AlternateFormats {
+		outputs = append(outputs, VariantOutput{
+			Variant:       p.Path + "." + format,
+			Format:        format,
+			ResponseField: p.Name + "_" + format + "_url",
+		})
+	}
+	return outputs
+}
+
+// 원본 포맷이 sourceFormat일 때 만들어질 이미지의 포맷
+func (o VariantOutput) OutputFormat(sourceFormat string) string {
+	if o.Format == "" {
+		return sourceFormat
+	}
+	return o.Format
+}
+
+// 이 preset의 이미지를 인코딩할 때 사용할 설정
+func (p *VariantPreset) EncoderOptions() EncoderOptions {
+	return p.encoding
+}
+
+// 전역 재시도 정책에 이 preset의 retry를 덮어쓴 정책
+func (p *VariantPreset) RetryPolicy() RetryPolicy {
+	return p.retry
+}
+
+func (p *VariantPreset) ResizeOptions() ResizeOptions {
+	return ResizeOptions{Width: p.Width, Height: p.Height, Fit: p.Fit, Background: p.background}
+}
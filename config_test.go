@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBumblebeeConfig_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		presets []*VariantPreset
+		isError bool
+	}{
+		{name: "정상", presets: []*VariantPreset{
+			{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128},
+			{Name: "resized_256", Path: "resized/256", Kind: VariantKindResize, Width: 256, Format: "JPG", Encoding: EncoderOptions{Jpeg: JpegOptions{Quality: 80}}},
+		}},
+		{name: "name_누락", presets: []*VariantPreset{
+			{Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128},
+		}, isError: true},
+		{name: "중복된_path", presets: []*VariantPreset{
+			{Name: "a", Path: "resized/256", Kind: VariantKindResize, Width: 256},
+			{Name: "b", Path: "resized/256", Kind: VariantKindResize, Width: 256},
+		}, isError: true},
+		{name: "original_path는_사용할_수_없음", presets: []*VariantPreset{
+			{Name: "a", Path: "original", Kind: VariantKindResize, Width: 256},
+		}, isError: true},
+		{name: "지원하지_않는_kind", presets: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: "crop", Width: 256},
+		}, isError: true},
+		{name: "지원하지_않는_format", presets: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256, Format: "tiff"},
+		}, isError: true},
+		{name: "중복된_alternate_format", presets: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256, Format: "png", AlternateFormats: []string{"png"}},
+		}, isError: true},
+		{name: "지원하지_않는_alternate_format", presets: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256, AlternateFormats: []string{"tiff"}},
+		}, isError: true},
+		{name: "잘못된_width", presets: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: VariantKindResize},
+		}, isError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &BumblebeeConfig{Variants: tc.presets}
+			err := cfg.Validate()
+			if tc.isError {
+				assert.ErrorIs(t, err, ErrInvalidVariantPreset)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestBumblebeeConfig_Validate_DefaultFit(t *testing.T) {
+	cfg := &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256},
+		{Name: "b", Path: "b", Kind: VariantKindThumbnail, Width: 128, Height: 128},
+		{Name: "c", Path: "c", Kind: VariantKindThumbnail, Width: 128, Height: 128, Fit: FitPad, Background: "#000"},
+	}}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, FitWidth, cfg.FindVariant("a").Fit)
+	assert.Equal(t, FitContain, cfg.FindVariant("b").Fit)
+	assert.NotNil(t, cfg.FindVariant("c").ResizeOptions().Background)
+
+	cfg = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256, Fit: FitFill},
+	}}
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidVariantPreset)
+}
+
+func TestVariantPreset_Outputs(t *testing.T) {
+	cfg := &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "a", Path: "a", Kind: VariantKindResize, Width: 256, Format: "jpg"},
+		{Name: "b", Path: "b", Kind: VariantKindResize, Width: 256, AlternateFormats: []string{"GIF"}},
+	}}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, "jpeg", cfg.FindVariant("a").Outputs()[0].OutputFormat("png"))
+	assert.Nil(t, cfg.FindVariant("c"))
+
+	outputs := cfg.FindVariant("b").Outputs()
+	assert.Equal(t, []VariantOutput{
+		{Variant: "b", Format: "", ResponseField: "b_url"},
+		{Variant: "b.gif", Format: "gif", ResponseField: "b_gif_url"},
+	}, outputs)
+	assert.Equal(t, "png", outputs[0].OutputFormat("png"))
+	assert.Equal(t, "gif", outputs[1].OutputFormat("png"))
+
+	preset, output, ok := cfg.FindOutput("b.gif")
+	assert.True(t, ok)
+	assert.Equal(t, "b", preset.Name)
+	assert.Equal(t, "gif", output.Format)
+	_, _, ok = cfg.FindOutput("b.png")
+	assert.False(t, ok)
+}
+
+func TestBumblebeeConfig_Validate_Encoding(t *testing.T) {
+	enabled := true
+	cfg := &BumblebeeConfig{
+		Encoding: EncoderOptions{Jpeg: JpegOptions{Quality: 85}, Png: PngOptions{Compression: PNGCompressionBest}},
+		Variants: []*VariantPreset{
+			{Name: "a", Path: "a", Kind: VariantKindThumbnail, Width: 128, Encoding: EncoderOptions{Jpeg: JpegOptions{Quality: 60}}},
+			{Name: "b", Path: "b", Kind: VariantKindResize, Width: 1024},
+		},
+	}
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, 60, cfg.FindVariant("a").EncoderOptions().Jpeg.Quality)
+	assert.Equal(t, PNGCompressionBest, cfg.FindVariant("a").EncoderOptions().Png.Compression)
+	assert.Equal(t, 85, cfg.FindVariant("b").EncoderOptions().Jpeg.Quality)
+
+	cfg = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "a", Path: "a", Kind: VariantKindThumbnail, Width: 128, Encoding: EncoderOptions{Gif: GifOptions{PaletteSize: 512}}},
+	}}
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidVariantPreset)
+
+	cfg = &BumblebeeConfig{Encoding: EncoderOptions{Png: PngOptions{Compression: "zopfli"}}}
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidEncoderOptions)
+
+	// jpegtran 없이 progressive jpeg를 사용할 수 없다.
+	defer func(original string) { jpegtranPath = original }(jpegtranPath)
+	jpegtranPath = ""
+	cfg = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "a", Path: "a", Kind: VariantKindThumbnail, Width: 128, Encoding: EncoderOptions{Jpeg: JpegOptions{Progressive: &enabled}}},
+	}}
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidVariantPreset)
+}
+
+func TestBumblebeeConfig_Validate_Storage(t *testing.T) {
+	cfg := &BumblebeeConfig{}
+	cfg.Storage.Disk.ShardDepth = 2
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Storage.Disk.ShardDepth = 5
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidStorage)
+}
+
+func TestBumblebeeConfig_Validate_Queue(t *testing.T) {
+	cfg := &BumblebeeConfig{}
+	cfg.Queue.Size = 4
+	cfg.Queue.WaitTimeout = 3
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Queue.MaxInFlightPixels = -1
+	err := cfg.Validate()
+	assert.ErrorIs(t, err, ErrInvalidQueueConfig)
+	assert.NotErrorIs(t, err, ErrInvalidRateLimitConfig)
+}
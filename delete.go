@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var ErrImageNotFound = errors.New("존재하지 않는 이미지입니다.")
+
+// 이미지 파일 하나의 삭제 결과
+type DeleteResult struct {
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// 요청의 name에서 hashed file name을 얻는다.
+// name은 업로드 응답의 file_name(확장자 포함)이나 확장자를 제외한 이름 모두 가능하다.
+// hashing=false로 업로드한 이름에는 .이 포함될 수 있으므로 이미지 포맷인 확장자만 제거한다.
+func hashedFileNameOf(name string) string {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if ext != "" && (IsEncodableFormat(normalizeFormat(ext)) || ext == "bmp") {
+		return strings.TrimSuffix(name, "."+ext)
+	}
+	return name
+}
+
+// 업로드된 이미지 하나로부터 만들어진 모든 파일의 key.
+// 원본과 각 variant preset의 경로에서 <hashedFileName>.<format> 형태의 파일을 모두 찾으므로
+// 원본의 포맷이나 preset의 format, alternateFormats와 관계 없이 찾을 수 있다.
+// on-the-fly로 변환되어 cache/<hashedFileName>/ 아래에 저장된 파일들도 포함한다.
+func ImageKeys(storage Storage, hashedFileName string) ([]string, error) {
+	dirs := []string{"original"}
+	for _, preset := range Config.Variants {
+		dirs = append(dirs, preset.Path)
+	}
+	keys := make([]string, 0)
+	for _, dir := range dirs {
+		objects, err := storage.List(dir + "/" + hashedFileName + ".")
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			// 다른 이미지의 파일(e.g. abcd.efgh.png)은 제외한다.
+			base := path.Base(object.Key)
+			if path.Dir(object.Key) == dir && strings.TrimSuffix(base, path.Ext(base)) == hashedFileName {
+				keys = append(keys, object.Key)
+			}
+		}
+	}
+	cached, err := storage.List(path.Join(onTheFlyCachePath, hashedFileName) + "/")
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range cached {
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+// 업로드된 이미지의 원본과 모든 variant를 삭제한다.
+// 하나라도 삭제되지 않으면 나머지는 계속 삭제하고 각 파일의 결과를 반환한다.
+func DeleteImage(storage Storage, hashedFileName string) ([]DeleteResult, error) {
+	keys, err := ImageKeys(storage, hashedFileName)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrImageNotFound
+	}
+	results := make([]DeleteResult, 0, len(keys))
+	for _, key := range keys {
+		result := DeleteResult{Key: key, Deleted: true}
+		if err := storage.Delete(key); err != nil {
+			result.Deleted, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// 특정 key의 삭제에 실패하는 저장소
+type failingDeleteStorage struct {
+	Storage
+	failKey string
+}
+
+func (s *failingDeleteStorage) Delete(key string) error {
+	if key == s.failKey {
+		return errors.New("삭제 실패")
+	}
+	return s.Storage.Delete(key)
+}
+
+func beforeEachDeleteTest(t *testing.T) Storage {
+	originalConfig := Config
+	t.Cleanup(func() { Config = originalConfig })
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, AlternateFormats: []string{"webp"}},
+		{Name: "resized_256", Path: "resized/256", Kind: VariantKindResize, Width: 256},
+	}}
+
+	storage := NewDiskStorage(t.TempDir(), 0)
+	for _, key := range []string{
+		"original/abcd.png", "thumbnail/abcd.png", "thumbnail/abcd.webp", "resized/256/abcd.png",
+		"cache/abcd/w64_h0_width_q0.png",
+		// 다른 이미지의 파일들
+		"original/abcd.efgh.png", "original/abcdef.png", "resized/256/abcd/abcd.png", "cache/abcdef/w64_h0_width_q0.png",
+	} {
+		assert.NoError(t, storage.Put(key, bytes.NewBufferString(key), "image/png"))
+	}
+	return storage
+}
+
+func TestHashedFileNameOf(t *testing.T) {
+	assert.Equal(t, "abcd", hashedFileNameOf("abcd.png"))
+	assert.Equal(t, "abcd", hashedFileNameOf("abcd.jpg"))
+	assert.Equal(t, "abcd", hashedFileNameOf("abcd"))
+	assert.Equal(t, "my.photo", hashedFileNameOf("my.photo"))
+}
+
+func TestImageKeys(t *testing.T) {
+	storage := beforeEachDeleteTest(t)
+	keys, err := ImageKeys(storage, "abcd")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"original/abcd.png", "thumbnail/abcd.png", "thumbnail/abcd.webp", "resized/256/abcd.png", "cache/abcd/w64_h0_width_q0.png"}, keys)
+}
+
+func TestDeleteImage(t *testing.T) {
+	t.Run("원본과_모든_variant_삭제", func(t *testing.T) {
+		storage := beforeEachDeleteTest(t)
+		results, err := DeleteImage(storage, "abcd")
+		assert.NoError(t, err)
+		assert.Len(t, results, 5)
+		for _, result := range results {
+			assert.True(t, result.Deleted)
+			_, err := storage.Stat(result.Key)
+			assert.ErrorIs(t, err, ErrObjectNotFound)
+		}
+		// 다른 이미지의 파일은 남아있다.
+		for _, key := range []string{"original/abcd.efgh.png", "original/abcdef.png", "resized/256/abcd/abcd.png", "cache/abcdef/w64_h0_width_q0.png"} {
+			_, err := storage.Stat(key)
+			assert.NoError(t, err)
+		}
+
+		_, err = DeleteImage(storage, "abcd")
+		assert.ErrorIs(t, err, ErrImageNotFound)
+	})
+
+	t.Run("일부_실패", func(t *testing.T) {
+		storage := &failingDeleteStorage{Storage: beforeEachDeleteTest(t), failKey: "thumbnail/abcd.webp"}
+		results, err := DeleteImage(storage, "abcd")
+		assert.NoError(t, err)
+		for _, result := range results {
+			assert.Equal(t, result.Key != "thumbnail/abcd.webp", result.Deleted, result.Key)
+		}
+		_, err = storage.Stat("resized/256/abcd.png")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	})
+}
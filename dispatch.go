@@ -1,41 +1,114 @@
 package main
 
-import "github.com/sirupsen/logrus"
+import (
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// extension 포맷의 이미지가 업로드되었을 때 만들어지는 variant들.
+// variant의 이름은 업로드 경로와 같고, 추가 포맷은 경로 뒤에 포맷이 붙는다. (e.g. original, thumbnail, thumbnail.webp, resized/256)
+// format을 생략한 preset은 원본 포맷을 따르므로, 원본 포맷과 같은 alternate format은 같은 파일에 저장되어 제외한다.
+// (e.g. png 이미지에 대한 format: "", alternateFormats: [png])
+func VariantsOf(extension string) []string {
+	extension = normalizeFormat(extension)
+	variants := []string{"original"}
+	for _, preset := range Config.Variants {
+		primary := preset.Outputs()[0].OutputFormat(extension)
+		for i, output := range preset.Outputs() {
+			if i > 0 && output.Format == primary {
+				continue
+			}
+			variants = append(variants, output.Variant)
+		}
+	}
+	return variants
+}
 
 // 기본적으로 이미지 분석 요청이 들어오면
 // 썸네일 요청 변환 요청
 // 그 외의 리사이징 변환 요청
 // 원본이미지 업로드 요청을 만든다.
+// 어떤 썸네일, 리사이징 작업을 만들지는 Config.Variants를 따른다.
 func DispatchMessages(baseImageTask *BaseImageTask) {
+	DispatchVariants(baseImageTask, VariantsOf(baseImageTask.Extension))
+}
+
+// variants에 해당하는 작업만 만든다.
+// durable queue에서 완료되지 않은 작업을 복구할 때처럼 일부 variant만 다시 처리해야하는 경우에 사용한다.
+func DispatchVariants(baseImageTask *BaseImageTask, variants []string) {
 	// base image task를 복제하면 imageData가 복제되어 메모리를 너무 많이 점유하지는 않을까?
 	// => imageData안에는 결국 byte arr의 데이터가 들어있을텐데, 이는 = 할당을 해도 deepcopy 되는 것이아니라
 	// 같은 arr을 참조하는 slice일 뿐임.
 
+	// 각 variant의 진행 상황을 조회할 수 있도록 Job을 등록
+	Jobs.Register(baseImageTask.HashedFileName, variants...)
+	Jobs.SetOwner(baseImageTask.HashedFileName, baseImageTask.Principal)
+
+	// 만들어진 작업들은 모두 dispatch span의 자식 span에서 처리된다.
+	_, span := startTaskSpan(baseImageTask, "dispatch", attribute.StringSlice("bumblebee.variants", variants))
+	defer span.End()
+	baseImageTask.SpanContext = span.SpanContext()
+
+	// 같은 preset의 출력들은 한 번의 변환 작업으로 만든다.
+	presets := make([]*VariantPreset, 0)
+	outputs := make(map[*VariantPreset][]VariantOutput)
+	uploadOriginal := false
+	for _, variant := range variants {
+		if variant == "original" {
+			uploadOriginal = true
+			continue
+		}
+		preset, output, ok := Config.FindOutput(variant)
+		if !ok {
+			// 설정이 바뀌어 더 이상 존재하지 않는 preset
+			logrus.Warnf("존재하지 않는 variant preset입니다. variant=%s", variant)
+			Jobs.SetFailed(baseImageTask.HashedFileName, variant, ErrInvalidVariantPreset)
+			FinishAdmittedVariants(baseImageTask, 1)
+			continue
+		}
+		if _, exists := outputs[preset]; !exists {
+			presets = append(presets, preset)
+		}
+		outputs[preset] = append(outputs[preset], output)
+	}
+
+	// TaskAdmission으로 수락된 작업이므로 채널에 여유가 있다. (InitTaskChannels 참고)
 	// Enqueue 섬네일 생성 작업
-	go func() {
+	for _, preset := range presets {
+		if preset.Kind != VariantKindThumbnail {
+			continue
+		}
 		ThumbnailTaskChan <- &ImageGenerateThumbnailTask{
 			BaseImageTask: baseImageTask,
+			Preset:        preset,
+			Outputs:       outputs[preset],
 		}
-		logrus.Info("Enqueued thumbnail task")
-	}()
+		logrus.Info("Enqueued thumbnail task for ", preset.Name)
+	}
 
 	// Enqueue 리사이징 생성 작업
-	go func() {
-		for _, size := range ResizeSizes {
-			ResizeTaskChan <- &ImageResizeTask{
-				BaseImageTask: baseImageTask,
-				ResizingWidth: size,
-			}
-			logrus.Info("Enqueued resize task for ", size)
+	for _, preset := range presets {
+		if preset.Kind != VariantKindResize {
+			continue
+		}
+		ResizeTaskChan <- &ImageResizeTask{
+			BaseImageTask: baseImageTask,
+			Preset:        preset,
+			Outputs:       outputs[preset],
 		}
-	}()
+		logrus.Info("Enqueued resize task for ", preset.Name)
+	}
 
 	// Upload original image
-	go func() {
+	if uploadOriginal {
 		UploadTaskChan <- &ImageUploadTask{
 			BaseImageTask: baseImageTask,
 			UploadPath:    "original",
+			Variant:       "original",
+			Encoding:      Config.Encoding,
+			RawData:       baseImageTask.OriginalData,
+			Retry:         Config.Retry,
 		}
 		logrus.Info("Enqueued upload task")
-	}()
+	}
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVariantsOf(t *testing.T) {
+	originalConfig := Config
+	defer func() { Config = originalConfig }()
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, AlternateFormats: []string{"png", "webp"}},
+		{Name: "resized_256", Path: "resized/256", Kind: VariantKindResize, Width: 256, Format: "jpeg", AlternateFormats: []string{"png"}},
+	}}
+	assert.NoError(t, Config.Validate())
+
+	// 원본 포맷을 따르는 preset의 alternate format이 원본 포맷과 같으면 같은 파일을 만들게 되므로 제외한다.
+	assert.Equal(t, []string{"original", "thumbnail", "thumbnail.webp", "resized/256", "resized/256.png"}, VariantsOf("png"))
+	assert.Equal(t, []string{"original", "thumbnail", "thumbnail.png", "thumbnail.webp", "resized/256", "resized/256.png"}, VariantsOf("jpeg"))
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walFileName        = "wal.log"
+	walOriginalsDir    = "originals"
+	walOpAccept        = "accept"
+	walOpFinish        = "finish"
+	walCompactFileName = "wal.log.compact"
+	// 완료된 작업의 record가 log의 대부분을 차지하게 되면 log를 압축한다.
+	// record 수가 완료되지 않은 작업 수의 walCompactRatio배 이상일 때
+	walCompactRatio = 4
+)
+
+var (
+	// Config.Queue.Durable.Enabled인 경우에만 사용된다.
+	DurableTaskQueue *DurableQueue
+
+	// log의 record 수가 이보다 적으면 압축하지 않는다.
+	walCompactMinRecords = 1024
+
+	ErrDurableQueueClosed  = errors.New("durable queue가 이미 닫혔습니다.")
+	ErrUnableToPersistTask = errors.New("업로드 작업을 저장하지 못했습니다. 잠시 후 다시 시도해주세요.")
+)
+
+// 채널에 들어있는 작업은 프로세스가 종료되면 사라지므로
+// 업로드 요청을 수락한 시점에 원본 파일과 처리해야할 variant 목록을 디스크에 기록해두고,
+// 재시작 시에 완료되지 않은 variant들을 다시 처리할 수 있도록 하는 write-ahead log
+//
+// <Path>/wal.log 에는 한 줄에 하나씩 json 형태의 record가 append되고,
+// <Path>/originals/ 에는 수락된 원본 파일이 그대로 저장된다.
+// log는 열 때와 완료된 작업의 record가 쌓였을 때 완료되지 않은 작업만 남도록 압축된다.
+type DurableQueue struct {
+	mu  sync.Mutex
+	dir string
+	log *os.File
+	// 아직 완료되지 않은 작업들. HashedFileName => 작업
+	pending map[string]*pendingEntry
+	// 마지막으로 수락된 작업의 순서
+	lastSeq uint64
+	// log에 기록된 record 수
+	records int
+}
+
+// durable queue에 기록된 완료되지 않은 작업
+type pendingEntry struct {
+	// 작업을 수락할 때 기록한 record. 압축 시에 남은 variant들과 함께 다시 기록된다.
+	record *walRecord
+	// 아직 완료되지 않은 variant set
+	variants map[string]struct{}
+	// 수락된 순서. 압축한 뒤에도 재시작 시 수락된 순서대로 복구한다.
+	seq uint64
+}
+
+type walRecord struct {
+	Op               string   `json:"op"`
+	HashedFileName   string   `json:"hashed_file_name"`
+	OriginalFileName string   `json:"original_file_name,omitempty"`
+	Extension        string   `json:"extension,omitempty"`
+	Variants         []string `json:"variants,omitempty"`
+	Variant          string   `json:"variant,omitempty"`
+	// 재시작 후에도 작업의 소유자를 유지하기 위해 기록한다.
+	Principal *Principal `json:"principal,omitempty"`
+}
+
+// 재시작 후 다시 처리해야하는 작업
+type PendingJob struct {
+	HashedFileName   string
+	OriginalFileName string
+	Extension        string
+	// 아직 완료되지 않은 variant들
+	Variants []string
+	// 수락 당시의 원본 파일
+	Data []byte
+	// 업로드를 요청한 주체
+	Principal *Principal
+}
+
+// dir에 있는 log를 읽어 완료되지 않은 작업들을 복구하고, 이후의 기록을 위해 log를 연다.
+// 완료된 작업들은 log와 원본 파일 저장소에서 정리된다.
+func OpenDurableQueue(dir string) (*DurableQueue, []*PendingJob, error) {
+	if err := os.MkdirAll(filepath.Join(dir, walOriginalsDir), 0755); err != nil {
+		return nil, nil, err
+	}
+	q := &DurableQueue{dir: dir, pending: make(map[string]*pendingEntry)}
+
+	records, err := q.readRecords()
+	if err != nil {
+		return nil, nil, err
+	}
+	// 같은 이름의 작업이 다시 수락될 수도 있으므로 마지막 상태를 기준으로 한다.
+	for _, record := range records {
+		switch record.Op {
+		case walOpAccept:
+			q.addPendingLocked(record)
+		case walOpFinish:
+			if entry, ok := q.pending[record.HashedFileName]; ok {
+				delete(entry.variants, record.Variant)
+			}
+		}
+	}
+
+	pendingJobs := make([]*PendingJob, 0)
+	for _, name := range q.pendingNamesLocked() {
+		entry := q.pending[name]
+		if len(entry.variants) == 0 {
+			delete(q.pending, name)
+			q.removeOriginal(name)
+			continue
+		}
+		data, err := ioutil.ReadFile(q.originalPath(name))
+		if err != nil {
+			// 원본이 없으면 다시 처리할 방법이 없다.
+			logrus.Errorf("복구할 작업의 원본 파일을 읽을 수 없어 작업을 버립니다. name=%s, err=%v", name, err)
+			delete(q.pending, name)
+			continue
+		}
+		pendingJobs = append(pendingJobs, &PendingJob{
+			HashedFileName:   name,
+			OriginalFileName: entry.record.OriginalFileName,
+			Extension:        entry.record.Extension,
+			Variants:         entry.remainingVariants(),
+			Data:             data,
+			Principal:        entry.record.Principal,
+		})
+	}
+
+	if err := q.compactLocked(); err != nil {
+		return nil, nil, err
+	}
+	q.removeOrphanOriginals()
+	if err := q.openLogLocked(); err != nil {
+		return nil, nil, err
+	}
+	logrus.Infof("Durable queue를 열었습니다. path=%s, 복구할 작업 수=%d", dir, len(pendingJobs))
+
+	return q, pendingJobs, nil
+}
+
+// 업로드 요청을 수락했음을 기록한다. 원본 파일을 먼저 저장한 뒤 log에 기록하므로
+// log에 기록된 작업은 항상 원본 파일을 갖는다.
+func (q *DurableQueue) Accept(task *BaseImageTask, data []byte, variants []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil {
+		return ErrDurableQueueClosed
+	}
+
+	if err := writeFileSync(q.originalPath(task.HashedFileName), data); err != nil {
+		return err
+	}
+	record := &walRecord{
+		Op:               walOpAccept,
+		HashedFileName:   task.HashedFileName,
+		OriginalFileName: task.OriginalFileName,
+		Extension:        task.Extension,
+		Variants:         variants,
+		Principal:        task.Principal,
+	}
+	if err := q.appendLocked(record); err != nil {
+		return err
+	}
+	q.addPendingLocked(record)
+	return nil
+}
+
+// variant의 처리가 끝났음을 기록한다. 성공, 실패 여부와 관계 없이 다시 처리하지 않는다.
+// 모든 variant가 끝나면 원본 파일을 지운다.
+func (q *DurableQueue) Finish(hashedFileName, variant string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil {
+		return ErrDurableQueueClosed
+	}
+	entry, ok := q.pending[hashedFileName]
+	if !ok {
+		return nil
+	}
+	if _, ok := entry.variants[variant]; !ok {
+		return nil
+	}
+
+	if err := q.appendLocked(&walRecord{Op: walOpFinish, HashedFileName: hashedFileName, Variant: variant}); err != nil {
+		return err
+	}
+	delete(entry.variants, variant)
+	if len(entry.variants) == 0 {
+		delete(q.pending, hashedFileName)
+		q.removeOriginal(hashedFileName)
+	}
+	if q.records >= walCompactMinRecords && q.records >= walCompactRatio*len(q.pending) {
+		return q.rotateLocked()
+	}
+	return nil
+}
+
+// 아직 완료되지 않은 작업의 수
+func (q *DurableQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+func (q *DurableQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log == nil {
+		return nil
+	}
+	err := q.log.Close()
+	q.log = nil
+	return err
+}
+
+func (q *DurableQueue) String() string {
+	return fmt.Sprintf("DurableQueue(path: %s)", q.dir)
+}
+
+func (q *DurableQueue) appendLocked(record *walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := q.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.records++
+	return q.log.Sync()
+}
+
+// 수락된 작업을 완료되지 않은 작업으로 등록한다. 같은 이름의 작업이 있으면 덮어쓴다.
+func (q *DurableQueue) addPendingLocked(record *walRecord) {
+	variants := make(map[string]struct{}, len(record.Variants))
+	for _, variant := range record.Variants {
+		variants[variant] = struct{}{}
+	}
+	q.lastSeq++
+	q.pending[record.HashedFileName] = &pendingEntry{record: record, variants: variants, seq: q.lastSeq}
+}
+
+// 완료되지 않은 작업들의 이름을 수락된 순서대로 반환한다.
+func (q *DurableQueue) pendingNamesLocked() []string {
+	names := make([]string, 0, len(q.pending))
+	for name := range q.pending {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return q.pending[names[i]].seq < q.pending[names[j]].seq })
+	return names
+}
+
+func (e *pendingEntry) remainingVariants() []string {
+	variants := make([]string, 0, len(e.variants))
+	for variant := range e.variants {
+		variants = append(variants, variant)
+	}
+	sort.Strings(variants)
+	return variants
+}
+
+func (q *DurableQueue) openLogLocked() error {
+	file, err := os.OpenFile(filepath.Join(q.dir, walFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	q.log = file
+	return nil
+}
+
+// 열려있는 log를 닫고 압축한 뒤 다시 연다.
+func (q *DurableQueue) rotateLocked() error {
+	logrus.Infof("Durable queue의 log를 압축합니다. record 수=%d, 완료되지 않은 작업 수=%d", q.records, len(q.pending))
+	if err := q.log.Close(); err != nil {
+		return err
+	}
+	q.log = nil
+	// 압축에 실패해도 기존 log에 이어서 기록한다.
+	compactErr := q.compactLocked()
+	if err := q.openLogLocked(); err != nil {
+		return err
+	}
+	return compactErr
+}
+
+func (q *DurableQueue) readRecords() ([]*walRecord, error) {
+	file, err := os.Open(filepath.Join(q.dir, walFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	records := make([]*walRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		record := &walRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			// 기록 도중 종료되어 마지막 줄이 잘린 경우
+			logrus.Warnf("Durable queue의 손상된 record를 무시합니다. err=%v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// 완료되지 않은 작업만 남도록 log를 새로 쓴다.
+func (q *DurableQueue) compactLocked() error {
+	buf := make([]byte, 0)
+	names := q.pendingNamesLocked()
+	for _, name := range names {
+		entry := q.pending[name]
+		record := *entry.record
+		record.Variants = entry.remainingVariants()
+		line, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	compactPath := filepath.Join(q.dir, walCompactFileName)
+	if err := writeFileSync(compactPath, buf); err != nil {
+		return err
+	}
+	if err := os.Rename(compactPath, filepath.Join(q.dir, walFileName)); err != nil {
+		return err
+	}
+	q.records = len(names)
+	return nil
+}
+
+// 사용자가 정한 이름(hashing=false)에는 경로 구분자 등이 포함될 수 있으므로 해싱한 이름으로 저장한다.
+func (q *DurableQueue) originalPath(hashedFileName string) string {
+	sum := sha256.Sum256([]byte(hashedFileName))
+	return filepath.Join(q.dir, walOriginalsDir, hex.EncodeToString(sum[:]))
+}
+
+// 원본 파일은 저장했지만 log에 기록하기 전에 종료된 경우 남게 되는 파일들을 지운다.
+func (q *DurableQueue) removeOrphanOriginals() {
+	referenced := make(map[string]bool, len(q.pending))
+	for name := range q.pending {
+		referenced[q.originalPath(name)] = true
+	}
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, walOriginalsDir))
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, file := range files {
+		filePath := filepath.Join(q.dir, walOriginalsDir, file.Name())
+		if !referenced[filePath] {
+			if err := os.Remove(filePath); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+}
+
+func (q *DurableQueue) removeOriginal(hashedFileName string) {
+	if err := os.Remove(q.originalPath(hashedFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Error(err)
+	}
+}
+
+// 파일을 쓰고 디스크에 반영될 때까지 기다린다.
+func writeFileSync(name string, data []byte) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
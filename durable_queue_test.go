@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDurableQueue_Recover(t *testing.T) {
+	dir := t.TempDir()
+	queue, pendingJobs, err := OpenDurableQueue(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, pendingJobs)
+
+	finished := &BaseImageTask{OriginalFileName: "a.png", HashedFileName: "aaaa", Extension: "png"}
+	unfinished := &BaseImageTask{OriginalFileName: "b.jpeg", HashedFileName: "bbbb", Extension: "jpeg", Principal: &Principal{Type: PrincipalTypeJWT, ID: "user-1"}}
+	assert.NoError(t, queue.Accept(finished, []byte("a"), []string{"original", "thumbnail"}))
+	assert.NoError(t, queue.Accept(unfinished, []byte("b"), []string{"original", "thumbnail", "resized/256"}))
+	assert.NoError(t, queue.Finish("aaaa", "original"))
+	assert.NoError(t, queue.Finish("aaaa", "thumbnail"))
+	assert.NoError(t, queue.Finish("bbbb", "thumbnail"))
+	assert.Equal(t, 1, queue.Len())
+	assert.NoError(t, queue.Close())
+
+	// 재시작
+	queue, pendingJobs, err = OpenDurableQueue(dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+	if assert.Len(t, pendingJobs, 1) {
+		job := pendingJobs[0]
+		assert.Equal(t, "bbbb", job.HashedFileName)
+		assert.Equal(t, "b.jpeg", job.OriginalFileName)
+		assert.Equal(t, []string{"original", "resized/256"}, job.Variants)
+		assert.Equal(t, []byte("b"), job.Data)
+		assert.Equal(t, unfinished.Principal, job.Principal)
+	}
+
+	// 완료된 작업의 원본은 남지 않는다.
+	originals, err := ioutil.ReadDir(filepath.Join(dir, walOriginalsDir))
+	assert.NoError(t, err)
+	assert.Len(t, originals, 1)
+}
+
+func TestDurableQueue_Finish(t *testing.T) {
+	queue, _, err := OpenDurableQueue(t.TempDir())
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	task := &BaseImageTask{OriginalFileName: "a.png", HashedFileName: "aaaa", Extension: "png"}
+	assert.NoError(t, queue.Accept(task, []byte("a"), []string{"original"}))
+	// 등록되지 않은 작업이나 variant는 무시한다.
+	assert.NoError(t, queue.Finish("unknown", "original"))
+	assert.NoError(t, queue.Finish("aaaa", "thumbnail"))
+	assert.Equal(t, 1, queue.Len())
+
+	assert.NoError(t, queue.Finish("aaaa", "original"))
+	assert.Equal(t, 0, queue.Len())
+
+	assert.NoError(t, queue.Close())
+	assert.ErrorIs(t, queue.Finish("aaaa", "original"), ErrDurableQueueClosed)
+}
+
+func TestDurableQueue_Compact(t *testing.T) {
+	defer func(original int) { walCompactMinRecords = original }(walCompactMinRecords)
+	walCompactMinRecords = 8
+	dir := t.TempDir()
+	queue, _, err := OpenDurableQueue(dir)
+	assert.NoError(t, err)
+
+	unfinished := &BaseImageTask{OriginalFileName: "a.png", HashedFileName: "aaaa", Extension: "png"}
+	assert.NoError(t, queue.Accept(unfinished, []byte("a"), []string{"original", "thumbnail"}))
+	assert.NoError(t, queue.Finish("aaaa", "thumbnail"))
+	for i := 0; i < 10; i++ {
+		task := &BaseImageTask{OriginalFileName: "b.png", HashedFileName: fmt.Sprintf("b%d", i), Extension: "png"}
+		assert.NoError(t, queue.Accept(task, []byte("b"), []string{"original"}))
+		assert.NoError(t, queue.Finish(task.HashedFileName, "original"))
+	}
+
+	// 실행 중에도 완료된 작업의 record들이 log에서 정리된다.
+	log, err := ioutil.ReadFile(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.Less(t, bytes.Count(log, []byte("\n")), walCompactMinRecords)
+	assert.Equal(t, 1, queue.Len())
+
+	// 압축한 뒤에도 이어서 기록하고 재시작 시 복구할 수 있다.
+	assert.NoError(t, queue.Accept(&BaseImageTask{OriginalFileName: "c.png", HashedFileName: "cccc", Extension: "png"}, []byte("c"), []string{"original"}))
+	assert.NoError(t, queue.Close())
+	queue, pendingJobs, err := OpenDurableQueue(dir)
+	assert.NoError(t, err)
+	defer queue.Close()
+	if assert.Len(t, pendingJobs, 2) {
+		assert.Equal(t, "aaaa", pendingJobs[0].HashedFileName)
+		assert.Equal(t, []string{"original"}, pendingJobs[0].Variants)
+		assert.Equal(t, []byte("a"), pendingJobs[0].Data)
+		assert.Equal(t, "cccc", pendingJobs[1].HashedFileName)
+	}
+}
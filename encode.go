@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnsupportedFormat          = errors.New("인코딩을 지원하지 않는 이미지 포맷입니다.")
+	ErrProgressiveJPEGUnavailable = errors.New("jpegtran을 찾을 수 없어 progressive jpeg로 인코딩할 수 없습니다.")
+
+	// 포맷별 인코더. cgo나 외부 프로그램이 필요한 포맷(webp, avif)은 사용할 수 있는 경우에만 등록된다.
+	encoders = map[string]Encoder{
+		"png":  encodePNG,
+		"jpeg": encodeJPEG,
+		"gif":  encodeGIF,
+	}
+	// EnableProgressiveJPEG로 설정된 jpegtran 실행 파일 경로
+	jpegtranPath string
+	// 외부 command(avifenc, jpegtran)로 인코딩할 때의 최대 시간. InitEncoders에서 Config.Encoding.CommandTimeout으로 설정된다.
+	externalEncoderTimeout = defaultExternalEncoderTimeout
+)
+
+// Config.Encoding.CommandTimeout을 지정하지 않았을 때 외부 command로 인코딩하는 최대 시간
+const defaultExternalEncoderTimeout = 30 * time.Second
+
+// 업로드 작업의 이미지를 w에 인코딩한다. ctx가 끝나면 외부 command를 사용하는 인코더는 command를 종료한다.
+type Encoder func(ctx context.Context, w io.Writer, task *ImageUploadTask) error
+
+// format에 대한 인코더를 등록한다. 서버가 작업을 시작하기 전에만 호출해야한다.
+func RegisterEncoder(format string, encoder Encoder) {
+	encoders[format] = encoder
+}
+
+// 인코딩할 수 있는 이미지 포맷인지
+func IsEncodableFormat(format string) bool {
+	_, ok := encoders[normalizeFormat(format)]
+	return ok
+}
+
+// 업로드 작업의 이미지를 task.Extension 포맷으로 인코딩한다.
+// 원본과 다른 포맷으로 변환하는 경우 gif는 첫 프레임만 사용된다.
+// task.Metadata는 jpeg, png, webp, avif에만 기록되고 gif에는 기록되지 않는다.
+func EncodeImage(w io.Writer, task *ImageUploadTask) error {
+	return EncodeImageContext(context.Background(), w, task)
+}
+
+// ctx가 끝나면 인코딩을 중단하는 EncodeImage. 외부 command는 ctx와 관계없이 externalEncoderTimeout 안에 끝나야한다.
+func EncodeImageContext(ctx context.Context, w io.Writer, task *ImageUploadTask) error {
+	if task.RawData != nil {
+		_, err := w.Write(task.RawData)
+		return err
+	}
+	if task.ImageData == nil && task.GIFImageData == nil {
+		return ErrNoImageDataToUpload
+	}
+
+	format := normalizeFormat(task.Extension)
+	encoder, ok := encoders[format]
+	if !ok {
+		return fmt.Errorf("%w format=%s", ErrUnsupportedFormat, task.Extension)
+	}
+	embed, ok := metadataEmbedders[format]
+	if !ok || task.Metadata.isEmpty() {
+		return encoder(ctx, w, task)
+	}
+
+	// 인코딩된 결과에 메타데이터를 추가한다.
+	encoded := bytes.NewBuffer([]byte{})
+	if err := encoder(ctx, encoded, task); err != nil {
+		return err
+	}
+	withMetadata, err := embed(encoded.Bytes(), task.Metadata, task.stillImage().Bounds())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(withMetadata)
+	return err
+}
+
+func encodePNG(_ context.Context, w io.Writer, task *ImageUploadTask) error {
+	options := task.Encoding.Png
+	imageData := task.stillImage()
+	if isTrue(options.ReducePalette) {
+		if paletted, ok := toPalettedIfFewColors(imageData, 256); ok {
+			imageData = paletted
+		}
+	}
+	encoder := &png.Encoder{CompressionLevel: pngCompressionLevels[options.Compression]}
+	return encoder.Encode(w, imageData)
+}
+
+func encodeJPEG(ctx context.Context, w io.Writer, task *ImageUploadTask) error {
+	var options *jpeg.Options
+	if task.Encoding.Jpeg.Quality > 0 {
+		options = &jpeg.Options{Quality: task.Encoding.Jpeg.Quality}
+	}
+	if !isTrue(task.Encoding.Jpeg.Progressive) {
+		return jpeg.Encode(w, task.stillImage(), options)
+	}
+
+	// 표준 라이브러리는 baseline jpeg만 만들 수 있으므로 jpegtran으로 무손실 변환한다.
+	// jpegtran이 멈추더라도 워커가 막히지 않도록 externalEncoderTimeout이 지나면 종료시킨다.
+	if jpegtranPath == "" {
+		return ErrProgressiveJPEGUnavailable
+	}
+	baseline := bytes.NewBuffer([]byte{})
+	if err := jpeg.Encode(baseline, task.stillImage(), options); err != nil {
+		return err
+	}
+	ctx, cancel := withExternalEncoderTimeout(ctx)
+	defer cancel()
+	stderr := bytes.NewBuffer([]byte{})
+	cmd := exec.CommandContext(ctx, jpegtranPath, "-progressive", "-optimize", "-copy", "none")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = baseline, w, stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return fmt.Errorf("jpegtran 실행에 실패했습니다. err=%v, output=%s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+func encodeGIF(_ context.Context, w io.Writer, task *ImageUploadTask) error {
+	paletteSize := task.Encoding.Gif.PaletteSize
+	if task.GIFImageData != nil {
+		gifImageData := task.GIFImageData
+		if paletteSize > 0 {
+			reduced := *gifImageData
+			reduced.Image = make([]*image.Paletted, len(gifImageData.Image))
+			for i, frame := range gifImageData.Image {
+				reduced.Image[i] = reduceFramePalette(frame, paletteSize)
+			}
+			// 전역 팔레트가 없어도 각 프레임의 팔레트가 사용된다.
+			reduced.Config.ColorModel = nil
+			gifImageData = &reduced
+		}
+		return gif.EncodeAll(w, gifImageData)
+	}
+	if paletteSize > 0 {
+		return gif.Encode(w, task.ImageData, &gif.Options{NumColors: paletteSize, Quantizer: medianCutQuantizer{}})
+	}
+	return gif.Encode(w, task.ImageData, nil)
+}
+
+// 외부 command로 인코딩할 때 사용할 context. ctx가 끝나거나 externalEncoderTimeout이 지나면 command가 종료된다.
+func withExternalEncoderTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, externalEncoderTimeout)
+}
+
+// progressive jpeg 변환에 jpegtran을 사용하도록 한다. command를 찾을 수 없으면 progressive jpeg를 만들 수 없다.
+func EnableProgressiveJPEG(command string) error {
+	commandPath, err := exec.LookPath(command)
+	if err != nil {
+		return err
+	}
+	jpegtranPath = commandPath
+	logrus.Infof("progressive jpeg 변환에 jpegtran을 사용합니다. command=%s", commandPath)
+	return nil
+}
+
+// progressive jpeg를 만들 수 있는지
+func IsProgressiveJPEGAvailable() bool {
+	return jpegtranPath != ""
+}
+
+// 대소문자를 구분하지 않고, jpg는 jpeg로 취급한다.
+func normalizeFormat(format string) string {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// 정지 이미지로 인코딩할 때 사용할 이미지. gif인 경우 첫 프레임을 사용한다.
+func (t *BaseImageTask) stillImage() image.Image {
+	if t.ImageData != nil {
+		return t.ImageData
+	}
+	return t.GIFImageData.Image[0]
+}
+
+// 포맷에 해당하는 Content-Type
+func ContentTypeOf(format string) string {
+	return "image/" + normalizeFormat(format)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	exif "github.com/dsoprea/go-exif/v3"
+	"github.com/sirupsen/logrus"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// avif를 인코딩할 수 있는 Go 라이브러리가 마땅치 않아 libavif의 avifenc를 실행해 인코딩한다.
+// command를 찾을 수 없으면 avif 인코더를 등록하지 않는다.
+func RegisterAvifEncoder(command string) error {
+	commandPath, err := exec.LookPath(command)
+	if err != nil {
+		return err
+	}
+	RegisterEncoder("avif", newAvifEncoder(commandPath))
+	logrus.Infof("avif 인코더를 등록했습니다. command=%s", commandPath)
+	return nil
+}
+
+// avifenc는 파일을 입력받으므로 png로 인코딩한 임시 파일을 넘겨주고, 결과 파일을 읽어 w에 쓴다.
+// avifenc가 멈추더라도 워커가 막히지 않도록 externalEncoderTimeout이 지나면 종료시킨다.
+func newAvifEncoder(commandPath string) Encoder {
+	return func(ctx context.Context, w io.Writer, task *ImageUploadTask) error {
+		dir, err := ioutil.TempDir("", "bumblebee-avif")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		input, output := filepath.Join(dir, "input.png"), filepath.Join(dir, "output.avif")
+		inputFile, err := os.Create(input)
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(inputFile, task.stillImage()); err != nil {
+			inputFile.Close()
+			return err
+		}
+		if err := inputFile.Close(); err != nil {
+			return err
+		}
+
+		args := make([]string, 0)
+		if isTrue(task.Encoding.Avif.Lossless) {
+			args = append(args, "--lossless")
+		} else if task.Encoding.Avif.Quality > 0 {
+			args = append(args, "-q", strconv.Itoa(task.Encoding.Avif.Quality))
+		}
+		metadataArgs, err := avifMetadataArgs(dir, task.Metadata)
+		if err != nil {
+			return err
+		}
+		args = append(append(args, metadataArgs...), input, output)
+		ctx, cancel := withExternalEncoderTimeout(ctx)
+		defer cancel()
+		if out, err := exec.CommandContext(ctx, commandPath, args...).CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("avifenc 실행에 실패했습니다. err=%v, output=%s", err, bytes.TrimSpace(out))
+		}
+
+		outputFile, err := os.Open(output)
+		if err != nil {
+			return err
+		}
+		defer outputFile.Close()
+		_, err = io.Copy(w, outputFile)
+		return err
+	}
+}
+
+// 메타데이터를 파일로 저장하고 avifenc에 넘겨줄 인자를 만든다.
+func avifMetadataArgs(dir string, m *ImageMetadata) ([]string, error) {
+	args := make([]string, 0)
+	if m.isEmpty() {
+		return args, nil
+	}
+	if len(m.ICCProfile) > 0 {
+		iccPath := filepath.Join(dir, "profile.icc")
+		if err := ioutil.WriteFile(iccPath, m.ICCProfile, 0600); err != nil {
+			return nil, err
+		}
+		args = append(args, "--icc", iccPath)
+	}
+	ib, err := buildExif(m)
+	if err != nil {
+		return nil, err
+	}
+	if ib != nil {
+		tiff, err := exif.NewIfdByteEncoder().EncodeToExif(ib)
+		if err != nil {
+			return nil, err
+		}
+		exifPath := filepath.Join(dir, "exif.bin")
+		if err := ioutil.WriteFile(exifPath, tiff, 0600); err != nil {
+			return nil, err
+		}
+		args = append(args, "--exif", exifPath)
+	}
+	return args, nil
+}
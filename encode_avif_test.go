@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// avifenc 대신 입력 파일을 그대로 출력 파일로 복사하고, 전달받은 인자를 기록하는 스크립트를 사용한다.
+func TestNewAvifEncoder(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	command := filepath.Join(dir, "avifenc")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\nfor last; do :; done\neval input=\\${$(($# - 1))}\ncp \"$input\" \"$last\"\n"
+	assert.NoError(t, ioutil.WriteFile(command, []byte(script), 0755))
+
+	encoder := newAvifEncoder(command)
+	body := bytes.NewBuffer([]byte{})
+	err := encoder(context.Background(), body, &ImageUploadTask{
+		BaseImageTask: &BaseImageTask{ImageData: image.NewRGBA(image.Rect(0, 0, 16, 8)), Extension: "avif"},
+		Encoding:      EncoderOptions{Avif: AvifOptions{Quality: 50}},
+	})
+	assert.NoError(t, err)
+	// 스크립트가 입력(png)을 그대로 복사했으므로 png로 해석되어야한다.
+	_, format, err := image.DecodeConfig(body)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+
+	args, err := ioutil.ReadFile(argsPath)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(args), "-q 50 "))
+
+	t.Run("실행_실패", func(t *testing.T) {
+		encoder := newAvifEncoder(filepath.Join(dir, "not-exists"))
+		err := encoder(context.Background(), bytes.NewBuffer([]byte{}), &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{ImageData: image.NewRGBA(image.Rect(0, 0, 16, 8)), Extension: "avif"},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("시간_초과", func(t *testing.T) {
+		originalTimeout := externalEncoderTimeout
+		t.Cleanup(func() { externalEncoderTimeout = originalTimeout })
+		externalEncoderTimeout = 100 * time.Millisecond
+		command := filepath.Join(dir, "hanging-avifenc")
+		assert.NoError(t, ioutil.WriteFile(command, []byte("#!/bin/sh\nexec sleep 10\n"), 0755))
+
+		start := time.Now()
+		err := newAvifEncoder(command)(context.Background(), bytes.NewBuffer([]byte{}), &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{ImageData: image.NewRGBA(image.Rect(0, 0, 16, 8)), Extension: "avif"},
+		})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+}
+
+func TestRegisterAvifEncoder(t *testing.T) {
+	err := RegisterAvifEncoder(filepath.Join(t.TempDir(), "not-exists"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+)
+
+// png 압축 수준
+const (
+	PNGCompressionDefault = "default"
+	PNGCompressionNone    = "none"
+	PNGCompressionFast    = "fast"
+	PNGCompressionBest    = "best"
+)
+
+var (
+	ErrInvalidEncoderOptions = errors.New("잘못된 인코딩 설정입니다.")
+
+	pngCompressionLevels = map[string]png.CompressionLevel{
+		"":                    png.DefaultCompression,
+		PNGCompressionDefault: png.DefaultCompression,
+		PNGCompressionNone:    png.NoCompression,
+		PNGCompressionFast:    png.BestSpeed,
+		PNGCompressionBest:    png.BestCompression,
+	}
+)
+
+// 포맷별 인코딩 설정
+// 전역 설정(Config.Encoding)과 preset별 설정(VariantPreset.Encoding)에서 사용되며, preset에 지정한 값이 우선한다.
+// 0, 빈 문자열, nil은 지정하지 않은 것으로 취급한다.
+type EncoderOptions struct {
+	Jpeg JpegOptions
+	Png  PngOptions
+	Gif  GifOptions
+	Webp WebpOptions
+	Avif AvifOptions
+	// 외부 command(avifenc, jpegtran)로 인코딩할 때의 최대 시간(초). 0이면 30. 전역 설정에서만 사용된다.
+	CommandTimeout int
+}
+
+type JpegOptions struct {
+	// 1~100. 0이면 기본값(75)
+	Quality int
+	// progressive jpeg로 인코딩할지. 지정하지 않으면 baseline
+	Progressive *bool
+	// progressive 변환에 사용할 libjpeg의 jpegtran 실행 파일. 전역 설정에서만 사용된다.
+	Command string
+}
+
+type PngOptions struct {
+	// 압축 수준 (default, none, fast, best)
+	Compression string
+	// 사용된 색상이 256개 이하인 경우 팔레트 png로 인코딩할지
+	ReducePalette *bool
+}
+
+type GifOptions struct {
+	// 팔레트의 색상 수(2~256). 0이면 원본 팔레트를 유지하고, 정지 이미지는 256색을 사용한다.
+	PaletteSize int
+}
+
+type WebpOptions struct {
+	// 1~100. 0이면 기본값
+	Quality  int
+	Lossless *bool
+}
+
+type AvifOptions struct {
+	// 1~100. 0이면 avifenc의 기본값
+	Quality  int
+	Lossless *bool
+	// avif 인코딩에 사용할 libavif의 avifenc 실행 파일. 전역 설정에서만 사용된다.
+	Command string
+}
+
+// 설정 값들이 올바른지 확인한다.
+func (o EncoderOptions) Validate() error {
+	if o.CommandTimeout < 0 {
+		return fmt.Errorf("%w commandTimeout은 0 이상이어야합니다. commandTimeout=%d", ErrInvalidEncoderOptions, o.CommandTimeout)
+	}
+	for format, quality := range map[string]int{"jpeg": o.Jpeg.Quality, "webp": o.Webp.Quality, "avif": o.Avif.Quality} {
+		if quality < 0 || quality > 100 {
+			return fmt.Errorf("%w %s.quality는 0~100 사이여야합니다. quality=%d", ErrInvalidEncoderOptions, format, quality)
+		}
+	}
+	if _, ok := pngCompressionLevels[o.Png.Compression]; !ok {
+		return fmt.Errorf("%w 지원하지 않는 png.compression입니다. compression=%s", ErrInvalidEncoderOptions, o.Png.Compression)
+	}
+	if o.Gif.PaletteSize != 0 && (o.Gif.PaletteSize < 2 || o.Gif.PaletteSize > 256) {
+		return fmt.Errorf("%w gif.paletteSize는 2~256 사이여야합니다. paletteSize=%d", ErrInvalidEncoderOptions, o.Gif.PaletteSize)
+	}
+	return nil
+}
+
+// o에 override에서 지정된 값들을 덮어쓴 설정을 반환한다. 실행 파일 설정은 덮어쓰지 않는다.
+func (o EncoderOptions) Merge(override EncoderOptions) EncoderOptions {
+	if override.Jpeg.Quality != 0 {
+		o.Jpeg.Quality = override.Jpeg.Quality
+	}
+	if override.Jpeg.Progressive != nil {
+		o.Jpeg.Progressive = override.Jpeg.Progressive
+	}
+	if override.Png.Compression != "" {
+		o.Png.Compression = override.Png.Compression
+	}
+	if override.Png.ReducePalette != nil {
+		o.Png.ReducePalette = override.Png.ReducePalette
+	}
+	if override.Gif.PaletteSize != 0 {
+		o.Gif.PaletteSize = override.Gif.PaletteSize
+	}
+	if override.Webp.Quality != 0 {
+		o.Webp.Quality = override.Webp.Quality
+	}
+	if override.Webp.Lossless != nil {
+		o.Webp.Lossless = override.Webp.Lossless
+	}
+	if override.Avif.Quality != 0 {
+		o.Avif.Quality = override.Avif.Quality
+	}
+	if override.Avif.Lossless != nil {
+		o.Avif.Lossless = override.Avif.Lossless
+	}
+	return o
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncoderOptions_Validate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options EncoderOptions
+		isError bool
+	}{
+		{name: "기본값", options: EncoderOptions{}},
+		{name: "정상", options: EncoderOptions{
+			Jpeg: JpegOptions{Quality: 85},
+			Png:  PngOptions{Compression: PNGCompressionBest},
+			Gif:  GifOptions{PaletteSize: 64},
+			Webp: WebpOptions{Quality: 100},
+		}},
+		{name: "잘못된_quality", options: EncoderOptions{Jpeg: JpegOptions{Quality: 101}}, isError: true},
+		{name: "잘못된_compression", options: EncoderOptions{Png: PngOptions{Compression: "zopfli"}}, isError: true},
+		{name: "잘못된_paletteSize", options: EncoderOptions{Gif: GifOptions{PaletteSize: 1}}, isError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.options.Validate()
+			if tc.isError {
+				assert.ErrorIs(t, err, ErrInvalidEncoderOptions)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestEncoderOptions_Merge(t *testing.T) {
+	enabled, disabled := true, false
+	global := EncoderOptions{
+		Jpeg: JpegOptions{Quality: 85, Progressive: &enabled, Command: "jpegtran"},
+		Png:  PngOptions{Compression: PNGCompressionFast, ReducePalette: &enabled},
+		Gif:  GifOptions{PaletteSize: 128},
+	}
+	merged := global.Merge(EncoderOptions{
+		Jpeg: JpegOptions{Quality: 60, Command: "other"},
+		Png:  PngOptions{ReducePalette: &disabled},
+	})
+
+	assert.Equal(t, 60, merged.Jpeg.Quality)
+	assert.True(t, isTrue(merged.Jpeg.Progressive))
+	assert.Equal(t, "jpegtran", merged.Jpeg.Command)
+	assert.Equal(t, PNGCompressionFast, merged.Png.Compression)
+	assert.False(t, isTrue(merged.Png.ReducePalette))
+	assert.Equal(t, 128, merged.Gif.PaletteSize)
+	// 원본은 바뀌지 않는다.
+	assert.Equal(t, 85, global.Jpeg.Quality)
+}
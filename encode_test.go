@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncodeImage(t *testing.T) {
+	imageData := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	imageData.Set(1, 1, color.RGBA{R: 255, A: 255})
+	gifImageData := &gif.GIF{
+		Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 16, 8), palette.Plan9)},
+		Delay:  []int{0},
+		Config: image.Config{Width: 16, Height: 8},
+	}
+
+	for _, tc := range []struct {
+		name           string
+		task           *BaseImageTask
+		format         string
+		expectedFormat string
+	}{
+		{name: "png", task: &BaseImageTask{ImageData: imageData}, format: "png", expectedFormat: "png"},
+		{name: "jpg", task: &BaseImageTask{ImageData: imageData}, format: "jpg", expectedFormat: "jpeg"},
+		{name: "png_to_gif", task: &BaseImageTask{ImageData: imageData}, format: "gif", expectedFormat: "gif"},
+		{name: "gif", task: &BaseImageTask{GIFImageData: gifImageData}, format: "gif", expectedFormat: "gif"},
+		{name: "gif_to_jpeg", task: &BaseImageTask{GIFImageData: gifImageData}, format: "jpeg", expectedFormat: "jpeg"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.task.Extension = tc.format
+			body := bytes.NewBuffer([]byte{})
+			err := EncodeImage(body, &ImageUploadTask{BaseImageTask: tc.task, Encoding: EncoderOptions{Jpeg: JpegOptions{Quality: 90}}})
+			assert.NoError(t, err)
+
+			decoded, format, err := image.Decode(body)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedFormat, format)
+			assert.Equal(t, 16, decoded.Bounds().Dx())
+		})
+	}
+
+	t.Run("지원하지_않는_포맷", func(t *testing.T) {
+		err := EncodeImage(bytes.NewBuffer([]byte{}), &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "tiff"}})
+		assert.ErrorIs(t, err, ErrUnsupportedFormat)
+	})
+
+	t.Run("이미지_없음", func(t *testing.T) {
+		err := EncodeImage(bytes.NewBuffer([]byte{}), &ImageUploadTask{BaseImageTask: &BaseImageTask{Extension: "png"}})
+		assert.ErrorIs(t, err, ErrNoImageDataToUpload)
+	})
+}
+
+func TestEncodeImage_Options(t *testing.T) {
+	imageData := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			imageData.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 64, A: 255})
+		}
+	}
+	encode := func(t *testing.T, task *BaseImageTask, options EncoderOptions) *bytes.Buffer {
+		body := bytes.NewBuffer([]byte{})
+		assert.NoError(t, EncodeImage(body, &ImageUploadTask{BaseImageTask: task, Encoding: options}))
+		return body
+	}
+
+	t.Run("jpeg_quality", func(t *testing.T) {
+		low := encode(t, &BaseImageTask{ImageData: imageData, Extension: "jpeg"}, EncoderOptions{Jpeg: JpegOptions{Quality: 10}})
+		high := encode(t, &BaseImageTask{ImageData: imageData, Extension: "jpeg"}, EncoderOptions{Jpeg: JpegOptions{Quality: 100}})
+		assert.Less(t, low.Len(), high.Len())
+	})
+
+	t.Run("png_compression", func(t *testing.T) {
+		none := encode(t, &BaseImageTask{ImageData: imageData, Extension: "png"}, EncoderOptions{Png: PngOptions{Compression: PNGCompressionNone}})
+		best := encode(t, &BaseImageTask{ImageData: imageData, Extension: "png"}, EncoderOptions{Png: PngOptions{Compression: PNGCompressionBest}})
+		assert.Less(t, best.Len(), none.Len())
+	})
+
+	t.Run("png_reduce_palette", func(t *testing.T) {
+		fewColors := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		fewColors.Set(1, 1, color.RGBA{R: 255, A: 255})
+		enabled := true
+		decoded, err := png.Decode(encode(t, &BaseImageTask{ImageData: fewColors, Extension: "png"}, EncoderOptions{Png: PngOptions{ReducePalette: &enabled}}))
+		assert.NoError(t, err)
+		assert.IsType(t, &image.Paletted{}, decoded)
+
+		// 색상이 많으면 그대로 인코딩한다.
+		decoded, err = png.Decode(encode(t, &BaseImageTask{ImageData: imageData, Extension: "png"}, EncoderOptions{Png: PngOptions{ReducePalette: &enabled}}))
+		assert.NoError(t, err)
+		assert.NotEqual(t, "*image.Paletted", fmt.Sprintf("%T", decoded))
+	})
+
+	t.Run("gif_palette_size", func(t *testing.T) {
+		decoded, err := gif.Decode(encode(t, &BaseImageTask{ImageData: imageData, Extension: "gif"}, EncoderOptions{Gif: GifOptions{PaletteSize: 16}}))
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(decoded.(*image.Paletted).Palette), 16)
+
+		animated := &gif.GIF{
+			Image:  []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9), image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9)},
+			Delay:  []int{10, 10},
+			Config: image.Config{ColorModel: color.Palette(palette.Plan9), Width: 16, Height: 16},
+		}
+		for i := range animated.Image[1].Pix {
+			animated.Image[1].Pix[i] = uint8(i)
+		}
+		decodedGIF, err := gif.DecodeAll(encode(t, &BaseImageTask{GIFImageData: animated, Extension: "gif"}, EncoderOptions{Gif: GifOptions{PaletteSize: 8}}))
+		assert.NoError(t, err)
+		assert.Len(t, decodedGIF.Image, 2)
+		for _, frame := range decodedGIF.Image {
+			assert.LessOrEqual(t, len(frame.Palette), 8)
+		}
+		// 원본은 바뀌지 않는다.
+		assert.Len(t, animated.Image[1].Palette, 256)
+	})
+
+	t.Run("jpeg_progressive", func(t *testing.T) {
+		defer func(original string) { jpegtranPath = original }(jpegtranPath)
+		enabled := true
+		task := &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "jpeg"},
+			Encoding:      EncoderOptions{Jpeg: JpegOptions{Progressive: &enabled}},
+		}
+		jpegtranPath = ""
+		assert.ErrorIs(t, EncodeImage(bytes.NewBuffer([]byte{}), task), ErrProgressiveJPEGUnavailable)
+
+		// jpegtran 대신 입력을 그대로 출력하는 스크립트를 사용한다.
+		command := filepath.Join(t.TempDir(), "jpegtran")
+		assert.NoError(t, ioutil.WriteFile(command, []byte("#!/bin/sh\ncat\n"), 0755))
+		assert.NoError(t, EnableProgressiveJPEG(command))
+		body := bytes.NewBuffer([]byte{})
+		assert.NoError(t, EncodeImage(body, task))
+		_, format, err := image.DecodeConfig(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+
+		// 멈춘 jpegtran은 externalEncoderTimeout이 지나면 종료된다.
+		defer func(original time.Duration) { externalEncoderTimeout = original }(externalEncoderTimeout)
+		externalEncoderTimeout = 100 * time.Millisecond
+		command = filepath.Join(t.TempDir(), "jpegtran")
+		assert.NoError(t, ioutil.WriteFile(command, []byte("#!/bin/sh\nexec sleep 10\n"), 0755))
+		assert.NoError(t, EnableProgressiveJPEG(command))
+		start := time.Now()
+		err = EncodeImage(bytes.NewBuffer([]byte{}), task)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+		}
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+}
+
+// 설치된 jpegtran으로 실제 progressive jpeg를 만든다. jpegtran이 없으면 건너뛴다.
+func TestEncodeImage_ProgressiveJPEG(t *testing.T) {
+	if _, err := exec.LookPath("jpegtran"); err != nil {
+		t.Skip("jpegtran을 찾을 수 없습니다.")
+	}
+	defer func(original string) { jpegtranPath = original }(jpegtranPath)
+	assert.NoError(t, EnableProgressiveJPEG("jpegtran"))
+	enabled := true
+	body := bytes.NewBuffer([]byte{})
+	err := EncodeImage(body, &ImageUploadTask{
+		BaseImageTask: &BaseImageTask{ImageData: image.NewRGBA(image.Rect(0, 0, 64, 32)), Extension: "jpeg"},
+		Encoding:      EncoderOptions{Jpeg: JpegOptions{Quality: 80, Progressive: &enabled}},
+	})
+	assert.NoError(t, err)
+	// progressive jpeg는 SOF2 marker를 사용한다.
+	assert.True(t, bytes.Contains(body.Bytes(), []byte{0xFF, 0xC2}))
+	decoded, _, err := image.DecodeConfig(bytes.NewReader(body.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, decoded.Width)
+}
@@ -0,0 +1,23 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"github.com/chai2010/webp"
+	"io"
+)
+
+// webp 인코딩은 libwebp를 사용하므로 cgo를 사용할 수 있는 빌드에서만 지원한다.
+func init() {
+	RegisterEncoder("webp", encodeWebP)
+}
+
+func encodeWebP(_ context.Context, w io.Writer, task *ImageUploadTask) error {
+	options := &webp.Options{Lossless: isTrue(task.Encoding.Webp.Lossless), Quality: webp.DefaulQuality}
+	if task.Encoding.Webp.Quality > 0 {
+		options.Quality = float32(task.Encoding.Webp.Quality)
+	}
+	return webp.Encode(w, task.stillImage(), options)
+}
@@ -0,0 +1,55 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestEncodeImage_WebP(t *testing.T) {
+	imageData := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	imageData.Set(1, 1, color.RGBA{R: 255, A: 255})
+
+	for _, lossless := range []bool{false, true} {
+		body := bytes.NewBuffer([]byte{})
+		err := EncodeImage(body, &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "webp"},
+			Encoding:      EncoderOptions{Webp: WebpOptions{Quality: 75, Lossless: &lossless}},
+		})
+		assert.NoError(t, err)
+
+		config, format, err := image.DecodeConfig(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "webp", format)
+		assert.Equal(t, 16, config.Width)
+	}
+	assert.Equal(t, "image/webp", ContentTypeOf("webp"))
+}
+
+func TestEncodeImage_WebPMetadata(t *testing.T) {
+	imageData := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	imageData.Set(1, 1, color.NRGBA{R: 255, A: 128})
+	metadata := &ImageMetadata{Copyright: "khumu", ICCProfile: []byte("test icc profile")}
+
+	for _, lossless := range []bool{false, true} {
+		body := bytes.NewBuffer([]byte{})
+		err := EncodeImage(body, &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "webp", Metadata: metadata},
+			Encoding:      EncoderOptions{Webp: WebpOptions{Lossless: &lossless}},
+		})
+		assert.NoError(t, err)
+
+		m := ReadMetadata(body.Bytes(), "webp")
+		assert.Equal(t, metadata.Copyright, m.Copyright)
+		assert.Equal(t, metadata.ICCProfile, m.ICCProfile)
+		decoded, format, err := image.Decode(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "webp", format)
+		assert.Equal(t, 16, decoded.Bounds().Dx())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	exif "github.com/dsoprea/go-exif/v3"
+	jpgis "github.com/dsoprea/go-jpeg-image-structure/v2"
+	pngis "github.com/dsoprea/go-png-image-structure/v2"
+)
+
+// 이미지 컨테이너에서 exif 데이터를 꺼내기 위한 함수들
+// 꺼낸 데이터는 TIFF 헤더(II*\0 혹은 MM\0*)로 시작한다.
+
+var (
+	// exif 데이터 앞에 붙기도 하는 식별자. jpeg의 APP1 세그먼트와 같은 형식
+	exifIdentifier = []byte("Exif\x00\x00")
+)
+
+// 원본 파일에 들어있는 exif 데이터들. 보통은 하나이지만 jpeg에는 exif APP1 세그먼트가 여러 개 있을 수도 있다.
+// jpeg, png는 go-jpeg-image-structure, go-png-image-structure로 해석하고
+// webp의 EXIF chunk는 직접 찾는다.
+// HEIF(heic) 이미지는 디코더가 등록되어있지 않아 업로드할 수 없으므로 exif를 찾지 않는다.
+func readExif(data []byte, extension string) [][]byte {
+	blobs := make([][]byte, 0)
+	switch {
+	case extension == "jpeg":
+		mc, err := jpgis.NewJpegMediaParser().ParseBytes(data)
+		sl, ok := mc.(*jpgis.SegmentList)
+		if err != nil || !ok {
+			return blobs
+		}
+		for _, segment := range sl.Segments() {
+			if segment.IsExif() {
+				blobs = append(blobs, segment.Data[len(exifIdentifier):])
+			}
+		}
+	case extension == "png":
+		mc, err := pngis.NewPngMediaParser().ParseBytes(data)
+		cs, ok := mc.(*pngis.ChunkSlice)
+		if err != nil || !ok {
+			return blobs
+		}
+		for _, chunk := range cs.Chunks() {
+			if chunk.Type == pngis.EXifChunkType {
+				blobs = append(blobs, chunk.Data)
+			}
+		}
+	case isWebP(data):
+		if tiff, ok := webpExif(data); ok {
+			blobs = append(blobs, tiff)
+		}
+	}
+	return blobs
+}
+
+// TIFF 형식의 exif 데이터에서 orientation(1~8)을 읽는다. 없거나 해석할 수 없으면 0을 반환한다.
+func exifOrientation(tiff []byte) uint {
+	tags, _, err := exif.GetFlatExifData(tiff, nil)
+	if err != nil {
+		return 0
+	}
+	for _, tag := range tags {
+		if tag.IfdPath != "IFD" || tag.TagName != "Orientation" {
+			continue
+		}
+		if values, ok := tag.Value.([]uint16); ok && len(values) > 0 && values[0] <= 8 {
+			return uint(values[0])
+		}
+	}
+	return 0
+}
+
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP"))
+}
+
+// webp(RIFF)의 EXIF chunk를 찾는다.
+func webpExif(data []byte) ([]byte, bool) {
+	for _, chunk := range parseWebPChunks(data) {
+		if chunk.fourCC == "EXIF" {
+			// 일부 프로그램은 jpeg처럼 Exif 식별자를 붙여서 저장한다.
+			return bytes.TrimPrefix(chunk.payload, exifIdentifier), true
+		}
+	}
+	return nil, false
+}
+
+type webpChunk struct {
+	fourCC  string
+	payload []byte
+}
+
+// webp(RIFF)의 chunk들을 나눈다. 크기가 잘못된 chunk를 만나면 그 앞까지만 반환한다.
+// https://developers.google.com/speed/webp/docs/riff_container
+func parseWebPChunks(data []byte) []webpChunk {
+	chunks := make([]webpChunk, 0)
+	if !isWebP(data) {
+		return chunks
+	}
+	for offset := 12; offset+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		start, end := offset+8, offset+8+size
+		if size < 0 || end > len(data) {
+			return chunks
+		}
+		chunks = append(chunks, webpChunk{fourCC: string(data[offset : offset+4]), payload: data[start:end]})
+		// chunk의 크기가 홀수이면 1byte padding이 붙는다.
+		offset = end + size%2
+	}
+	return chunks
+}
+
+// chunk들로 webp 파일을 만든다.
+func writeWebPChunks(chunks []webpChunk) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		header := make([]byte, 8)
+		copy(header, chunk.fourCC)
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(chunk.payload)))
+		data = append(append(data, header...), chunk.payload...)
+		if len(chunk.payload)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+	return data
+}
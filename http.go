@@ -1,31 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"path"
-	"strconv"
 	"strings"
+	"time"
 )
 
+// 저장소의 파일을 제공하는 경로. 뒤에 저장소의 key가 붙는다. (e.g. /images/thumbnail/abcd1234.png)
+const storedImagePathPrefix = "/images/"
+
 func NewEcho() *echo.Echo {
 	e := echo.New()
 	e.Pre(middleware.RemoveTrailingSlash())
+	// client가 보낸 X-Forwarded-For, X-Real-IP 헤더로 요청 수, 용량 제한을 피할 수 없도록 한다.
+	ipExtractor, err := newIPExtractor(Config.TrustedProxies)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	e.IPExtractor = ipExtractor
 
-	g := e.Group("api")
+	// 업로드, 조회, 삭제는 Config.Auth에 따라 인증된 요청만 허용한다.
+	g := e.Group("api", AuthMiddleware)
+	// 서명된 URL이나 관리자 token 등 별도의 방식으로 요청을 검증하는 API
+	public := e.Group("api")
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "${time_rfc3339} ${method} ${status} uri=${uri} latency=${latency}\n",
 		Skipper: func(context echo.Context) bool {
 			// health check log는 너무 verbose함.
-			if context.Request().URL.RequestURI() == "/healthz" {
+			if uri := context.Request().URL.RequestURI(); uri == "/healthz" || uri == "/metrics" {
 				return true
 			}
 			return false
 		},
 	}))
-	e.GET("/healthz", func(c echo.Context) error { return c.String(200, "OK") })
-	g.POST("/images", ImageUploadRequestHandler, ForceContentTypeMultipartFormDataMiddleware)
+	if Config.Tracing.Enabled {
+		e.Use(TracingMiddleware)
+	}
+	e.GET("/healthz", HealthRequestHandler)
+	if Config.Metrics.Enabled {
+		e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	}
+	g.POST("/images", ImageUploadRequestHandler, RateLimitMiddleware, ForceContentTypeMultipartFormDataMiddleware, LimitBodySizeMiddleware)
+	g.GET("/images/:name/status", ImageStatusRequestHandler)
+	g.DELETE("/images/:name", ImageDeleteRequestHandler)
+	if Config.OnTheFly.Enabled {
+		public.GET("/images/:name", OnTheFlyImageRequestHandler, VerifySignedURLMiddleware)
+		public.POST("/admin/signed-urls", SignURLRequestHandler, AdminTokenMiddleware)
+	}
+	public.GET("/admin/quotas", QuotaUsageRequestHandler, AdminTokenMiddleware)
+	public.GET("/admin/quotas/:client", ClientQuotaUsageRequestHandler, AdminTokenMiddleware)
+	public.GET("/admin/dead-letters", DeadLetterListRequestHandler, AdminTokenMiddleware)
+	public.POST("/admin/dead-letters/:id/replay", DeadLetterReplayRequestHandler, AdminTokenMiddleware)
+	public.DELETE("/admin/dead-letters/:id", DeadLetterDiscardRequestHandler, AdminTokenMiddleware)
+	// CDN이 없는 환경에서도 업로드 응답의 URL로 이미지를 볼 수 있도록 디스크에 저장된 파일을 직접 제공한다.
+	if Config.Storage.Disk.Enabled {
+		e.GET(storedImagePathPrefix+"*", StoredImageRequestHandler)
+		e.HEAD(storedImagePathPrefix+"*", StoredImageRequestHandler)
+	}
 
 	return e
 }
@@ -34,6 +75,9 @@ func ImageUploadRequestHandler(c echo.Context) error {
 	// Source
 	input, err := c.FormFile("image")
 	if err != nil {
+		if limitErr := bodyLimitError(c); limitErr != nil {
+			return respondLimitError(c, limitErr)
+		}
 		logrus.Error(err)
 		return err
 	}
@@ -66,12 +110,30 @@ func ImageUploadRequestHandler(c echo.Context) error {
 		return err
 	}
 	defer src.Close()
+	// durable queue에 원본을 기록해야하므로 먼저 읽어둔다.
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	uploadsReceived.Inc()
+	bytesIn.Add(float64(len(data)))
 	//imageData, _, gifImageData, ext, err := DecodeImageFile(src)
-	imageData, orientation, gifImageData, ext, err := DecodeImageFile(src)
+	decodeStart := time.Now()
+	imageData, orientation, gifImageData, ext, err := DecodeImageFile(bytes.NewReader(data))
+	if err != nil {
+		observeDecodeFailure(ext)
+	} else {
+		observeStage(StageDecode, decodeStart)
+	}
 	if orientation != 0 {
 		imageData = RotateImage(imageData, orientation)
 	}
 
+	var limitErr *ImageLimitError
+	if errors.As(err, &limitErr) {
+		return respondLimitError(c, limitErr)
+	}
 	if err != nil {
 		logrus.Error(err)
 		return c.JSON(400, map[string]interface{}{
@@ -80,46 +142,265 @@ func ImageUploadRequestHandler(c echo.Context) error {
 		})
 	}
 
-	DispatchMessages(&BaseImageTask{
+	metadata, originalData := Config.Metadata.Apply(data, ext)
+	imageData, metadata = Config.ColorProfile.Apply(imageData, metadata, data, ext)
+	baseImageTask := &BaseImageTask{
 		ImageData:        imageData,
 		GIFImageData:     gifImageData,
 		OriginalFileName: inputFileName,
 		HashedFileName:   hashedFileName,
 		Extension:        ext,
-	})
+		Metadata:         metadata,
+		OriginalData:     originalData,
+		Principal:        PrincipalOf(c),
+		SpanContext:      trace.SpanContextFromContext(c.Request().Context()),
+	}
+	variants := VariantsOf(ext)
+	// 디코딩된 이미지가 메모리에 쌓이지 않도록 처리 중인 작업이 많으면 기다리거나 거절한다.
+	if err := AcquireAdmission(c.Request().Context(), baseImageTask, len(variants)); err != nil {
+		return respondServiceUnavailable(c, err)
+	}
+	consumedAt := time.Now()
+	if UploadQuotas != nil {
+		if retryAfter, err := UploadQuotas.Consume(clientKeyOf(c), int64(len(data)), consumedAt); errors.Is(err, ErrQuotaExceeded) {
+			ReleaseAdmission(baseImageTask)
+			return respondTooManyRequests(c, err, retryAfter)
+		} else if err != nil {
+			ReleaseAdmission(baseImageTask)
+			logrus.Error(err)
+			return c.JSON(500, BaseResponse{Message: err.Error()})
+		}
+	}
+	logrus.Infof("업로드 요청을 수락했습니다. name=%s, principal=%s", hashedFileName, baseImageTask.Principal)
+	if DurableTaskQueue != nil {
+		if err := DurableTaskQueue.Accept(baseImageTask, data, variants); err != nil {
+			ReleaseAdmission(baseImageTask)
+			// 처리하지 못한 업로드는 사용량에 포함하지 않는다.
+			if UploadQuotas != nil {
+				if err := UploadQuotas.Refund(clientKeyOf(c), int64(len(data)), consumedAt); err != nil {
+					logrus.Error(err)
+				}
+			}
+			logrus.Error(err)
+			return c.JSON(500, BaseResponse{Message: ErrUnableToPersistTask.Error()})
+		}
+	}
+	DispatchMessages(baseImageTask)
 
-	resp := GenerateSuccessfullyUploadedResponse(hashedFileName + "." + ext)
+	resp := GenerateSuccessfullyUploadedResponse(hashedFileName, ext)
 	logrus.Println(resp)
 	return c.JSON(200, resp)
 }
 
+// 서버 상태와 작업 채널의 길이, 처리 중인 작업 수를 응답한다.
+// 작업이 밀려있어도 서버는 정상이므로 항상 200으로 응답한다.
+func HealthRequestHandler(c echo.Context) error {
+	health := map[string]interface{}{
+		"status": "OK",
+		"queue":  CurrentQueueDepth(),
+	}
+	if TaskAdmission != nil {
+		health["admission"] = TaskAdmission.Stats()
+	}
+	return c.JSON(200, health)
+}
+
+// 업로드 후 각 variant의 처리 상태를 조회한다.
+// name은 업로드 응답의 file_name(확장자 포함)이나 확장자를 제외한 이름 모두 가능하다.
+func ImageStatusRequestHandler(c echo.Context) error {
+	name := c.Param("name")
+	job, err := Jobs.Get(name)
+	if errors.Is(err, ErrJobNotFound) {
+		job, err = Jobs.Get(strings.TrimSuffix(name, path.Ext(name)))
+	}
+	if err != nil {
+		return c.JSON(404, BaseResponse{Message: err.Error()})
+	}
+
+	return c.JSON(200, BaseResponse{Data: job})
+}
+
+// 업로드된 이미지의 원본과 모든 variant를 삭제하고 파일마다의 결과를 응답한다.
+// name은 업로드 응답의 file_name(확장자 포함)이나 확장자를 제외한 이름 모두 가능하다.
+// 삭제하지 못한 파일이 있으면 500으로 응답한다.
+func ImageDeleteRequestHandler(c echo.Context) error {
+	hashedFileName := hashedFileNameOf(c.Param("name"))
+	logrus.Infof("이미지 삭제 요청. name=%s, principal=%s", hashedFileName, PrincipalOf(c))
+	results, err := DeleteImage(ImageStorage, hashedFileName)
+	if errors.Is(err, ErrImageNotFound) {
+		return c.JSON(404, BaseResponse{Message: err.Error()})
+	}
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+
+	status := 200
+	for _, result := range results {
+		if !result.Deleted {
+			logrus.Errorf("이미지 파일을 삭제하지 못했습니다. key=%s, err=%s", result.Key, result.Error)
+			status = 500
+		}
+	}
+	return c.JSON(status, BaseResponse{Data: map[string]interface{}{
+		"file_name": hashedFileName,
+		"results":   results,
+	}})
+}
+
+// 저장소의 파일을 제공한다.
+// Content-Type, ETag, Last-Modified 헤더를 설정하고 조건부 요청(If-None-Match, If-Modified-Since)과 Range 요청을 처리한다.
+// 원본, variant, on-the-fly 변환 결과가 아닌 파일은 저장소 아래에 있더라도 404로 응답한다.
+func StoredImageRequestHandler(c echo.Context) error {
+	key := c.Param("*")
+	if !isServableKey(key) {
+		return c.JSON(404, BaseResponse{Message: ErrObjectNotFound.Error()})
+	}
+	return serveStoredObject(c, key)
+}
+
+// 업로드된 이미지가 저장되는 경로(original/, variant preset들의 path/, cache/) 아래의 key인지
+func isServableKey(key string) bool {
+	if key == "" || path.Clean(key) != key {
+		return false
+	}
+	prefixes := []string{"original/", onTheFlyCachePath + "/"}
+	for _, preset := range Config.Variants {
+		prefixes = append(prefixes, preset.Path+"/")
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) && len(key) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// 원본을 URL 파라미터에 따라 변환한 이미지를 제공한다. (e.g. /api/images/abcd1234.png?w=300&h=200&fit=fill&format=webp&q=70)
+// 변환한 이미지는 저장소의 cache/<hashed file name>/ 아래에 저장해두고 같은 요청에는 저장된 파일을 제공한다.
+// 잘못된 파라미터는 400, 원본이 없으면 404로 응답한다.
+func OnTheFlyImageRequestHandler(c echo.Context) error {
+	params, err := ParseTransformParams(c.QueryParams())
+	if err != nil {
+		return c.JSON(400, BaseResponse{Message: err.Error()})
+	}
+	hashedFileName := hashedFileNameOf(c.Param("name"))
+	originalKey, err := findOriginalKey(ImageStorage, hashedFileName)
+	if errors.Is(err, ErrImageNotFound) {
+		return c.JSON(404, BaseResponse{Message: err.Error()})
+	}
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+
+	sourceFormat := strings.TrimPrefix(path.Ext(originalKey), ".")
+	cacheKey := params.CacheKey(hashedFileName, sourceFormat)
+	if _, err := ImageStorage.Stat(cacheKey); err == nil {
+		return serveStoredObject(c, cacheKey)
+	} else if !errors.Is(err, ErrObjectNotFound) {
+		logrus.Error(err)
+	}
+
+	body, _, err := ImageStorage.Get(originalKey)
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	transformed, err := TransformImage(c.Request().Context(), data, hashedFileName, params)
+	if err != nil {
+		var limitErr *ImageLimitError
+		if errors.As(err, &limitErr) {
+			return respondLimitError(c, limitErr)
+		}
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+
+	outputFormat := params.OutputFormat(sourceFormat)
+	if err := ImageStorage.Put(cacheKey, bytes.NewReader(transformed), ContentTypeOf(outputFormat)); err != nil {
+		// 저장하지 못하더라도 변환한 이미지는 응답한다. 다음 요청에서 다시 변환된다.
+		logrus.Errorf("변환된 이미지를 저장하지 못했습니다. key=%s, err=%s", cacheKey, err)
+		c.Response().Header().Set("Content-Type", ContentTypeOf(outputFormat))
+		http.ServeContent(c.Response(), c.Request(), path.Base(cacheKey), time.Now(), bytes.NewReader(transformed))
+		return nil
+	}
+	logrus.Infof("변환된 이미지를 저장했습니다. key=%s", cacheKey)
+	return serveStoredObject(c, cacheKey)
+}
+
+// 저장소의 key에 해당하는 파일을 응답한다.
+func serveStoredObject(c echo.Context, key string) error {
+	body, info, err := ImageStorage.Get(key)
+	if errors.Is(err, ErrObjectNotFound) || errors.Is(err, ErrInvalidObjectKey) {
+		return c.JSON(404, BaseResponse{Message: ErrObjectNotFound.Error()})
+	}
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	defer body.Close()
+
+	// Range 요청을 처리하려면 원하는 위치부터 읽을 수 있어야한다.
+	content, ok := body.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			logrus.Error(err)
+			return c.JSON(500, BaseResponse{Message: err.Error()})
+		}
+		content = bytes.NewReader(data)
+	}
+	header := c.Response().Header()
+	header.Set("Content-Type", info.ContentType)
+	if info.ETag != "" {
+		header.Set("ETag", info.ETag)
+	}
+	http.ServeContent(c.Response(), c.Request(), path.Base(key), info.LastModified, content)
+	return nil
+}
+
 type BaseResponse struct {
 	Data    interface{} `json:"data"`
 	Message string      `json:"message"`
 }
 
-type SuccessfullyUploadedResponseData struct {
-	RootEndpoint   string `json:"root_endpoint"`
-	FileName       string `json:"file_name"`
-	ThumbnailURL   string `json:"thumbnail_url"`
-	Resized256URL  string `json:"resized_256_url"`
-	Resized1024URL string `json:"resized_1024_url"`
-}
+// root_endpoint, file_name과 Config.Variants의 preset마다 <Name>_url 필드를 갖는다.
+// preset에 alternate format이 있으면 <Name>_<format>_url 필드도 갖는다.
+// e.g. {"root_endpoint": "...", "file_name": "abcd123.png", "thumbnail_url": "...", "thumbnail_webp_url": "...", "resized_256_url": "..."}
+type SuccessfullyUploadedResponseData map[string]string
 
-// fileFullName은 파일 이름 자체와 ., 확장자명이 모두 연결된 문자.
-// e.g. abcd123.png
-func GenerateSuccessfullyUploadedResponse(fileFullName string) *BaseResponse {
+// hashedFileName은 확장자를 제외한 파일 이름, extension은 원본 이미지의 포맷
+// e.g. abcd123, png
+func GenerateSuccessfullyUploadedResponse(hashedFileName, extension string) *BaseResponse {
 	rootEndpoint := Config.Storage.Aws.Endpoint
-	return &BaseResponse{
-		Data: SuccessfullyUploadedResponseData{
-			RootEndpoint:   rootEndpoint,
-			FileName:       fileFullName,
-			ThumbnailURL:   path.Join(rootEndpoint, "thumbnail", fileFullName),
-			Resized256URL:  path.Join(rootEndpoint, "resized", strconv.Itoa(256), fileFullName),
-			Resized1024URL: path.Join(rootEndpoint, "resized", strconv.Itoa(1024), fileFullName),
-		},
+	if Config.Storage.Disk.Enabled {
+		// StoredImageRequestHandler가 제공하는 경로
+		rootEndpoint = Config.Storage.Disk.Endpoint
 	}
+	data := SuccessfullyUploadedResponseData{
+		"root_endpoint": rootEndpoint,
+		"file_name":     hashedFileName + "." + extension,
+	}
+	for _, preset := range Config.Variants {
+		for _, output := range preset.Outputs() {
+			fileFullName := hashedFileName + "." + output.OutputFormat(extension)
+			data[output.ResponseField] = joinURL(rootEndpoint, preset.Path, fileFullName)
+		}
+	}
+
+	return &BaseResponse{Data: data}
+}
 
+// path.Join은 "https://"의 "//"를 "/"로 바꿔버리므로 root endpoint와 나머지 경로를 따로 합친다.
+func joinURL(rootEndpoint string, elem ...string) string {
+	return strings.TrimSuffix(rootEndpoint, "/") + "/" + path.Join(elem...)
 }
 
 func ForceContentTypeMultipartFormDataMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
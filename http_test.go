@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGenerateSuccessfullyUploadedResponse(t *testing.T) {
+	originalConfig := Config
+	defer func() { Config = originalConfig }()
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{
+		{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, AlternateFormats: []string{"gif"}},
+		{Name: "resized_512", Path: "resized/512", Kind: VariantKindResize, Width: 512, Format: "jpeg"},
+	}}
+	Config.Storage.Aws.Endpoint = "https://drive.dev.khumu.me/"
+
+	resp := GenerateSuccessfullyUploadedResponse("abcd1234", "png")
+	data := resp.Data.(SuccessfullyUploadedResponseData)
+	assert.Equal(t, "https://drive.dev.khumu.me/", data["root_endpoint"])
+	assert.Equal(t, "abcd1234.png", data["file_name"])
+	assert.Equal(t, "https://drive.dev.khumu.me/thumbnail/abcd1234.png", data["thumbnail_url"])
+	assert.Equal(t, "https://drive.dev.khumu.me/resized/512/abcd1234.jpeg", data["resized_512_url"])
+	assert.Equal(t, "https://drive.dev.khumu.me/thumbnail/abcd1234.gif", data["thumbnail_gif_url"])
+	assert.Len(t, data, 5)
+}
+
+func TestImageUploadRequestHandler_Limits(t *testing.T) {
+	originalLimits := Config.Limits
+	defer func() { Config.Limits = originalLimits }()
+	e := NewEcho()
+
+	for _, tc := range []struct {
+		name           string
+		limits         DecodeLimits
+		expectedStatus int
+		expectedLimit  string
+	}{
+		{name: "body_크기_초과", limits: DecodeLimits{MaxBodySize: 100}, expectedStatus: 413, expectedLimit: LimitMaxBodySize},
+		{name: "이미지_크기_초과", limits: DecodeLimits{MaxBodySize: 10000, MaxPixels: 100000000}, expectedStatus: 422, expectedLimit: LimitMaxPixels},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			Config.Limits = tc.limits
+			body := bytes.NewBuffer([]byte{})
+			writer := multipart.NewWriter(body)
+			part, err := writer.CreateFormFile("image", "bomb.png")
+			assert.NoError(t, err)
+			_, err = part.Write(testPNGHeader(50000, 50000))
+			assert.NoError(t, err)
+			assert.NoError(t, writer.WriteField("hashing", "false"))
+			assert.NoError(t, writer.Close())
+
+			for _, contentLength := range []int64{int64(body.Len()), -1} {
+				req := httptest.NewRequest("POST", "/api/images", bytes.NewReader(body.Bytes()))
+				req.Header.Set("Content-Type", writer.FormDataContentType())
+				// Content-Length를 알 수 없는 경우에도 body를 읽는 중에 제한한다.
+				req.ContentLength = contentLength
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+
+				assert.Equal(t, tc.expectedStatus, rec.Code)
+				resp := struct {
+					Data    ImageLimitError `json:"data"`
+					Message string          `json:"message"`
+				}{}
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				assert.Equal(t, tc.expectedLimit, resp.Data.Limit)
+				assert.NotEmpty(t, resp.Message)
+			}
+		})
+	}
+}
+
+func TestImageDeleteRequestHandler(t *testing.T) {
+	storage := beforeEachDeleteTest(t)
+	originalStorage := ImageStorage
+	defer func() { ImageStorage = originalStorage }()
+	ImageStorage = storage
+	e := NewEcho()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/images/abcd.png", nil))
+	assert.Equal(t, 200, rec.Code)
+	resp := struct {
+		Data struct {
+			FileName string         `json:"file_name"`
+			Results  []DeleteResult `json:"results"`
+		} `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "abcd", resp.Data.FileName)
+	assert.Len(t, resp.Data.Results, 5)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("DELETE", "/api/images/abcd", nil))
+	assert.Equal(t, 404, rec.Code)
+}
+
+func TestStoredImageRequestHandler(t *testing.T) {
+	originalConfig, originalStorage := Config, ImageStorage
+	defer func() { Config, ImageStorage = originalConfig, originalStorage }()
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128}}}
+	Config.Storage.Disk.Enabled = true
+	Config.Storage.Disk.Endpoint = "http://localhost:9001/images/"
+	ImageStorage = NewDiskStorage(t.TempDir(), 0)
+	data := []byte("0123456789")
+	assert.NoError(t, ImageStorage.Put("thumbnail/abcd.png", bytes.NewReader(data), "image/png"))
+	e := NewEcho()
+
+	serve := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", "/images/thumbnail/abcd.png", nil)
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, data, rec.Body.Bytes())
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, lastModified)
+
+	t.Run("조건부_요청", func(t *testing.T) {
+		assert.Equal(t, 304, serve("GET", "/images/thumbnail/abcd.png", map[string]string{"If-None-Match": etag}).Code)
+		assert.Equal(t, 304, serve("GET", "/images/thumbnail/abcd.png", map[string]string{"If-Modified-Since": lastModified}).Code)
+		assert.Equal(t, 200, serve("GET", "/images/thumbnail/abcd.png", map[string]string{"If-None-Match": `"other"`}).Code)
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		rec := serve("GET", "/images/thumbnail/abcd.png", map[string]string{"Range": "bytes=2-5"})
+		assert.Equal(t, 206, rec.Code)
+		assert.Equal(t, "2345", rec.Body.String())
+		assert.Equal(t, "bytes 2-5/10", rec.Header().Get("Content-Range"))
+		assert.Equal(t, 416, serve("GET", "/images/thumbnail/abcd.png", map[string]string{"Range": "bytes=20-"}).Code)
+	})
+
+	t.Run("HEAD", func(t *testing.T) {
+		rec := serve("HEAD", "/images/thumbnail/abcd.png", nil)
+		assert.Equal(t, 200, rec.Code)
+		assert.Equal(t, "10", rec.Header().Get("Content-Length"))
+		assert.Empty(t, rec.Body.Bytes())
+	})
+
+	t.Run("없는_파일", func(t *testing.T) {
+		assert.Equal(t, 404, serve("GET", "/images/thumbnail/none.png", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/thumbnail", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/thumbnail/..%2f..%2fgo.mod", nil).Code)
+	})
+
+	t.Run("이미지가_아닌_파일", func(t *testing.T) {
+		// 저장소 아래에 있더라도 원본, variant, cache가 아닌 파일은 제공하지 않는다.
+		for _, key := range []string{"config/default.yml", "queue/wal.log", "dead-letters/abcd.json", "quota.db"} {
+			assert.NoError(t, ImageStorage.Put(key, bytes.NewReader(data), "application/octet-stream"))
+		}
+		assert.Equal(t, 404, serve("GET", "/images/config/default.yml", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/queue/wal.log", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/dead-letters/abcd.json", nil).Code)
+		assert.Equal(t, 404, serve("HEAD", "/images/quota.db", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/thumbnail/../config/default.yml", nil).Code)
+		assert.Equal(t, 404, serve("GET", "/images/thumbnail/", nil).Code)
+
+		assert.NoError(t, ImageStorage.Put("original/abcd.png", bytes.NewReader(data), "image/png"))
+		assert.NoError(t, ImageStorage.Put("cache/abcd/w300.png", bytes.NewReader(data), "image/png"))
+		assert.Equal(t, 200, serve("GET", "/images/original/abcd.png", nil).Code)
+		assert.Equal(t, 200, serve("GET", "/images/cache/abcd/w300.png", nil).Code)
+	})
+
+	t.Run("응답의_URL", func(t *testing.T) {
+		data := GenerateSuccessfullyUploadedResponse("abcd", "png").Data.(SuccessfullyUploadedResponseData)
+		assert.Equal(t, "http://localhost:9001/images/", data["root_endpoint"])
+		assert.Equal(t, "http://localhost:9001/images/thumbnail/abcd.png", data["thumbnail_url"])
+	})
+}
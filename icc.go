@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"github.com/sirupsen/logrus"
+	"image"
+	"math"
+)
+
+// 원본 이미지에 ICC profile이 있을 때 변환된 이미지의 색을 어떻게 유지할지
+const (
+	// ICC profile을 변환된 이미지에도 그대로 기록한다. metadata 정책과 관계 없이 기록된다.
+	ColorProfileModePreserve = "preserve"
+	// 이미지를 sRGB로 변환하고 ICC profile은 기록하지 않는다.
+	ColorProfileModeSRGB = "srgb"
+)
+
+var (
+	ErrInvalidColorProfileMode = errors.New("잘못된 colorProfile 설정입니다.")
+	ErrUnsupportedICCProfile   = errors.New("지원하지 않는 ICC profile입니다.")
+
+	// sRGB의 rXYZ, gXYZ, bXYZ (D50). 원본의 profile이 이와 같으면 변환하지 않는다.
+	srgbToXYZ = [3][3]float64{
+		{0.4360747, 0.3850649, 0.1430804},
+		{0.2225045, 0.7168786, 0.0606169},
+		{0.0139322, 0.0971045, 0.7141733},
+	}
+	// XYZ (D50)를 linear sRGB로 변환하는 행렬 (Bradford)
+	xyzToSRGB = [3][3]float64{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+)
+
+const (
+	iccHeaderSize = 128
+	// linear 값을 sRGB로 인코딩할 때 사용하는 table의 크기
+	srgbEncodeTableSize = 4096
+)
+
+type ColorProfilePolicy struct {
+	// preserve, srgb. 비어있으면 ICC profile은 metadata 정책을 따른다.
+	Mode string
+}
+
+func (p ColorProfilePolicy) Validate() error {
+	switch p.Mode {
+	case "", ColorProfileModePreserve, ColorProfileModeSRGB:
+		return nil
+	default:
+		return fmt.Errorf("%w mode=%s", ErrInvalidColorProfileMode, p.Mode)
+	}
+}
+
+// 원본 파일의 ICC profile에 따라 이미지를 sRGB로 변환하거나, 변환된 이미지에 기록할 메타데이터에 ICC profile을 남긴다.
+// gif처럼 ImageData가 없거나 ICC profile이 없는 경우 그대로 반환한다.
+func (p ColorProfilePolicy) Apply(imageData image.Image, metadata *ImageMetadata, data []byte, extension string) (image.Image, *ImageMetadata) {
+	if p.Mode == "" || imageData == nil {
+		return imageData, metadata
+	}
+	profile := readICCProfile(data, extension)
+	if len(profile) == 0 {
+		return imageData, metadata
+	}
+
+	if p.Mode == ColorProfileModeSRGB {
+		converted, err := ConvertToSRGB(imageData, profile)
+		if err == nil {
+			return converted, metadata.withICCProfile(nil)
+		}
+		// 변환할 수 없는 profile이면 profile을 남겨서 색이 달라지지 않도록 한다.
+		logrus.Warnf("이미지를 sRGB로 변환할 수 없어 ICC profile을 유지합니다. err=%v", err)
+	}
+	if iccColorSpace(profile) != "RGB " {
+		// 변환된 이미지는 RGB로 인코딩되므로 CMYK, Gray profile은 기록하지 않는다.
+		return imageData, metadata.withICCProfile(nil)
+	}
+	return imageData, metadata.withICCProfile(profile)
+}
+
+// ICC profile만 바꾼 메타데이터. 남는 항목이 없으면 nil을 반환한다.
+func (m *ImageMetadata) withICCProfile(profile []byte) *ImageMetadata {
+	copied := &ImageMetadata{}
+	if m != nil {
+		*copied = *m
+	}
+	copied.ICCProfile = profile
+	if copied.isEmpty() {
+		return nil
+	}
+	return copied
+}
+
+// matrix/TRC 방식의 RGB ICC profile. 대부분의 디스플레이 profile(sRGB, Display P3, Adobe RGB 등)이 이 방식이다.
+type iccProfile struct {
+	// linear RGB를 XYZ (D50)로 변환하는 행렬
+	toXYZ [3][3]float64
+	// 채널별로 인코딩된 값(0~1)을 linear 값으로 변환하는 함수
+	curves [3]func(float64) float64
+}
+
+func iccColorSpace(profile []byte) string {
+	if len(profile) < iccHeaderSize {
+		return ""
+	}
+	return string(profile[16:20])
+}
+
+// ICC profile에서 rXYZ, gXYZ, bXYZ와 rTRC, gTRC, bTRC tag를 읽는다.
+// A2B0 같은 LUT 방식만 갖는 profile은 지원하지 않는다.
+// https://www.color.org/specification/ICC.1-2022-05.pdf
+func parseICCProfile(profile []byte) (*iccProfile, error) {
+	if len(profile) < iccHeaderSize+4 || string(profile[36:40]) != "acsp" {
+		return nil, fmt.Errorf("%w ICC profile 형식이 아닙니다", ErrUnsupportedICCProfile)
+	}
+	if iccColorSpace(profile) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, fmt.Errorf("%w color space=%q, pcs=%q", ErrUnsupportedICCProfile, iccColorSpace(profile), profile[20:24])
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[iccHeaderSize:]))
+	for i := 0; i < count; i++ {
+		entry := iccHeaderSize + 4 + i*12
+		if entry+12 > len(profile) {
+			break
+		}
+		offset := uint64(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := uint64(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset+size > uint64(len(profile)) {
+			continue
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	for i, name := range []string{"r", "g", "b"} {
+		xyz, ok := iccXYZ(tags[name+"XYZ"])
+		if !ok {
+			return nil, fmt.Errorf("%w %sXYZ tag가 없습니다", ErrUnsupportedICCProfile, name)
+		}
+		for j := range xyz {
+			p.toXYZ[j][i] = xyz[j]
+		}
+		curve, ok := iccCurve(tags[name+"TRC"])
+		if !ok {
+			return nil, fmt.Errorf("%w %sTRC tag를 해석할 수 없습니다", ErrUnsupportedICCProfile, name)
+		}
+		p.curves[i] = curve
+	}
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// XYZType: 'XYZ ' reserved(4) X Y Z
+func iccXYZ(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[0:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// curveType(curv) 혹은 parametricCurveType(para)
+func iccCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[0:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case count == 0:
+			return func(x float64) float64 { return x }, true
+		case count == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case len(tag) >= 12+count*2:
+			table := make([]float64, count)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+			}
+			return func(x float64) float64 {
+				position := x * float64(count-1)
+				i := int(position)
+				if i >= count-1 {
+					return table[count-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(position-float64(i))
+			}, true
+		}
+	case "para":
+		functionType := int(binary.BigEndian.Uint16(tag[8:]))
+		paramCounts := []int{1, 3, 4, 5, 7}
+		if functionType >= len(paramCounts) || len(tag) < 12+paramCounts[functionType]*4 {
+			return nil, false
+		}
+		// g, a, b, c, d, e, f
+		params := make([]float64, 7)
+		for i := 0; i < paramCounts[functionType]; i++ {
+			params[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		switch functionType {
+		case 1, 2:
+			// b + a * x >= 0 인 구간부터 거듭제곱을 사용하고 그 전에는 c(type 1은 0)
+			d = -b / a
+			e, f = c, c
+			c = 0
+		case 3:
+			e, f = 0, 0
+		}
+		return func(x float64) float64 {
+			if functionType == 0 {
+				return math.Pow(x, g)
+			}
+			if x >= d {
+				return math.Pow(math.Max(a*x+b, 0), g) + e
+			}
+			return c*x + f
+		}, true
+	}
+	return nil, false
+}
+
+// 원본 이미지에 포함된 ICC profile의 색공간에서 sRGB로 이미지를 변환한다.
+// sRGB 밖의 색은 잘라낸다. 원본 profile이 sRGB라면 그대로 반환한다.
+func ConvertToSRGB(imageData image.Image, profile []byte) (image.Image, error) {
+	p, err := parseICCProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSRGB() {
+		return imageData, nil
+	}
+
+	// 원본의 8bit 값을 linear 값으로 바꾸는 table
+	var decode [3][256]float64
+	for c := range decode {
+		for v := range decode[c] {
+			decode[c][v] = p.curves[c](float64(v) / 255)
+		}
+	}
+	var encode [srgbEncodeTableSize]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/(srgbEncodeTableSize-1)) * 255))
+	}
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToSRGB[i][k] * p.toXYZ[k][j]
+			}
+		}
+	}
+
+	converted := imaging.Clone(imageData)
+	pix := converted.Pix
+	for i := 0; i+3 < len(pix); i += 4 {
+		r, g, b := decode[0][pix[i]], decode[1][pix[i+1]], decode[2][pix[i+2]]
+		for c := 0; c < 3; c++ {
+			linear := math.Min(math.Max(m[c][0]*r+m[c][1]*g+m[c][2]*b, 0), 1)
+			pix[i+c] = encode[int(math.Round(linear*(srgbEncodeTableSize-1)))]
+		}
+	}
+	return converted, nil
+}
+
+func (p *iccProfile) isSRGB() bool {
+	for i := range p.toXYZ {
+		for j := range p.toXYZ[i] {
+			if math.Abs(p.toXYZ[i][j]-srgbToXYZ[i][j]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for _, x := range []float64{0.1, 0.5, 0.9} {
+			if math.Abs(curve(x)-srgbDecode(x)) > 0.005 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func srgbDecode(x float64) float64 {
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(linear float64) float64 {
+	if linear <= 0.0031308 {
+		return linear * 12.92
+	}
+	return 1.055*math.Pow(linear, 1/2.4) - 0.055
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+// test/test_display_p3.png, test/test_display_p3.jpeg는 Display P3 profile을 포함하고
+// 16x16 크기의 블록 4개(Display P3 기준 빨강, 초록, (200,120,80), (90,160,110))로 이루어진 64x16 이미지다.
+var displayP3Blocks = []color.NRGBA{
+	{R: 255, A: 255},
+	{G: 255, A: 255},
+	{R: 200, G: 120, B: 80, A: 255},
+	{R: 90, G: 160, B: 110, A: 255},
+}
+
+// 각 블록을 sRGB로 변환했을 때 기대하는 색. 빨강, 초록은 sRGB 범위 밖이므로 잘린다.
+var displayP3BlocksInSRGB = []color.NRGBA{
+	{R: 255, A: 255},
+	{G: 255, A: 255},
+	{R: 213, G: 115, B: 70, A: 255},
+	{R: 61, G: 162, B: 105, A: 255},
+}
+
+func TestParseICCProfile(t *testing.T) {
+	data, err := ioutil.ReadFile("test/test_display_p3.png")
+	assert.NoError(t, err)
+	profile := readICCProfile(data, "png")
+	assert.Equal(t, "RGB ", iccColorSpace(profile))
+
+	p, err := parseICCProfile(profile)
+	assert.NoError(t, err)
+	assert.False(t, p.isSRGB())
+	assert.InDelta(t, 0.515102, p.toXYZ[0][0], 0.0001)
+	assert.InDelta(t, 0.214, p.curves[0](0.5), 0.001)
+
+	p, err = parseICCProfile(testICCProfileOf("RGB ", srgbToXYZ, testSRGBCurve()))
+	assert.NoError(t, err)
+	assert.True(t, p.isSRGB())
+
+	_, err = parseICCProfile(testICCProfileOf("CMYK", srgbToXYZ, testSRGBCurve()))
+	assert.ErrorIs(t, err, ErrUnsupportedICCProfile)
+	_, err = parseICCProfile([]byte("test icc profile"))
+	assert.ErrorIs(t, err, ErrUnsupportedICCProfile)
+}
+
+func TestICCCurve(t *testing.T) {
+	gamma := make([]byte, 14)
+	copy(gamma, "curv")
+	binary.BigEndian.PutUint32(gamma[8:], 1)
+	binary.BigEndian.PutUint16(gamma[12:], 0x0233) // 2.2
+	curve, ok := iccCurve(gamma)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.2180, curve(0.5), 0.001)
+
+	table := make([]byte, 12+3*2)
+	copy(table, "curv")
+	binary.BigEndian.PutUint32(table[8:], 3)
+	binary.BigEndian.PutUint16(table[12:], 0)
+	binary.BigEndian.PutUint16(table[14:], 16384)
+	binary.BigEndian.PutUint16(table[16:], 65535)
+	curve, ok = iccCurve(table)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.125, curve(0.25), 0.001)
+	assert.InDelta(t, 1, curve(1), 0.001)
+
+	for _, x := range []float64{0, 0.02, 0.3, 0.8, 1} {
+		assert.InDelta(t, srgbDecode(x), testSRGBCurveFunc(t)(x), 0.0001)
+	}
+
+	_, ok = iccCurve([]byte("text"))
+	assert.False(t, ok)
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	data, err := ioutil.ReadFile("test/test_display_p3.png")
+	assert.NoError(t, err)
+	imageData, _, err := image.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	converted, err := ConvertToSRGB(imageData, readICCProfile(data, "png"))
+	assert.NoError(t, err)
+	for i, expected := range displayP3BlocksInSRGB {
+		actual := color.NRGBAModel.Convert(converted.At(i*16+8, 8)).(color.NRGBA)
+		assertColorInDelta(t, expected, actual, 1)
+	}
+
+	// sRGB profile이면 변환하지 않는다.
+	srgb, err := ConvertToSRGB(imageData, testICCProfileOf("RGB ", srgbToXYZ, testSRGBCurve()))
+	assert.NoError(t, err)
+	assert.Equal(t, imageData, srgb)
+
+	_, err = ConvertToSRGB(imageData, []byte("test icc profile"))
+	assert.ErrorIs(t, err, ErrUnsupportedICCProfile)
+}
+
+func TestColorProfilePolicy_Validate(t *testing.T) {
+	assert.NoError(t, ColorProfilePolicy{}.Validate())
+	assert.NoError(t, ColorProfilePolicy{Mode: ColorProfileModeSRGB}.Validate())
+	assert.ErrorIs(t, ColorProfilePolicy{Mode: "p3"}.Validate(), ErrInvalidColorProfileMode)
+}
+
+func TestColorProfilePolicy_Apply(t *testing.T) {
+	for _, fixture := range []struct{ path, extension string }{{"test/test_display_p3.png", "png"}, {"test/test_display_p3.jpeg", "jpeg"}} {
+		data, err := ioutil.ReadFile(fixture.path)
+		assert.NoError(t, err)
+		imageData, _, err := image.Decode(bytes.NewReader(data))
+		assert.NoError(t, err)
+		profile := readICCProfile(data, fixture.extension)
+		assert.NotEmpty(t, profile)
+
+		t.Run(fixture.extension+"_preserve", func(t *testing.T) {
+			// metadata 정책이 strip이더라도 ICC profile을 남긴다.
+			applied, metadata := ColorProfilePolicy{Mode: ColorProfileModePreserve}.Apply(imageData, nil, data, fixture.extension)
+			assert.Equal(t, imageData, applied)
+			assert.Equal(t, &ImageMetadata{ICCProfile: profile}, metadata)
+
+			// 리사이징 후 인코딩한 이미지에도 profile이 남는다.
+			for _, format := range []string{"jpeg", "png"} {
+				body := bytes.NewBuffer([]byte{})
+				err := EncodeImage(body, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: ResizeImage(applied, ResizeOptions{Width: 32, Fit: FitWidth}), Extension: format, Metadata: metadata}})
+				assert.NoError(t, err)
+				assert.Equal(t, profile, ReadMetadata(body.Bytes(), format).ICCProfile)
+			}
+		})
+
+		t.Run(fixture.extension+"_srgb", func(t *testing.T) {
+			applied, metadata := ColorProfilePolicy{Mode: ColorProfileModeSRGB}.Apply(imageData, &ImageMetadata{Copyright: "khumu", ICCProfile: profile}, data, fixture.extension)
+			assert.Equal(t, &ImageMetadata{Copyright: "khumu"}, metadata)
+			delta := 1
+			if fixture.extension == "jpeg" {
+				delta = 6
+			}
+			for i, expected := range displayP3BlocksInSRGB {
+				actual := color.NRGBAModel.Convert(applied.At(i*16+8, 8)).(color.NRGBA)
+				assertColorInDelta(t, expected, actual, delta)
+			}
+		})
+	}
+
+	t.Run("변환할_수_없는_profile은_유지", func(t *testing.T) {
+		profile := testICCProfileOf("RGB ", srgbToXYZ, nil)
+		data := bytes.NewBuffer([]byte{})
+		imageData := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		err := EncodeImage(data, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "png", Metadata: &ImageMetadata{ICCProfile: profile}}})
+		assert.NoError(t, err)
+
+		applied, metadata := ColorProfilePolicy{Mode: ColorProfileModeSRGB}.Apply(imageData, nil, data.Bytes(), "png")
+		assert.Equal(t, imageData, applied)
+		assert.Equal(t, &ImageMetadata{ICCProfile: profile}, metadata)
+	})
+
+	t.Run("RGB가_아닌_profile은_기록하지_않음", func(t *testing.T) {
+		profile := testICCProfileOf("GRAY", srgbToXYZ, testSRGBCurve())
+		data := bytes.NewBuffer([]byte{})
+		imageData := image.NewGray(image.Rect(0, 0, 4, 4))
+		err := EncodeImage(data, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "png", Metadata: &ImageMetadata{ICCProfile: profile}}})
+		assert.NoError(t, err)
+
+		_, metadata := ColorProfilePolicy{Mode: ColorProfileModePreserve}.Apply(imageData, &ImageMetadata{ICCProfile: profile}, data.Bytes(), "png")
+		assert.Nil(t, metadata)
+	})
+}
+
+func assertColorInDelta(t *testing.T, expected, actual color.NRGBA, delta int) {
+	for _, pair := range [][2]uint8{{expected.R, actual.R}, {expected.G, actual.G}, {expected.B, actual.B}} {
+		assert.InDelta(t, int(pair[0]), int(pair[1]), float64(delta), "expected=%v, actual=%v", expected, actual)
+	}
+}
+
+// sRGB의 TRC를 parametricCurveType(type 3)으로 나타낸 tag
+func testSRGBCurve() []byte {
+	return testParametricCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+}
+
+func testSRGBCurveFunc(t *testing.T) func(float64) float64 {
+	curve, ok := iccCurve(testSRGBCurve())
+	assert.True(t, ok)
+	return curve
+}
+
+func testParametricCurve(functionType uint16, params ...float64) []byte {
+	tag := make([]byte, 12+len(params)*4)
+	copy(tag, "para")
+	binary.BigEndian.PutUint16(tag[8:], functionType)
+	for i, param := range params {
+		binary.BigEndian.PutUint32(tag[12+i*4:], uint32(int32(param*65536)))
+	}
+	return tag
+}
+
+// matrix/TRC 방식의 ICC profile(v2)을 만든다. curve가 nil이면 TRC tag가 없는 profile을 만든다.
+func testICCProfileOf(colorSpace string, toXYZ [3][3]float64, curve []byte) []byte {
+	xyzTag := func(x, y, z float64) []byte {
+		tag := make([]byte, 20)
+		copy(tag, "XYZ ")
+		for i, v := range []float64{x, y, z} {
+			binary.BigEndian.PutUint32(tag[8+i*4:], uint32(int32(v*65536)))
+		}
+		return tag
+	}
+	desc := make([]byte, 12+len("Test Profile")+1+4+4+2+1+67)
+	copy(desc, "desc")
+	binary.BigEndian.PutUint32(desc[8:], uint32(len("Test Profile")+1))
+	copy(desc[12:], "Test Profile")
+
+	tags := map[string][]byte{
+		"desc": desc,
+		"wtpt": xyzTag(0.9642, 1, 0.8249),
+		"rXYZ": xyzTag(toXYZ[0][0], toXYZ[1][0], toXYZ[2][0]),
+		"gXYZ": xyzTag(toXYZ[0][1], toXYZ[1][1], toXYZ[2][1]),
+		"bXYZ": xyzTag(toXYZ[0][2], toXYZ[1][2], toXYZ[2][2]),
+	}
+	if curve != nil {
+		tags["rTRC"], tags["gTRC"], tags["bTRC"] = curve, curve, curve
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header := make([]byte, iccHeaderSize+4+len(names)*12)
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], colorSpace)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	copy(header[68:], xyzTag(0.9642, 1, 0.8249)[8:])
+	binary.BigEndian.PutUint32(header[iccHeaderSize:], uint32(len(names)))
+	profile := header
+	for i, name := range names {
+		entry := iccHeaderSize + 4 + i*12
+		copy(profile[entry:], name)
+		binary.BigEndian.PutUint32(profile[entry+4:], uint32(len(profile)))
+		binary.BigEndian.PutUint32(profile[entry+8:], uint32(len(tags[name])))
+		profile = append(profile, tags[name]...)
+		// tag는 4byte 단위로 정렬한다.
+		for len(profile)%4 != 0 {
+			profile = append(profile, 0)
+		}
+	}
+	binary.BigEndian.PutUint32(profile[0:], uint32(len(profile)))
+	return profile
+}
@@ -6,9 +6,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"github.com/disintegration/imaging"
-	jpgis "github.com/dsoprea/go-jpeg-image-structure/v2"
-	pngis "github.com/dsoprea/go-png-image-structure/v2"
-	riimage "github.com/dsoprea/go-utility/v2/image"
 	log "github.com/sirupsen/logrus"
 	_ "golang.org/x/image/webp"
 	"image"
@@ -28,49 +25,26 @@ var (
 // jpg는 jpeg로 해석됨.
 // bmp는 png로 해석됨.
 // orientation은 0이면 회전 정보 없음을 의미
+// Config.Limits를 초과하는 이미지는 디코딩하지 않고 *ImageLimitError를 반환한다.
 func DecodeImageFile(reader io.Reader) (imageData image.Image, orientation uint, gifImageData *gif.GIF, extension string, err error) {
-	var mc riimage.MediaContext
-	
 	// reader는 한 번만 읽을 수 있으므로 복사해둔다.
 	tmpData, err := ioutil.ReadAll(reader)
 	if err != nil {
 		log.Error(err)
 		return
 	}
+	// 전체를 디코딩하기 전에 크기와 프레임 수를 확인한다.
+	if err = Config.Limits.Check(tmpData); err != nil {
+		log.Warn(err)
+		return
+	}
 
 	imageData, extension, err = image.Decode(bytes.NewReader(tmpData))
 	log.Infof("founded extension: %s", extension)
-	if extension == "jpeg" {
-		jmp := jpgis.NewJpegMediaParser()
-		mc, err = jmp.ParseBytes(tmpData)
-		//tags, med, err := exif.GetFlatExifData(tmpData, &exif.ScanOptions{})
-		if err != nil {
-			log.Error(err)
-		}
-	}
-
-	if extension == "png" {
-		pmp := pngis.NewPngMediaParser()
-		mc, err = pmp.ParseBytes(tmpData)
-		if err != nil {
-			log.Error(err)
-		}
-	}
-	
-	if mc != nil {
-		ifdIdentity, _, err := mc.Exif()
-		orientationData, err := ifdIdentity.FindTagWithName("Orientation")
-		if err != nil {
-			log.Info("Orientation을 사용하지 않는 이미지.")
-		} else{
-			orientationTmp, err := orientationData[0].Value()
-			if err != nil {
-				log.Error(err)
-			} else{
-				orientation = uint(orientationTmp.([]uint16)[0])
-				log.Infof("Exif 데이터 해석 결과 회전된 이미지 입니다. orientation=%d", orientation)
-			}
-
+	if err == nil {
+		orientation = readOrientation(tmpData, extension)
+		if orientation > 1 {
+			log.Infof("Exif 데이터 해석 결과 회전된 이미지 입니다. orientation=%d", orientation)
 		}
 	}
 
@@ -92,21 +66,45 @@ func DecodeImageFile(reader io.Reader) (imageData image.Image, orientation uint,
 	return
 }
 
-// 참고: https://feel5ny.github.io/2018/08/06/JS_13/
-func RotateImage(imageData image.Image, exifOrientation uint) image.Image{
-	if exifOrientation != 0 && exifOrientation != 1 {
-		if exifOrientation == 7 || exifOrientation == 8 {
-			return imaging.Rotate90(imageData)
-		} else if exifOrientation == 3 || exifOrientation == 4 {
-			return imaging.Rotate180(imageData)
-		} else if exifOrientation == 5 || exifOrientation == 6 {
-			return imaging.Rotate270(imageData)
-		} else {
-			log.Errorf("Unsupported orientation: orientation=%d", exifOrientation)
-		}
+// 원본 파일의 exif에서 orientation(1~8)을 읽는다. 회전 정보가 없으면 0을 반환한다.
+// jpeg, png 외에 webp의 EXIF chunk도 확인한다.
+func readOrientation(data []byte, extension string) uint {
+	blobs := readExif(data, extension)
+	if len(blobs) == 0 {
+		log.Info("Exif 데이터가 없는 이미지.")
+		return 0
 	}
+	return exifOrientation(blobs[0])
+}
 
-	return imageData
+// exif orientation에 따라 이미지를 똑바로 보이도록 뒤집거나 회전한다.
+// 변환된 이미지를 인코딩한 결과물에는 exif가 포함되지 않으므로 브라우저가 다시 회전시키는 일은 없다.
+// 참고: https://feel5ny.github.io/2018/08/06/JS_13/
+// 참고: https://magnushoff.com/articles/jpeg-orientation/
+func RotateImage(imageData image.Image, exifOrientation uint) image.Image {
+	switch exifOrientation {
+	case 0, 1:
+		return imageData
+	case 2:
+		return imaging.FlipH(imageData)
+	case 3:
+		return imaging.Rotate180(imageData)
+	case 4:
+		return imaging.FlipV(imageData)
+	case 5:
+		return imaging.Transpose(imageData)
+	case 6:
+		// 시계 방향으로 90도
+		return imaging.Rotate270(imageData)
+	case 7:
+		return imaging.Transverse(imageData)
+	case 8:
+		// 반시계 방향으로 90도
+		return imaging.Rotate90(imageData)
+	default:
+		log.Errorf("Unsupported orientation: orientation=%d", exifOrientation)
+		return imageData
+	}
 }
 
 // extension이 포함되어있든 아니든 어차피 해싱할것이라 상관없음.
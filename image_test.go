@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io/ioutil"
 	"testing"
 )
@@ -41,6 +45,97 @@ func TestDecodeImageFile(t *testing.T) {
 	}
 }
 
+func TestRotateImage(t *testing.T) {
+	// 저장된 이미지의 (x, y) 픽셀이 똑바로 보이도록 변환된 이미지에서 어디에 위치해야하는지
+	const w, h = 3, 2
+	for orientation, position := range map[uint]func(x, y int) (int, int){
+		1: func(x, y int) (int, int) { return x, y },
+		2: func(x, y int) (int, int) { return w - 1 - x, y },
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y },
+		4: func(x, y int) (int, int) { return x, h - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return h - 1 - y, x },
+		7: func(x, y int) (int, int) { return h - 1 - y, w - 1 - x },
+		8: func(x, y int) (int, int) { return y, w - 1 - x },
+	} {
+		stored := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				stored.Set(x, y, color.NRGBA{R: uint8(x * 100), G: uint8(y * 100), A: 255})
+			}
+		}
+
+		rotated := RotateImage(stored, orientation)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				rx, ry := position(x, y)
+				assert.Equal(t, stored.At(x, y), rotated.At(rx, ry), "orientation=%d, x=%d, y=%d", orientation, x, y)
+			}
+		}
+	}
+}
+
+func TestDecodeImageFile_Orientation(t *testing.T) {
+	body := bytes.NewBuffer([]byte{})
+	assert.NoError(t, jpeg.Encode(body, image.NewRGBA(image.Rect(0, 0, 30, 20)), nil))
+	encoded := body.Bytes()
+	// SOI 바로 뒤에 exif를 담은 APP1 세그먼트를 넣는다.
+	app1 := append([]byte("Exif\x00\x00"), testExifTIFF(6)...)
+	segment := append([]byte{0xff, 0xe1, 0, 0}, app1...)
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(app1)+2))
+	data := append(append(append([]byte{}, encoded[:2]...), segment...), encoded[2:]...)
+
+	imageData, orientation, _, ext, err := DecodeImageFile(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", ext)
+	assert.Equal(t, uint(6), orientation)
+
+	// 회전한 뒤 인코딩한 결과물에는 orientation이 남지 않는다.
+	body = bytes.NewBuffer([]byte{})
+	err = EncodeImage(body, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: RotateImage(imageData, orientation), Extension: "jpeg"}})
+	assert.NoError(t, err)
+	imageData, orientation, _, _, err = DecodeImageFile(body)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), orientation)
+	assert.Equal(t, 20, imageData.Bounds().Dx())
+	assert.Equal(t, 30, imageData.Bounds().Dy())
+}
+
+func TestReadOrientation_WebP(t *testing.T) {
+	for _, prefix := range []string{"", "Exif\x00\x00"} {
+		exifChunk := append([]byte(prefix), testExifTIFF(8)...)
+		data := []byte("RIFF\x00\x00\x00\x00WEBP")
+		// orientation과 관계 없는 chunk를 건너뛰는지 확인하기 위해 홀수 크기의 chunk를 넣는다.
+		data = append(data, []byte("ICCP\x03\x00\x00\x00abc\x00")...)
+		data = append(data, []byte("EXIF")...)
+		data = append(data, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(data[len(data)-4:], uint32(len(exifChunk)))
+		data = append(data, exifChunk...)
+		binary.LittleEndian.PutUint32(data[4:8], uint32(len(data)-8))
+
+		assert.Equal(t, uint(8), readOrientation(data, "webp"))
+	}
+	assert.Equal(t, uint(0), readOrientation([]byte("RIFF\x04\x00\x00\x00WEBP"), "webp"))
+}
+
+func TestDecodeImageFile_HEIF(t *testing.T) {
+	// HEIF 디코더는 등록되어있지 않으므로 heic 이미지는 해석할 수 없다.
+	data := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+	_, _, _, _, err := DecodeImageFile(bytes.NewReader(data))
+	assert.Error(t, err)
+}
+
+// orientation 태그 하나만을 갖는 big endian TIFF 형식의 exif 데이터
+func testExifTIFF(orientation uint16) []byte {
+	data := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	// IFD0: entry 1개
+	data = append(data, 0, 1)
+	// tag 0x0112(Orientation), type 3(SHORT), count 1, value
+	data = append(data, 0x01, 0x12, 0, 3, 0, 0, 0, 1, byte(orientation>>8), byte(orientation), 0, 0)
+	// 다음 IFD 없음
+	return append(data, 0, 0, 0, 0)
+}
+
 //type parseImageFileNameTestCase struct {
 //	originalFileName string
 //	parsedFileName   string
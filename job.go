@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 업로드 요청 하나에서 파생된 각 variant(원본, 썸네일, 리사이징 이미지)의 처리 상태
+type JobStatus string
+
+const (
+	JobStatusQueued       JobStatus = "queued"
+	JobStatusTransforming JobStatus = "transforming"
+	JobStatusUploading    JobStatus = "uploading"
+	JobStatusDone         JobStatus = "done"
+	JobStatusFailed       JobStatus = "failed"
+	// 업로드에 실패해 다시 시도하기를 기다리는 중
+	JobStatusRetrying JobStatus = "retrying"
+	// Job 전체의 상태에만 사용. 일부 variant는 처리 중이거나 완료된 상태
+	JobStatusProcessing JobStatus = "processing"
+)
+
+var (
+	// DispatchMessages로 전달된 모든 작업의 상태를 관리하는 registry
+	Jobs = NewJobRegistry()
+
+	ErrJobNotFound = errors.New("해당 이름의 이미지에 대한 작업 정보가 존재하지 않습니다.")
+)
+
+type VariantState struct {
+	Status    JobStatus `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HashedFileName 하나에 대한 작업 정보
+// variant의 key는 업로드 경로(UploadPath)를 사용하고, 추가 포맷은 경로 뒤에 포맷을 붙인다.
+// (e.g. original, thumbnail, thumbnail.webp, resized/256)
+type Job struct {
+	HashedFileName string    `json:"hashed_file_name"`
+	Status         JobStatus `json:"status"`
+	// 업로드를 요청한 주체. 인증을 사용하지 않으면 nil
+	Owner     *Principal               `json:"owner,omitempty"`
+	Variants  map[string]*VariantState `json:"variants"`
+	CreatedAt time.Time                `json:"created_at"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+type JobRegistry struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+	// 모든 variant가 끝난 Job을 보관하는 시간. 0 이하이면 지우지 않는다.
+	retention time.Duration
+	// variant가 done 혹은 failed 상태가 되었을 때 호출되는 함수들
+	finishedHooks []func(hashedFileName, variant string, state VariantState)
+}
+
+func NewJobRegistry() *JobRegistry {
+	return &JobRegistry{jobs: make(map[string]*Job)}
+}
+
+// 완료된 Job을 보관할 시간을 설정한다.
+func (r *JobRegistry) SetRetention(retention time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retention = retention
+}
+
+// variant가 done 혹은 failed 상태가 될 때마다 호출될 함수를 등록한다.
+// hook은 registry의 lock을 잡지 않은 상태에서 호출된다.
+func (r *JobRegistry) OnVariantFinished(hook func(hashedFileName, variant string, state VariantState)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finishedHooks = append(r.finishedHooks, hook)
+}
+
+// 새로운 Job을 등록한다. 모든 variant는 queued 상태로 시작한다.
+// 같은 이름의 Job이 이미 존재하면 덮어쓴다.
+func (r *JobRegistry) Register(hashedFileName string, variants ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pruneLocked()
+
+	now := time.Now()
+	job := &Job{
+		HashedFileName: hashedFileName,
+		Status:         JobStatusQueued,
+		Variants:       make(map[string]*VariantState, len(variants)),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	for _, variant := range variants {
+		job.Variants[variant] = &VariantState{Status: JobStatusQueued, UpdatedAt: now}
+	}
+	r.jobs[hashedFileName] = job
+}
+
+// Job의 소유자를 기록한다.
+func (r *JobRegistry) SetOwner(hashedFileName string, owner *Principal) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if job, ok := r.jobs[hashedFileName]; ok {
+		job.Owner = owner
+	}
+}
+
+// variant의 상태를 갱신한다. 등록되지 않은 Job이나 variant에 대한 갱신은 무시한다.
+// (e.g. 테스트에서 Transformer나 Uploader를 직접 사용하는 경우)
+func (r *JobRegistry) SetStatus(hashedFileName, variant string, status JobStatus) {
+	r.update(hashedFileName, variant, status, "")
+}
+
+// variant를 실패 상태로 만들고 원인을 기록한다.
+func (r *JobRegistry) SetFailed(hashedFileName, variant string, cause error) {
+	message := ""
+	if cause != nil {
+		message = cause.Error()
+	}
+	r.update(hashedFileName, variant, JobStatusFailed, message)
+}
+
+func (r *JobRegistry) update(hashedFileName, variant string, status JobStatus, message string) {
+	r.mu.Lock()
+	job, ok := r.jobs[hashedFileName]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	state, ok := job.Variants[variant]
+	if !ok {
+		r.mu.Unlock()
+		logrus.Warnf("등록되지 않은 variant의 상태를 갱신하려 했습니다. name=%s, variant=%s", hashedFileName, variant)
+		return
+	}
+	now := time.Now()
+	state.Status = status
+	state.Error = message
+	state.UpdatedAt = now
+	job.UpdatedAt = now
+	job.Status = job.aggregateStatus()
+	snapshot := *state
+	hooks := r.finishedHooks
+	r.mu.Unlock()
+
+	if status == JobStatusDone || status == JobStatusFailed {
+		for _, hook := range hooks {
+			hook(hashedFileName, variant, snapshot)
+		}
+	}
+}
+
+// Job의 복사본을 반환한다. 반환된 Job은 이후의 상태 변화에 영향을 받지 않는다.
+func (r *JobRegistry) Get(hashedFileName string) (*Job, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	job, ok := r.jobs[hashedFileName]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	snapshot := *job
+	snapshot.Variants = make(map[string]*VariantState, len(job.Variants))
+	for variant, state := range job.Variants {
+		copied := *state
+		snapshot.Variants[variant] = &copied
+	}
+	return &snapshot, nil
+}
+
+// 아직 완료되지 않은 variant가 있는 Job들의 이름과 완료되지 않은 variant들
+func (r *JobRegistry) Unfinished() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	unfinished := make(map[string][]string)
+	for name, job := range r.jobs {
+		for variant, state := range job.Variants {
+			if state.Status != JobStatusDone && state.Status != JobStatusFailed {
+				unfinished[name] = append(unfinished[name], variant)
+			}
+		}
+		sort.Strings(unfinished[name])
+	}
+	return unfinished
+}
+
+// retention이 지난 완료된 Job들을 지운다. lock을 잡은 상태에서 호출해야한다.
+func (r *JobRegistry) pruneLocked() {
+	if r.retention <= 0 {
+		return
+	}
+	for name, job := range r.jobs {
+		if job.isFinished() && time.Since(job.UpdatedAt) > r.retention {
+			delete(r.jobs, name)
+		}
+	}
+}
+
+// variant들의 상태로부터 Job 전체의 상태를 정한다.
+// 하나라도 실패하면 failed, 모두 완료되면 done, 모두 대기 중이면 queued, 그 외에는 processing
+func (j *Job) aggregateStatus() JobStatus {
+	numOfDone, numOfQueued := 0, 0
+	for _, state := range j.Variants {
+		switch state.Status {
+		case JobStatusFailed:
+			return JobStatusFailed
+		case JobStatusDone:
+			numOfDone++
+		case JobStatusQueued:
+			numOfQueued++
+		}
+	}
+	if numOfDone == len(j.Variants) {
+		return JobStatusDone
+	} else if numOfQueued == len(j.Variants) {
+		return JobStatusQueued
+	}
+	return JobStatusProcessing
+}
+
+// 더 이상 상태가 바뀔 variant가 없는지
+func (j *Job) isFinished() bool {
+	for _, state := range j.Variants {
+		if state.Status != JobStatusDone && state.Status != JobStatusFailed {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestJobRegistry_SetStatus(t *testing.T) {
+	registry := NewJobRegistry()
+	registry.Register("abcd1234", "original", "thumbnail")
+
+	job, err := registry.Get("abcd1234")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusQueued, job.Status)
+
+	registry.SetStatus("abcd1234", "thumbnail", JobStatusTransforming)
+	job, _ = registry.Get("abcd1234")
+	assert.Equal(t, JobStatusProcessing, job.Status)
+	assert.Equal(t, JobStatusTransforming, job.Variants["thumbnail"].Status)
+
+	registry.SetStatus("abcd1234", "thumbnail", JobStatusDone)
+	registry.SetStatus("abcd1234", "original", JobStatusDone)
+	job, _ = registry.Get("abcd1234")
+	assert.Equal(t, JobStatusDone, job.Status)
+}
+
+func TestJobRegistry_SetFailed(t *testing.T) {
+	registry := NewJobRegistry()
+	registry.Register("abcd1234", "original", "thumbnail")
+	registry.SetStatus("abcd1234", "original", JobStatusDone)
+	registry.SetFailed("abcd1234", "thumbnail", errors.New("업로드 실패"))
+
+	job, err := registry.Get("abcd1234")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusFailed, job.Status)
+	assert.Equal(t, "업로드 실패", job.Variants["thumbnail"].Error)
+}
+
+func TestJobRegistry_Unfinished(t *testing.T) {
+	registry := NewJobRegistry()
+	registry.Register("abcd1234", "original", "thumbnail", "resized/256")
+	registry.Register("efgh5678", "original")
+	registry.SetStatus("abcd1234", "original", JobStatusDone)
+	registry.SetStatus("abcd1234", "thumbnail", JobStatusRetrying)
+	registry.SetFailed("efgh5678", "original", errors.New("업로드 실패"))
+
+	assert.Equal(t, map[string][]string{"abcd1234": {"resized/256", "thumbnail"}}, registry.Unfinished())
+}
+
+func TestJobRegistry_Get(t *testing.T) {
+	t.Run("존재하지_않는_작업", func(t *testing.T) {
+		registry := NewJobRegistry()
+		_, err := registry.Get("unknown")
+		assert.ErrorIs(t, err, ErrJobNotFound)
+	})
+
+	t.Run("반환된_작업은_이후_변경에_영향받지_않음", func(t *testing.T) {
+		registry := NewJobRegistry()
+		registry.Register("abcd1234", "original")
+		job, _ := registry.Get("abcd1234")
+		registry.SetStatus("abcd1234", "original", JobStatusDone)
+		assert.Equal(t, JobStatusQueued, job.Variants["original"].Status)
+	})
+
+	t.Run("보관_기간이_지난_작업은_삭제", func(t *testing.T) {
+		registry := NewJobRegistry()
+		registry.SetRetention(time.Nanosecond)
+		registry.Register("finished", "original")
+		registry.SetStatus("finished", "original", JobStatusDone)
+		registry.Register("pending", "original")
+		time.Sleep(time.Millisecond)
+		registry.Register("new", "original")
+
+		_, err := registry.Get("finished")
+		assert.ErrorIs(t, err, ErrJobNotFound)
+		_, err = registry.Get("pending")
+		assert.NoError(t, err)
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"image"
+	"io"
+)
+
+// 초과한 제한의 이름. 응답의 data.limit에 사용된다.
+const (
+	LimitMaxBodySize    = "maxBodySize"
+	LimitMaxPixels      = "maxPixels"
+	LimitMaxFrames      = "maxFrames"
+	LimitMaxTotalPixels = "maxTotalPixels"
+
+	// 요청 body를 제한하는 reader를 echo context에 저장할 때의 key
+	limitedBodyContextKey = "limitedBody"
+)
+
+var (
+	ErrImageTooLarge       = errors.New("업로드할 수 있는 파일의 크기를 초과했습니다.")
+	ErrImageLimitExceeded  = errors.New("처리할 수 있는 이미지의 크기를 초과했습니다.")
+	ErrInvalidDecodeLimits = errors.New("잘못된 limits 설정입니다.")
+)
+
+// 악의적으로 만들어진 이미지(decompression bomb)로부터 서버를 보호하기 위한 제한. 0이면 제한하지 않는다.
+type DecodeLimits struct {
+	// 요청 body의 최대 크기(byte)
+	MaxBodySize int64
+	// 이미지 한 장(gif는 한 프레임)의 최대 width * height
+	MaxPixels int64
+	// gif의 최대 프레임 수
+	MaxFrames int64
+	// 모든 프레임의 width * height의 합
+	MaxTotalPixels int64
+}
+
+// 제한을 초과한 경우의 에러. body 크기를 초과하면 413, 그 외에는 422로 응답한다.
+type ImageLimitError struct {
+	Limit  string `json:"limit"`
+	Max    int64  `json:"max"`
+	Actual int64  `json:"actual"`
+}
+
+func (l DecodeLimits) Validate() error {
+	if l.MaxBodySize < 0 || l.MaxPixels < 0 || l.MaxFrames < 0 || l.MaxTotalPixels < 0 {
+		return fmt.Errorf("%w 음수일 수 없습니다", ErrInvalidDecodeLimits)
+	}
+	return nil
+}
+
+func (e *ImageLimitError) Error() string {
+	return fmt.Sprintf("%v %s=%d, actual=%d", e.Unwrap(), e.Limit, e.Max, e.Actual)
+}
+
+func (e *ImageLimitError) Unwrap() error {
+	if e.Limit == LimitMaxBodySize {
+		return ErrImageTooLarge
+	}
+	return ErrImageLimitExceeded
+}
+
+func (e *ImageLimitError) StatusCode() int {
+	if e.Limit == LimitMaxBodySize {
+		return 413
+	}
+	return 422
+}
+
+// actual이 max를 초과하면 에러를 반환한다.
+func checkLimit(limit string, max, actual int64) error {
+	if max > 0 && actual > max {
+		return &ImageLimitError{Limit: limit, Max: max, Actual: actual}
+	}
+	return nil
+}
+
+// 이미지 전체를 디코딩하기 전에 헤더만 읽어 크기와 프레임 수를 확인한다.
+func (l DecodeLimits) Check(data []byte) error {
+	if err := checkLimit(LimitMaxBodySize, l.MaxBodySize, int64(len(data))); err != nil {
+		return err
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		// 해석할 수 없는 이미지는 디코딩 과정에서 에러가 발생한다.
+		return nil
+	}
+	pixels := int64(config.Width) * int64(config.Height)
+	if err := checkLimit(LimitMaxPixels, l.MaxPixels, pixels); err != nil {
+		return err
+	}
+	if format != "gif" {
+		return checkLimit(LimitMaxTotalPixels, l.MaxTotalPixels, pixels)
+	}
+
+	frames, err := gifFrames(data)
+	if err != nil {
+		return nil
+	}
+	totalPixels := int64(0)
+	for _, frame := range frames {
+		framePixels := int64(frame.Dx()) * int64(frame.Dy())
+		if err := checkLimit(LimitMaxPixels, l.MaxPixels, framePixels); err != nil {
+			return err
+		}
+		totalPixels += framePixels
+	}
+	if err := checkLimit(LimitMaxFrames, l.MaxFrames, int64(len(frames))); err != nil {
+		return err
+	}
+	return checkLimit(LimitMaxTotalPixels, l.MaxTotalPixels, totalPixels)
+}
+
+// gif의 프레임들의 영역. LZW로 압축된 이미지 데이터는 해제하지 않고 건너뛴다.
+// https://www.w3.org/Graphics/GIF/spec-gif89a.txt
+func gifFrames(data []byte) ([]image.Rectangle, error) {
+	errInvalid := errors.New("gif 형식이 아닙니다")
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return nil, errInvalid
+	}
+	// header(6), logical screen descriptor(7), global color table
+	offset := 13
+	if data[10]&0x80 != 0 {
+		offset += 3 << (uint(data[10]&0x07) + 1)
+	}
+	frames := make([]image.Rectangle, 0)
+	// sub-block들을 건너뛴다.
+	skipSubBlocks := func() error {
+		for {
+			if offset >= len(data) {
+				return io.ErrUnexpectedEOF
+			}
+			size := int(data[offset])
+			offset += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	for offset < len(data) {
+		switch data[offset] {
+		case 0x21:
+			// extension: introducer(1), label(1), sub-blocks
+			offset += 2
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+		case 0x2c:
+			// image descriptor: separator(1), left(2), top(2), width(2), height(2), flags(1)
+			if offset+10 > len(data) {
+				return frames, io.ErrUnexpectedEOF
+			}
+			left, top := int(data[offset+1])|int(data[offset+2])<<8, int(data[offset+3])|int(data[offset+4])<<8
+			width, height := int(data[offset+5])|int(data[offset+6])<<8, int(data[offset+7])|int(data[offset+8])<<8
+			frames = append(frames, image.Rect(left, top, left+width, top+height))
+			flags := data[offset+9]
+			offset += 10
+			if flags&0x80 != 0 {
+				offset += 3 << (uint(flags&0x07) + 1)
+			}
+			// LZW minimum code size(1), sub-blocks
+			offset++
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+		case 0x3b:
+			return frames, nil
+		default:
+			return frames, errInvalid
+		}
+	}
+	return frames, io.ErrUnexpectedEOF
+}
+
+// 요청 body를 Config.Limits.MaxBodySize까지만 읽도록 제한한다.
+// Content-Length가 제한을 넘으면 body를 읽지 않고 바로 413으로 응답한다.
+func LimitBodySizeMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		max := Config.Limits.MaxBodySize
+		if max <= 0 {
+			return handlerFunc(c)
+		}
+		if err := checkLimit(LimitMaxBodySize, max, c.Request().ContentLength); err != nil {
+			return respondLimitError(c, err.(*ImageLimitError))
+		}
+		body := &limitedBody{ReadCloser: c.Request().Body, max: max}
+		c.Request().Body = body
+		c.Set(limitedBodyContextKey, body)
+		return handlerFunc(c)
+	}
+}
+
+// 요청 body가 제한을 초과했다면 그 에러를 반환한다.
+func bodyLimitError(c echo.Context) *ImageLimitError {
+	body, ok := c.Get(limitedBodyContextKey).(*limitedBody)
+	if !ok || body.read <= body.max {
+		return nil
+	}
+	return &ImageLimitError{Limit: LimitMaxBodySize, Max: body.max, Actual: body.read}
+}
+
+func respondLimitError(c echo.Context, err *ImageLimitError) error {
+	logrus.Warn(err)
+	return c.JSON(err.StatusCode(), BaseResponse{Data: err, Message: err.Unwrap().Error()})
+}
+
+// max를 초과해서 읽으려고 하면 ErrImageTooLarge를 반환하는 reader
+type limitedBody struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.max {
+		return 0, ErrImageTooLarge
+	}
+	// 제한을 초과했는지 알 수 있도록 1byte 더 읽는다.
+	if remaining := b.max - b.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.max {
+		return n, ErrImageTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDecodeLimits_Check(t *testing.T) {
+	bomb := testPNGHeader(50000, 50000)
+	animation := testGIF(t, 3, 20, 10)
+
+	for _, tc := range []struct {
+		name          string
+		limits        DecodeLimits
+		data          []byte
+		expectedLimit string
+	}{
+		{name: "제한_없음", limits: DecodeLimits{}, data: bomb},
+		{name: "body_크기", limits: DecodeLimits{MaxBodySize: 10}, data: bomb, expectedLimit: LimitMaxBodySize},
+		{name: "디코딩_전에_width*height_확인", limits: DecodeLimits{MaxPixels: 100000000}, data: bomb, expectedLimit: LimitMaxPixels},
+		{name: "gif_프레임_수", limits: DecodeLimits{MaxFrames: 2}, data: animation, expectedLimit: LimitMaxFrames},
+		{name: "gif_전체_픽셀_수", limits: DecodeLimits{MaxPixels: 200, MaxTotalPixels: 500}, data: animation, expectedLimit: LimitMaxTotalPixels},
+		{name: "gif_제한_이내", limits: DecodeLimits{MaxPixels: 200, MaxFrames: 3, MaxTotalPixels: 600}, data: animation},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.Check(tc.data)
+			if tc.expectedLimit == "" {
+				assert.NoError(t, err)
+				return
+			}
+			limitErr, ok := err.(*ImageLimitError)
+			if assert.True(t, ok, "err=%v", err) {
+				assert.Equal(t, tc.expectedLimit, limitErr.Limit)
+			}
+		})
+	}
+}
+
+func TestImageLimitError(t *testing.T) {
+	err := error(&ImageLimitError{Limit: LimitMaxBodySize, Max: 10, Actual: 11})
+	assert.ErrorIs(t, err, ErrImageTooLarge)
+	assert.Equal(t, 413, err.(*ImageLimitError).StatusCode())
+
+	err = &ImageLimitError{Limit: LimitMaxPixels, Max: 10, Actual: 11}
+	assert.ErrorIs(t, err, ErrImageLimitExceeded)
+	assert.Equal(t, 422, err.(*ImageLimitError).StatusCode())
+}
+
+func TestGifFrames(t *testing.T) {
+	frames, err := gifFrames(testGIF(t, 3, 20, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, []image.Rectangle{image.Rect(0, 0, 20, 10), image.Rect(0, 0, 20, 10), image.Rect(0, 0, 20, 10)}, frames)
+
+	data, err := ioutil.ReadFile("test/test_gif.gif")
+	assert.NoError(t, err)
+	frames, err = gifFrames(data)
+	assert.NoError(t, err)
+	decoded, err := gif.DecodeAll(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Len(t, frames, len(decoded.Image))
+
+	_, err = gifFrames([]byte("not a gif"))
+	assert.Error(t, err)
+}
+
+func TestDecodeImageFile_Limits(t *testing.T) {
+	originalLimits := Config.Limits
+	defer func() { Config.Limits = originalLimits }()
+	Config.Limits = DecodeLimits{MaxPixels: 100000000}
+
+	_, _, _, _, err := DecodeImageFile(bytes.NewReader(testPNGHeader(50000, 50000)))
+	assert.ErrorIs(t, err, ErrImageLimitExceeded)
+}
+
+// IHDR만 갖는 png. 헤더만 읽으면 크기를 알 수 있지만 디코딩하려고 하면 width * height 만큼의 메모리가 필요하다.
+func testPNGHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	// bit depth 8, color type RGBA
+	ihdr[8], ihdr[9] = 8, 6
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(ihdr)))
+	chunk = append(append(chunk, "IHDR"...), ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(append(data, chunk...), crc...)
+}
+
+func testGIF(t *testing.T, frames, width, height int) []byte {
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+		frame.SetColorIndex(i%width, 0, 1)
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+	body := bytes.NewBuffer([]byte{})
+	assert.NoError(t, gif.EncodeAll(body, animation))
+	return body.Bytes()
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/sirupsen/logrus"
 	"github.com/umi0410/ezconfig"
 	"net/http"
@@ -14,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -24,6 +24,8 @@ var (
 	UploaderWorker Uploader
 	// TransformerWorkers의 작업이 모두 마무리되었는지를 관리하는 WaitGroup
 	transformerWorkersWG = new(sync.WaitGroup)
+	// UploaderWorker의 작업이 모두 마무리되었는지를 관리하는 WaitGroup
+	uploaderWorkersWG = new(sync.WaitGroup)
 )
 
 func init() {
@@ -50,9 +52,31 @@ func init() {
 
 func main() {
 	logrus.Printf("KHUMU_ENVIRONMENT=%s", os.Getenv("KHUMU_ENVIRONMENT"))
+	InitEncoders()
+	if err := Config.Validate(); err != nil {
+		logrus.Fatal(err)
+	}
 	InitTaskChannels()
-	StartTransformerWorkers()
-	StartUploaderWorker()
+	InitAdmission()
+	InitAuthenticators()
+	InitUploadLimits()
+	InitDeadLetters()
+	if err := InitTracing(); err != nil {
+		logrus.Fatal(err)
+	}
+	Jobs.SetRetention(time.Duration(Config.Job.Retention) * time.Minute)
+	var pendingJobs []*PendingJob
+	if Config.Queue.Durable.Enabled {
+		pendingJobs = OpenDurableTaskQueue()
+	}
+	dispatcherCtx, stopDispatchers := context.WithCancel(context.Background())
+	transformerCtx, stopTransformers := context.WithCancel(context.Background())
+	uploaderCtx, stopUploaders := context.WithCancel(context.Background())
+	StartTransformerWorkers(transformerCtx)
+	StartUploaderWorker(uploaderCtx)
+	// 채널의 크기보다 많은 작업이 복구될 수 있으므로 워커들이 시작된 뒤에 다시 처리한다.
+	dispatcherWG.Add(1)
+	go RecoverPendingJobs(dispatcherCtx, pendingJobs)
 	e := NewEcho()
 	// echo 서버 실행
 	go func() {
@@ -68,79 +92,173 @@ func main() {
 
 	// echo의 graceful shutdown 예시
 	// https://echo.labstack.com/cookbook/graceful-shutdown/
-	// os의 SIGINT 신호를 받은 경우 echo를 grafully shutdown한다. (현재 있는 connection은 유지)
-	// echo 서버는 현재 연결되어있는 커넥션까지만 처리하고 종료되지만
-	// 이미지 변환은 쌓인 작업을 모두 처리하고 전체 서비스가 종료된다.
+	// SIGINT 혹은 SIGTERM(e.g. Kubernetes의 pod 종료)을 받으면 echo를 gracefully shutdown한 뒤
+	// 쌓인 변환, 업로드 작업을 모두 처리하고 전체 서비스가 종료된다. (Shutdown 참고)
 	shutDownChan := make(chan os.Signal, 1)
-	signal.Notify(shutDownChan, os.Interrupt)
-	<-shutDownChan
-	if err := e.Shutdown(context.Background()); err != nil {
-		logrus.Error(err)
+	signal.Notify(shutDownChan, os.Interrupt, syscall.SIGTERM)
+	sig := <-shutDownChan
+	logrus.Infof("%v 신호를 받아 서버를 종료합니다.", sig)
+	ok := Shutdown(e, ShutdownHooks{
+		StopDispatchers:  stopDispatchers,
+		StopTransformers: stopTransformers,
+		StopUploaders:    stopUploaders,
+	})
+	CloseResources()
+	if !ok {
+		os.Exit(1)
 	}
+	logrus.Info("모든 워커들이 작업을 종료하여 서버를 안전하게 종료합니다.")
+	os.Exit(0)
+}
 
-	// Transformer들에게 SIGINT가 발생했음을 전파
-	for i := 0; i < len(TransformerWorkers); i++ {
-		go func(transformerIdx int) {
-			logrus.Infof("Transformer %d에게 종료 신호를 보냅니다.", transformerIdx)
-			TransformerWorkers[transformerIdx].Quit <- struct{}{}
-		}(i)
+// Config.Auth에 따라 api 요청을 인증할 수단들을 만든다.
+func InitAuthenticators() {
+	authenticators, err := NewAuthenticators(&Config.Auth)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	Authenticators = authenticators
+	if !Config.Auth.Enabled {
+		logrus.Warn("인증을 사용하지 않습니다. 누구나 이미지를 업로드, 삭제할 수 있습니다.")
 	}
+}
 
-	select {
-	case <-allTransformerWorkersCompleted():
-		logrus.Infof("모든 워커들이 작업을 종료하여 서버를 안전하게 종료합니다. 혹시 모를 미완료된 업로드 작업을 위해 %d초를 대기합니다.", Config.GracefulShutdown.UploaderTimeout)
-		time.Sleep(time.Duration(Config.GracefulShutdown.UploaderTimeout) * time.Second)
-		os.Exit(0)
-	case <-time.After(time.Duration(Config.GracefulShutdown.MaxTimeout) * time.Second):
-		logrus.Errorf("Graceful shutdown의 Max timeout인 %d초가 경과되었음에도 작업을 모두 완료하지 못했습니다. 강제로 종료합니다. (개발 환경에서 편의상 transformer의 loop delay보다 짧게 기다리는 경우 발생할 수도 있음.)", Config.GracefulShutdown.MaxTimeout)
-		os.Exit(1)
+// Config.RateLimit, Config.Quota에 따라 업로드 요청 수와 용량을 제한한다.
+func InitUploadLimits() {
+	if Config.RateLimit.Enabled {
+		UploadRateLimiter = NewRateLimiter(Config.RateLimit.Rate, Config.RateLimit.Burst)
+	}
+	if Config.Quota.Enabled {
+		quotas, err := OpenQuotaStore(Config.Quota.Path, Config.Quota.MaxBytes, time.Duration(Config.Quota.Window)*time.Minute)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		UploadQuotas = quotas
+	}
+}
+
+// Config.DeadLetter에 따라 재시도를 모두 실패한 업로드 작업을 보관할 곳을 연다.
+func InitDeadLetters() {
+	if !Config.DeadLetter.Enabled {
+		logrus.Warn("dead letter를 사용하지 않습니다. 재시도를 모두 실패한 업로드 작업은 버려집니다.")
+		return
+	}
+	store, err := OpenDeadLetterStore(Config.DeadLetter.Path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	DeadLetters = store
+}
+
+// 설정에 따라 추가적인 인코더를 등록한다. preset의 format을 검사하기 전에 호출되어야한다.
+func InitEncoders() {
+	if Config.Encoding.CommandTimeout > 0 {
+		externalEncoderTimeout = time.Duration(Config.Encoding.CommandTimeout) * time.Second
+	}
+	if Config.Encoding.Avif.Command != "" {
+		if err := RegisterAvifEncoder(Config.Encoding.Avif.Command); err != nil {
+			logrus.Warnf("avif 인코더를 사용할 수 없습니다. err=%v", err)
+		}
+	}
+	if Config.Encoding.Jpeg.Command != "" {
+		if err := EnableProgressiveJPEG(Config.Encoding.Jpeg.Command); err != nil {
+			logrus.Warnf("progressive jpeg를 사용할 수 없습니다. err=%v", err)
+		}
 	}
 }
 
-func StartTransformerWorkers() {
+// ctx가 끝나면 Transformer들은 남은 작업을 처리한 뒤 종료하고 transformerWorkersWG에 보고한다.
+func StartTransformerWorkers(ctx context.Context) {
 	num := Config.NumOfTransformerWorkers
 	TransformerWorkers = make([]*Transformer, num)
 	for i := 0; i < num; i++ {
-		TransformerWorkers[i] = NewTransformer(ResizeTaskChan, ThumbnailTaskChan, UploadTaskChan, make(chan interface{}), transformerWorkersWG)
-		go TransformerWorkers[i].Start()
+		TransformerWorkers[i] = NewTransformer(ResizeTaskChan, ThumbnailTaskChan, UploadTaskChan, transformerWorkersWG)
+		transformerWorkersWG.Add(1)
+		go TransformerWorkers[i].Start(ctx)
 		logrus.Info("Started TransformerWorker", i)
 	}
+	workers.WithLabelValues(WorkerTransformer).Set(float64(num))
 }
 
-func StartUploaderWorker() {
+// ctx가 끝나면 Uploader는 남은 작업을 처리한 뒤 종료하고 uploaderWorkersWG에 보고한다.
+func StartUploaderWorker(ctx context.Context) {
 	if Config.Storage.Disk.Enabled {
-		UploaderWorker = &DiskUploader{
-			UploadTaskChan: UploadTaskChan,
-			Quit:           make(chan interface{}),
-		}
+		ImageStorage = NewMetricsStorage(NewDiskStorage(Config.Storage.Disk.RootPath, Config.Storage.Disk.ShardDepth), "disk")
 	} else if Config.Storage.Aws.Enabled {
-		sess, err := session.NewSessionWithOptions(session.Options{
-			Config: aws.Config{
-				Region: aws.String("ap-northeast-2"),
-			},
-		})
+		sess, err := NewAwsSession(&Config.Storage.Aws)
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		UploaderWorker = NewS3Uploader(UploadTaskChan, make(chan interface{}), sess)
+		ImageStorage = NewMetricsStorage(NewS3Storage(sess, Config.Storage.Aws.BucketName), "s3")
 	} else {
 		logrus.Fatal("Unsupported storage kind.")
 	}
-	go UploaderWorker.Start()
+	UploaderWorker = NewStorageUploader(UploadTaskChan, ImageStorage, uploaderWorkersWG)
+	uploaderWorkersWG.Add(1)
+	workers.WithLabelValues(WorkerUploader).Set(1)
+	go UploaderWorker.Start(ctx)
 	logrus.Info("Started UploaderWorker. ", UploaderWorker)
 
 }
 
-// 모든 Transformer가 작업을 종료하면 channel에 값을 전달합니다.
-// channel을 return하기 때문에 select문을 통해 timeout이나 default를 이용하기 편라합니다.
-func allTransformerWorkersCompleted() <-chan struct{} {
-	logrus.Info("모든 워커들이 작업을 종료했는지 확인합니다.")
-	isAllCompleted := make(chan struct{})
-	go func() {
+// durable queue를 열고, 이전에 완료되지 않은 작업들을 반환한다.
+// Transformer들이 작업을 가져가기 전에 호출되어야한다.
+func OpenDurableTaskQueue() []*PendingJob {
+	queue, pendingJobs, err := OpenDurableQueue(Config.Queue.Durable.Path)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	DurableTaskQueue = queue
+	Jobs.OnVariantFinished(func(hashedFileName, variant string, state VariantState) {
+		if err := DurableTaskQueue.Finish(hashedFileName, variant); err != nil {
+			logrus.Error(err)
+		}
+	})
+	return pendingJobs
+}
 
-		transformerWorkersWG.Wait()
-		logrus.Info("모든 워커들이 작업을 종료했습니다.")
-		isAllCompleted <- struct{}{}
-	}()
-	return isAllCompleted
+// 이전에 완료되지 않은 작업들을 다시 처리하도록 전달한다.
+// 디코딩된 이미지가 한꺼번에 메모리에 올라가지 않도록 TaskAdmission이 수락할 때까지 기다리며 하나씩 전달한다.
+// ctx가 끝나면 멈추고, 전달하지 못한 작업들은 durable queue에 남아 다음 실행 시 다시 처리된다.
+func RecoverPendingJobs(ctx context.Context, pendingJobs []*PendingJob) {
+	defer dispatcherWG.Done()
+	for _, job := range pendingJobs {
+		if ctx.Err() != nil {
+			logrus.Info("종료 중이므로 남은 작업들은 다음 실행 시 복구합니다.")
+			return
+		}
+		imageData, orientation, gifImageData, ext, err := DecodeImageFile(bytes.NewReader(job.Data))
+		if err != nil {
+			logrus.Errorf("복구한 작업의 원본을 해석할 수 없습니다. name=%s, err=%v", job.HashedFileName, err)
+			for _, variant := range job.Variants {
+				if err := DurableTaskQueue.Finish(job.HashedFileName, variant); err != nil {
+					logrus.Error(err)
+				}
+			}
+			continue
+		}
+		if orientation != 0 {
+			imageData = RotateImage(imageData, orientation)
+		}
+		logrus.Infof("완료되지 않은 작업을 다시 처리합니다. name=%s, variants=%v", job.HashedFileName, job.Variants)
+		metadata, originalData := Config.Metadata.Apply(job.Data, ext)
+		imageData, metadata = Config.ColorProfile.Apply(imageData, metadata, job.Data, ext)
+		task := &BaseImageTask{
+			ImageData:        imageData,
+			GIFImageData:     gifImageData,
+			OriginalFileName: job.OriginalFileName,
+			HashedFileName:   job.HashedFileName,
+			Extension:        ext,
+			Metadata:         metadata,
+			OriginalData:     originalData,
+			Principal:        job.Principal,
+		}
+		id, err := TaskAdmission.Acquire(ctx, pixelsOf(task), len(job.Variants))
+		if err != nil {
+			logrus.Info("종료 중이므로 남은 작업들은 다음 실행 시 복구합니다.")
+			return
+		}
+		task.AdmissionID = id
+		DispatchVariants(task, job.Variants)
+	}
 }
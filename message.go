@@ -6,8 +6,10 @@ package main
 import (
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/trace"
 	"image"
 	"image/gif"
+	"path"
 )
 
 var (
@@ -29,11 +31,25 @@ type BaseImageTask struct {
 	GIFImageData *gif.GIF
 	// 이미지 파일 확장자명 (e.g. jpeg, png)
 	Extension string
+	// 변환된 이미지에 기록할 메타데이터. nil이면 메타데이터를 기록하지 않는다.
+	Metadata *ImageMetadata
+	// 메타데이터 정책이 preserve인 경우 다시 인코딩하지 않고 그대로 저장할 원본 파일
+	OriginalData []byte
+	// 업로드를 요청한 주체. 인증을 사용하지 않으면 nil
+	Principal *Principal
+	// TaskAdmission이 이 작업을 수락하며 발급한 ID. 0이면 자원을 확보하지 않은 작업이다. (e.g. dead letter)
+	AdmissionID uint64
+	// 이 작업을 만든 단계의 span. 작업을 처리하는 span은 이 span의 자식이 된다.
+	// durable queue에서 복구된 작업처럼 비어있으면 새 trace를 시작한다.
+	SpanContext trace.SpanContext
 }
 
 type ImageResizeTask struct {
 	*BaseImageTask
-	ResizingWidth int
+	// 만들어낼 variant에 대한 설정
+	Preset *VariantPreset
+	// 만들어낼 출력들. 비어있으면 preset의 모든 출력을 만든다.
+	Outputs []VariantOutput
 	//MaxHeight        int // Height는 Width에 따라 정함.
 	ResizedImageData    image.Image
 	ResizedGIFImageData *gif.GIF
@@ -41,6 +57,10 @@ type ImageResizeTask struct {
 
 type ImageGenerateThumbnailTask struct {
 	*BaseImageTask
+	// 만들어낼 variant에 대한 설정
+	Preset *VariantPreset
+	// 만들어낼 출력들. 비어있으면 preset의 모든 출력을 만든다.
+	Outputs               []VariantOutput
 	ThumbnailImageData    image.Image
 	ThumbnailGIFImageData *gif.GIF
 }
@@ -48,12 +68,35 @@ type ImageGenerateThumbnailTask struct {
 type ImageUploadTask struct {
 	*BaseImageTask
 	UploadPath string
+	// 작업 상태 조회 시의 variant 이름 (e.g. original, thumbnail, thumbnail.webp)
+	Variant string
+	// 포맷별 인코딩 설정
+	Encoding EncoderOptions
+	// 인코딩하지 않고 그대로 업로드할 파일. 비어있으면 이미지를 인코딩해서 업로드한다.
+	RawData []byte
+	// 저장소 업로드에 실패했을 때의 재시도 정책
+	Retry RetryPolicy
+	// 지금까지 업로드에 실패한 기록
+	Failures []UploadFailure
 }
 
+// 동시에 처리할 수 있는 업로드 작업 수(Config.Queue.Size)만큼의 작업이 모두 들어갈 수 있는 크기로 채널들을 만든다.
+// TaskAdmission이 처리 중인 작업 수를 제한하므로 작업을 보낼 때 채널에서 막히지 않는다.
 func InitTaskChannels() {
-	ResizeTaskChan = make(chan *ImageResizeTask)
-	ThumbnailTaskChan = make(chan *ImageGenerateThumbnailTask)
-	UploadTaskChan = make(chan *ImageUploadTask)
+	numOfThumbnails, numOfResizes, numOfUploads := 0, 0, 1
+	for _, preset := range Config.Variants {
+		switch preset.Kind {
+		case VariantKindThumbnail:
+			numOfThumbnails++
+		case VariantKindResize:
+			numOfResizes++
+		}
+		numOfUploads += len(preset.Outputs())
+	}
+	size := queueSize()
+	ResizeTaskChan = make(chan *ImageResizeTask, size*numOfResizes)
+	ThumbnailTaskChan = make(chan *ImageGenerateThumbnailTask, size*numOfThumbnails)
+	UploadTaskChan = make(chan *ImageUploadTask, size*numOfUploads)
 }
 
 func (t *BaseImageTask) String() string {
@@ -64,6 +107,25 @@ func (t *ImageUploadTask) String() string {
 	return fmt.Sprintf("ImageUploadTask(UploadPath: %s, OriginalFileName: %s, HashedFileName: %s)", t.UploadPath, t.OriginalFileName, t.HashedFileName)
 }
 
+// 저장소에 저장될 경로 (e.g. thumbnail/abcd1234.png)
+func (t *ImageUploadTask) Key() string {
+	return path.Join(t.UploadPath, t.HashedFileName+"."+t.Extension)
+}
+
+func (t *ImageResizeTask) outputs() []VariantOutput {
+	if len(t.Outputs) == 0 {
+		return t.Preset.Outputs()
+	}
+	return t.Outputs
+}
+
+func (t *ImageGenerateThumbnailTask) outputs() []VariantOutput {
+	if len(t.Outputs) == 0 {
+		return t.Preset.Outputs()
+	}
+	return t.Outputs
+}
+
 func (t *BaseImageTask) Validate() error {
 	if t.ImageData == nil && t.GIFImageData == nil {
 		return ErrNoImageErr
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	exif "github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	jpgis "github.com/dsoprea/go-jpeg-image-structure/v2"
+	pngis "github.com/dsoprea/go-png-image-structure/v2"
+	"github.com/sirupsen/logrus"
+	"image"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// 업로드된 이미지의 메타데이터를 어떻게 다룰지
+const (
+	// 모든 메타데이터를 지운다.
+	MetadataPolicyStrip = "strip"
+	// Allowlist에 있는 항목만 남긴다.
+	MetadataPolicyAllowlist = "allowlist"
+	// 원본은 받은 그대로 저장하고, 변환된 이미지에는 Allowlist에 있는 항목만 남긴다.
+	// 단, GPS 정보는 원본에서도 지운다.
+	MetadataPolicyPreserve = "preserve"
+)
+
+// Allowlist에 사용할 수 있는 항목
+const (
+	// exif의 Copyright
+	MetadataFieldCopyright = "copyright"
+	// ICC profile
+	MetadataFieldICCProfile = "iccProfile"
+	// exif의 DateTimeOriginal, OffsetTimeOriginal
+	MetadataFieldCaptureDate = "captureDate"
+)
+
+var (
+	ErrInvalidMetadataPolicy = errors.New("잘못된 metadata 설정입니다.")
+	ErrUnableToRemoveGPS     = errors.New("원본 파일에서 GPS 정보를 지울 수 없습니다.")
+
+	metadataFields = map[string]bool{
+		MetadataFieldCopyright:   true,
+		MetadataFieldICCProfile:  true,
+		MetadataFieldCaptureDate: true,
+	}
+
+	// xmp 등 텍스트로 저장된 메타데이터에서 GPS 정보를 나타내는 이름들
+	gpsMarkers = [][]byte{[]byte("GPSLatitude"), []byte("GPSLongitude"), []byte("GPSCoordinates")}
+
+	// jpeg APP2 세그먼트에 ICC profile을 저장할 때의 식별자
+	iccProfileIdentifier = []byte("ICC_PROFILE\x00")
+)
+
+const (
+	jpegMarkerAPP2 = 0xe2
+	// APP2 세그먼트 하나에 담을 수 있는 ICC profile의 크기. 세그먼트 크기(2), 식별자(12), 순서(2)를 제외한 크기
+	jpegMaxICCChunkSize = 65535 - 2 - 12 - 2
+)
+
+type MetadataPolicy struct {
+	// strip, allowlist, preserve. 비어있으면 strip
+	Policy string
+	// allowlist, preserve 정책에서 변환된 이미지에 남길 항목들 (copyright, iccProfile, captureDate)
+	Allowlist []string
+}
+
+// 원본 이미지에서 읽어낸 메타데이터 중 변환된 이미지에 다시 기록할 수 있는 항목들
+// GPS 정보는 기록할 수 있는 항목이 아니다.
+type ImageMetadata struct {
+	Copyright string
+	// exif의 DateTimeOriginal (e.g. 2021:05:01 13:00:00)
+	CaptureDate string
+	// exif의 OffsetTimeOriginal (e.g. +09:00)
+	CaptureOffset string
+	ICCProfile    []byte
+	// GPS 정보를 갖고 있는지. 해석할 수 없는 메타데이터가 있는 경우에도 true이다.
+	HasGPS bool
+}
+
+func (p MetadataPolicy) Validate() error {
+	switch p.Policy {
+	case "", MetadataPolicyStrip, MetadataPolicyAllowlist, MetadataPolicyPreserve:
+	default:
+		return fmt.Errorf("%w 지원하지 않는 policy입니다. policy=%s", ErrInvalidMetadataPolicy, p.Policy)
+	}
+	for _, field := range p.Allowlist {
+		if !metadataFields[field] {
+			return fmt.Errorf("%w 지원하지 않는 allowlist 항목입니다. field=%s", ErrInvalidMetadataPolicy, field)
+		}
+	}
+	return nil
+}
+
+func (p MetadataPolicy) allows(field string) bool {
+	if p.Policy != MetadataPolicyAllowlist && p.Policy != MetadataPolicyPreserve {
+		return false
+	}
+	for _, allowed := range p.Allowlist {
+		if allowed == field {
+			return true
+		}
+	}
+	return false
+}
+
+// 업로드된 원본 파일에 정책을 적용한다.
+// 변환된 이미지에 기록할 메타데이터(없으면 nil)와, 다시 인코딩하지 않고 그대로 저장할 원본 파일(없으면 nil)을 반환한다.
+func (p MetadataPolicy) Apply(data []byte, extension string) (*ImageMetadata, []byte) {
+	if p.Policy == "" || p.Policy == MetadataPolicyStrip {
+		return nil, nil
+	}
+
+	read := ReadMetadata(data, extension)
+	metadata := &ImageMetadata{}
+	if p.allows(MetadataFieldCopyright) {
+		metadata.Copyright = read.Copyright
+	}
+	if p.allows(MetadataFieldCaptureDate) {
+		metadata.CaptureDate, metadata.CaptureOffset = read.CaptureDate, read.CaptureOffset
+	}
+	if p.allows(MetadataFieldICCProfile) {
+		metadata.ICCProfile = read.ICCProfile
+	}
+	if metadata.isEmpty() {
+		metadata = nil
+	}
+	if p.Policy != MetadataPolicyPreserve {
+		return metadata, nil
+	}
+
+	if !read.HasGPS {
+		return metadata, data
+	}
+	sanitized, err := removeGPS(data, extension)
+	if err == nil && !ReadMetadata(sanitized, extension).HasGPS {
+		return metadata, sanitized
+	}
+	// GPS 정보를 확실히 지울 수 없으면 원본도 다시 인코딩한다.
+	logrus.Warnf("원본에서 GPS 정보를 지울 수 없어 원본도 다시 인코딩합니다. err=%v", err)
+	return metadata, nil
+}
+
+func (m *ImageMetadata) isEmpty() bool {
+	return m == nil || (m.Copyright == "" && m.CaptureDate == "" && m.CaptureOffset == "" && len(m.ICCProfile) == 0)
+}
+
+// 원본 파일의 exif, ICC profile 등을 읽는다.
+func ReadMetadata(data []byte, extension string) *ImageMetadata {
+	m := &ImageMetadata{}
+	for _, tiff := range readExif(data, extension) {
+		tags, _, err := exif.GetFlatExifData(tiff, nil)
+		if err != nil {
+			// 해석할 수 없는 exif에는 GPS 정보가 들어있을 수도 있다.
+			logrus.Warnf("exif를 해석할 수 없습니다. err=%v", err)
+			m.HasGPS = true
+			continue
+		}
+		for _, tag := range tags {
+			switch {
+			case strings.HasPrefix(tag.IfdPath, "IFD/GPSInfo") || tag.TagId == exifcommon.IfdGpsInfoStandardIfdIdentity.TagId():
+				m.HasGPS = true
+			case tag.IfdPath == "IFD" && tag.TagName == "Copyright":
+				m.Copyright = exifString(tag.Value)
+			case tag.IfdPath == "IFD/Exif" && tag.TagName == "DateTimeOriginal":
+				m.CaptureDate = exifString(tag.Value)
+			case tag.IfdPath == "IFD/Exif" && tag.TagName == "OffsetTimeOriginal":
+				m.CaptureOffset = exifString(tag.Value)
+			}
+		}
+	}
+	if containsGPSMarker(data) || (extension == "png" && pngTextContainsGPS(data)) {
+		m.HasGPS = true
+	}
+	m.ICCProfile = readICCProfile(data, extension)
+	return m
+}
+
+func exifString(value interface{}) string {
+	s, _ := value.(string)
+	return strings.TrimRight(s, "\x00 ")
+}
+
+func containsGPSMarker(data []byte) bool {
+	for _, marker := range gpsMarkers {
+		if bytes.Contains(data, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// png의 압축된 텍스트 chunk(zTXt, iTXt)에 저장된 xmp에 GPS 정보가 있는지
+func pngTextContainsGPS(data []byte) bool {
+	mc, err := pngis.NewPngMediaParser().ParseBytes(data)
+	cs, ok := mc.(*pngis.ChunkSlice)
+	if err != nil || !ok {
+		return false
+	}
+	for _, chunk := range cs.Chunks() {
+		if text, ok := pngText(chunk); ok && containsGPSMarker(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// 압축된 텍스트 chunk의 내용. 압축을 풀 수 없으면 내용을 알 수 없으므로 GPS가 있는 것으로 취급하도록 marker를 반환한다.
+func pngText(chunk *pngis.Chunk) ([]byte, bool) {
+	var compressed []byte
+	switch chunk.Type {
+	case "zTXt":
+		// keyword\0 compression method(1) compressed text
+		keywordEnd := bytes.IndexByte(chunk.Data, 0)
+		if keywordEnd < 0 || keywordEnd+2 > len(chunk.Data) {
+			return nil, false
+		}
+		compressed = chunk.Data[keywordEnd+2:]
+	case "iTXt":
+		// keyword\0 compression flag(1) compression method(1) language\0 translated keyword\0 text
+		keywordEnd := bytes.IndexByte(chunk.Data, 0)
+		if keywordEnd < 0 || keywordEnd+3 > len(chunk.Data) || chunk.Data[keywordEnd+1] == 0 {
+			return nil, false
+		}
+		rest := chunk.Data[keywordEnd+3:]
+		for i := 0; i < 2; i++ {
+			end := bytes.IndexByte(rest, 0)
+			if end < 0 {
+				return nil, false
+			}
+			rest = rest[end+1:]
+		}
+		compressed = rest
+	default:
+		return nil, false
+	}
+	text, err := inflate(compressed)
+	if err != nil {
+		return gpsMarkers[0], true
+	}
+	return text, true
+}
+
+func inflate(compressed []byte) ([]byte, error) {
+	reader, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// 원본 파일의 ICC profile. jpeg는 APP2 세그먼트, png는 iCCP chunk, webp는 ICCP chunk에 저장된다.
+func readICCProfile(data []byte, extension string) []byte {
+	switch {
+	case extension == "jpeg":
+		mc, err := jpgis.NewJpegMediaParser().ParseBytes(data)
+		sl, ok := mc.(*jpgis.SegmentList)
+		if err != nil || !ok {
+			return nil
+		}
+		// 식별자(12) 뒤에 순서(1부터 시작), 전체 개수가 붙고 ICC profile의 일부가 들어있다.
+		chunks := make(map[int][]byte)
+		for _, segment := range sl.Segments() {
+			if segment.MarkerId == jpegMarkerAPP2 && bytes.HasPrefix(segment.Data, iccProfileIdentifier) && len(segment.Data) > len(iccProfileIdentifier)+2 {
+				chunks[int(segment.Data[len(iccProfileIdentifier)])] = segment.Data[len(iccProfileIdentifier)+2:]
+			}
+		}
+		sequences := make([]int, 0, len(chunks))
+		for sequence := range chunks {
+			sequences = append(sequences, sequence)
+		}
+		sort.Ints(sequences)
+		var profile []byte
+		for _, sequence := range sequences {
+			profile = append(profile, chunks[sequence]...)
+		}
+		return profile
+	case extension == "png":
+		mc, err := pngis.NewPngMediaParser().ParseBytes(data)
+		cs, ok := mc.(*pngis.ChunkSlice)
+		if err != nil || !ok {
+			return nil
+		}
+		for _, chunk := range cs.Chunks() {
+			if chunk.Type != "iCCP" {
+				continue
+			}
+			// profile name\0 compression method(1) compressed profile
+			nameEnd := bytes.IndexByte(chunk.Data, 0)
+			if nameEnd < 0 || nameEnd+2 > len(chunk.Data) {
+				return nil
+			}
+			profile, err := inflate(chunk.Data[nameEnd+2:])
+			if err != nil {
+				logrus.Warnf("ICC profile을 읽을 수 없습니다. err=%v", err)
+				return nil
+			}
+			return profile
+		}
+	case isWebP(data):
+		for _, chunk := range parseWebPChunks(data) {
+			if chunk.fourCC == "ICCP" {
+				return chunk.payload
+			}
+		}
+	}
+	return nil
+}
+
+// 원본 파일의 다른 부분은 그대로 둔 채 exif의 GPS IFD와 GPS 정보가 들어있는 xmp를 지운다.
+// jpeg, png만 지원한다.
+func removeGPS(data []byte, extension string) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	switch extension {
+	case "jpeg":
+		mc, err := jpgis.NewJpegMediaParser().ParseBytes(data)
+		sl, ok := mc.(*jpgis.SegmentList)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+		}
+		segments := make([]*jpgis.Segment, 0, len(sl.Segments()))
+		for _, segment := range sl.Segments() {
+			if segment.IsXmp() && containsGPSMarker(segment.Data) {
+				continue
+			}
+			if segment.IsExif() {
+				rootIfd, _, err := segment.Exif()
+				if err != nil {
+					return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+				}
+				rootIb := exif.NewIfdBuilderFromExistingChain(rootIfd)
+				deleteGPSIfd(rootIb)
+				if err := segment.SetExif(rootIb); err != nil {
+					return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+				}
+			}
+			segments = append(segments, segment)
+		}
+		if err := jpgis.NewSegmentList(segments).Write(buf); err != nil {
+			return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+		}
+	case "png":
+		mc, err := pngis.NewPngMediaParser().ParseBytes(data)
+		cs, ok := mc.(*pngis.ChunkSlice)
+		if err != nil || !ok {
+			return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+		}
+		chunks := make([]*pngis.Chunk, 0, len(cs.Chunks()))
+		for _, chunk := range cs.Chunks() {
+			if text, ok := pngText(chunk); (ok && containsGPSMarker(text)) || (chunk.Type == "tEXt" || chunk.Type == "iTXt") && containsGPSMarker(chunk.Data) {
+				continue
+			}
+			chunks = append(chunks, chunk)
+		}
+		cs = pngis.NewChunkSlice(chunks)
+		if _, err := cs.FindExif(); err == nil {
+			rootIb, err := cs.ConstructExifBuilder()
+			if err != nil {
+				return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+			}
+			deleteGPSIfd(rootIb)
+			if err := cs.SetExif(rootIb); err != nil {
+				return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+			}
+		}
+		if err := cs.WriteTo(buf); err != nil {
+			return nil, fmt.Errorf("%w err=%v", ErrUnableToRemoveGPS, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w format=%s", ErrUnableToRemoveGPS, extension)
+	}
+	return buf.Bytes(), nil
+}
+
+func deleteGPSIfd(rootIb *exif.IfdBuilder) {
+	// GPS IFD가 없으면 에러가 반환되지만 지울 것이 없는 것이므로 무시한다.
+	_, _ = rootIb.DeleteAll(exifcommon.IfdGpsInfoStandardIfdIdentity.TagId())
+}
+
+// 메타데이터를 exif로 만든다. exif에 기록할 항목이 없으면 nil을 반환한다.
+func buildExif(m *ImageMetadata) (*exif.IfdBuilder, error) {
+	if m.Copyright == "" && m.CaptureDate == "" && m.CaptureOffset == "" {
+		return nil, nil
+	}
+	im, err := exifcommon.NewIfdMappingWithStandard()
+	if err != nil {
+		return nil, err
+	}
+	rootIb := exif.NewIfdBuilder(im, exif.NewTagIndex(), exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
+	if m.Copyright != "" {
+		if err := rootIb.SetStandardWithName("Copyright", m.Copyright); err != nil {
+			return nil, err
+		}
+	}
+	if m.CaptureDate != "" || m.CaptureOffset != "" {
+		exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+		if err != nil {
+			return nil, err
+		}
+		if m.CaptureDate != "" {
+			if err := exifIb.SetStandardWithName("DateTimeOriginal", m.CaptureDate); err != nil {
+				return nil, err
+			}
+		}
+		if m.CaptureOffset != "" {
+			if err := exifIb.SetStandardWithName("OffsetTimeOriginal", m.CaptureOffset); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rootIb, nil
+}
+
+// 인코딩된 이미지에 메타데이터를 기록한다.
+type metadataEmbedder func(encoded []byte, m *ImageMetadata, bounds image.Rectangle) ([]byte, error)
+
+var metadataEmbedders = map[string]metadataEmbedder{
+	"jpeg": embedJPEGMetadata,
+	"png":  embedPNGMetadata,
+	"webp": embedWebPMetadata,
+}
+
+func embedJPEGMetadata(encoded []byte, m *ImageMetadata, _ image.Rectangle) ([]byte, error) {
+	mc, err := jpgis.NewJpegMediaParser().ParseBytes(encoded)
+	if err != nil {
+		return nil, err
+	}
+	sl := mc.(*jpgis.SegmentList)
+	ib, err := buildExif(m)
+	if err != nil {
+		return nil, err
+	}
+	if ib != nil {
+		// SOI 바로 뒤에 exif 세그먼트가 추가된다.
+		if err := sl.SetExif(ib); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.ICCProfile) > 0 {
+		segments := sl.Segments()
+		// SOI와 exif 세그먼트 뒤에 넣는다.
+		at := 1
+		if ib != nil {
+			at = 2
+		}
+		withICC := append(append(append([]*jpgis.Segment{}, segments[:at]...), jpegICCSegments(m.ICCProfile)...), segments[at:]...)
+		sl = jpgis.NewSegmentList(withICC)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := sl.Write(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func jpegICCSegments(profile []byte) []*jpgis.Segment {
+	count := (len(profile) + jpegMaxICCChunkSize - 1) / jpegMaxICCChunkSize
+	segments := make([]*jpgis.Segment, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * jpegMaxICCChunkSize
+		if end > len(profile) {
+			end = len(profile)
+		}
+		data := append(append([]byte{}, iccProfileIdentifier...), byte(i+1), byte(count))
+		segments = append(segments, &jpgis.Segment{
+			MarkerId:   jpegMarkerAPP2,
+			MarkerName: "APP2",
+			Data:       append(data, profile[i*jpegMaxICCChunkSize:end]...),
+		})
+	}
+	return segments
+}
+
+func embedPNGMetadata(encoded []byte, m *ImageMetadata, _ image.Rectangle) ([]byte, error) {
+	mc, err := pngis.NewPngMediaParser().ParseBytes(encoded)
+	if err != nil {
+		return nil, err
+	}
+	cs := mc.(*pngis.ChunkSlice)
+	if len(m.ICCProfile) > 0 {
+		compressed := bytes.NewBuffer([]byte{})
+		writer := zlib.NewWriter(compressed)
+		if _, err := writer.Write(m.ICCProfile); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		// profile name\0 compression method(0) compressed profile
+		iccp := &pngis.Chunk{Type: "iCCP", Data: append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...)}
+		iccp.Length = uint32(len(iccp.Data))
+		iccp.UpdateCrc32()
+		// PLTE, IDAT보다 앞에 있어야하므로 IHDR 바로 뒤에 넣는다.
+		chunks := cs.Chunks()
+		cs = pngis.NewChunkSlice(append([]*pngis.Chunk{chunks[0], iccp}, chunks[1:]...))
+	}
+	ib, err := buildExif(m)
+	if err != nil {
+		return nil, err
+	}
+	if ib != nil {
+		if err := cs.SetExif(ib); err != nil {
+			return nil, err
+		}
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := cs.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 메타데이터를 기록하려면 VP8X chunk를 사용하는 확장 형식이어야한다.
+// https://developers.google.com/speed/webp/docs/riff_container#extended_file_format
+func embedWebPMetadata(encoded []byte, m *ImageMetadata, bounds image.Rectangle) ([]byte, error) {
+	const (
+		flagICC   = 0x20
+		flagAlpha = 0x10
+		flagExif  = 0x08
+	)
+	chunks := parseWebPChunks(encoded)
+	if len(chunks) == 0 {
+		return nil, errors.New("webp를 해석할 수 없습니다.")
+	}
+
+	var vp8x []byte
+	// 이미지 데이터를 담은 chunk들 (VP8, VP8L, ALPH, ANIM, ANMF 등)
+	images := make([]webpChunk, 0)
+	for _, chunk := range chunks {
+		switch chunk.fourCC {
+		case "VP8X":
+			vp8x = append([]byte{}, chunk.payload...)
+		case "ICCP", "EXIF":
+		default:
+			images = append(images, chunk)
+		}
+	}
+	if len(images) == 0 {
+		return nil, errors.New("webp에 이미지 데이터가 없습니다.")
+	}
+	if vp8x == nil {
+		vp8x = make([]byte, 10)
+		// 캔버스 크기 - 1 (24bit little endian)
+		width, height := bounds.Dx()-1, bounds.Dy()-1
+		vp8x[4], vp8x[5], vp8x[6] = byte(width), byte(width>>8), byte(width>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(height), byte(height>>8), byte(height>>16)
+		// 무손실(VP8L)인 경우 header에 alpha 사용 여부가 들어있다.
+		if first := images[0]; first.fourCC == "VP8L" && len(first.payload) >= 5 && first.payload[4]&0x10 != 0 {
+			vp8x[0] |= flagAlpha
+		}
+	}
+
+	result := []webpChunk{{fourCC: "VP8X", payload: vp8x}}
+	if len(m.ICCProfile) > 0 {
+		vp8x[0] |= flagICC
+		result = append(result, webpChunk{fourCC: "ICCP", payload: m.ICCProfile})
+	}
+	result = append(result, images...)
+	ib, err := buildExif(m)
+	if err != nil {
+		return nil, err
+	}
+	if ib != nil {
+		tiff, err := exif.NewIfdByteEncoder().EncodeToExif(ib)
+		if err != nil {
+			return nil, err
+		}
+		vp8x[0] |= flagExif
+		result = append(result, webpChunk{fourCC: "EXIF", payload: tiff})
+	}
+	return writeWebPChunks(result), nil
+}
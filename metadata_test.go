@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	exif "github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	jpgis "github.com/dsoprea/go-jpeg-image-structure/v2"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+var testICCProfile = []byte("test icc profile")
+
+func TestMetadataPolicy_Validate(t *testing.T) {
+	assert.NoError(t, MetadataPolicy{}.Validate())
+	assert.NoError(t, MetadataPolicy{Policy: MetadataPolicyAllowlist, Allowlist: []string{MetadataFieldCopyright, MetadataFieldICCProfile}}.Validate())
+	assert.ErrorIs(t, MetadataPolicy{Policy: "keep"}.Validate(), ErrInvalidMetadataPolicy)
+	assert.ErrorIs(t, MetadataPolicy{Policy: MetadataPolicyAllowlist, Allowlist: []string{"gps"}}.Validate(), ErrInvalidMetadataPolicy)
+}
+
+func TestReadMetadata(t *testing.T) {
+	m := ReadMetadata(testJPEGWithMetadata(t, true, false), "jpeg")
+	assert.True(t, m.HasGPS)
+	assert.Equal(t, "khumu", m.Copyright)
+	assert.Equal(t, "2021:05:01 13:00:00", m.CaptureDate)
+	assert.Equal(t, testICCProfile, m.ICCProfile)
+
+	m = ReadMetadata(testJPEGWithMetadata(t, false, false), "jpeg")
+	assert.False(t, m.HasGPS)
+
+	// exif에 GPS가 없더라도 xmp에 GPS 정보가 있을 수 있다.
+	m = ReadMetadata(testJPEGWithMetadata(t, false, true), "jpeg")
+	assert.True(t, m.HasGPS)
+}
+
+func TestMetadataPolicy_Apply(t *testing.T) {
+	allowlist := []string{MetadataFieldCopyright, MetadataFieldICCProfile, MetadataFieldCaptureDate}
+
+	t.Run("strip", func(t *testing.T) {
+		metadata, original := MetadataPolicy{Policy: MetadataPolicyStrip, Allowlist: allowlist}.Apply(testJPEGWithMetadata(t, true, true), "jpeg")
+		assert.Nil(t, metadata)
+		assert.Nil(t, original)
+	})
+
+	t.Run("allowlist", func(t *testing.T) {
+		policy := MetadataPolicy{Policy: MetadataPolicyAllowlist, Allowlist: []string{MetadataFieldCopyright}}
+		metadata, original := policy.Apply(testJPEGWithMetadata(t, true, true), "jpeg")
+		assert.Nil(t, original)
+		assert.Equal(t, &ImageMetadata{Copyright: "khumu"}, metadata)
+	})
+
+	t.Run("preserve_GPS가_없으면_원본_그대로", func(t *testing.T) {
+		data := testJPEGWithMetadata(t, false, false)
+		_, original := MetadataPolicy{Policy: MetadataPolicyPreserve}.Apply(data, "jpeg")
+		assert.Equal(t, data, original)
+	})
+
+	t.Run("preserve_GPS만_지움", func(t *testing.T) {
+		data := testJPEGWithMetadata(t, true, true)
+		metadata, original := MetadataPolicy{Policy: MetadataPolicyPreserve, Allowlist: allowlist}.Apply(data, "jpeg")
+		assert.NotNil(t, metadata)
+		if assert.NotNil(t, original) {
+			m := ReadMetadata(original, "jpeg")
+			assert.False(t, m.HasGPS)
+			assert.Equal(t, "khumu", m.Copyright)
+			assert.Equal(t, testICCProfile, m.ICCProfile)
+			_, err := jpeg.Decode(bytes.NewReader(original))
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("preserve_GPS를_지울_수_없으면_다시_인코딩", func(t *testing.T) {
+		data := append([]byte("GIF89a"), []byte("<exif:GPSLatitude>37,30.0N</exif:GPSLatitude>")...)
+		_, original := MetadataPolicy{Policy: MetadataPolicyPreserve}.Apply(data, "gif")
+		assert.Nil(t, original)
+	})
+}
+
+// 어떤 정책을 사용하더라도 저장되는 파일에는 GPS 정보가 남지 않는다.
+func TestMetadataPolicy_NeverLeaksGPS(t *testing.T) {
+	data := testJPEGWithMetadata(t, true, true)
+	imageData, err := jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+
+	allowlist := []string{MetadataFieldCopyright, MetadataFieldICCProfile, MetadataFieldCaptureDate}
+	for _, policy := range []string{MetadataPolicyStrip, MetadataPolicyAllowlist, MetadataPolicyPreserve} {
+		metadata, original := MetadataPolicy{Policy: policy, Allowlist: allowlist}.Apply(data, "jpeg")
+		for _, format := range []string{"jpeg", "png", "gif"} {
+			for _, rawData := range [][]byte{nil, original} {
+				body := bytes.NewBuffer([]byte{})
+				err := EncodeImage(body, &ImageUploadTask{
+					BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: format, Metadata: metadata},
+					RawData:       rawData,
+				})
+				assert.NoError(t, err)
+				m := ReadMetadata(body.Bytes(), format)
+				assert.False(t, m.HasGPS, "policy=%s, format=%s", policy, format)
+				if policy == MetadataPolicyStrip {
+					assert.Empty(t, m.Copyright)
+					assert.Empty(t, m.ICCProfile)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeImage_Metadata(t *testing.T) {
+	imageData := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	imageData.Set(1, 1, color.RGBA{R: 255, A: 255})
+	metadata := &ImageMetadata{Copyright: "khumu", CaptureDate: "2021:05:01 13:00:00", ICCProfile: testICCProfile}
+
+	for _, format := range []string{"jpeg", "png"} {
+		t.Run(format, func(t *testing.T) {
+			body := bytes.NewBuffer([]byte{})
+			err := EncodeImage(body, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: format, Metadata: metadata}})
+			assert.NoError(t, err)
+
+			encoded := body.Bytes()
+			m := ReadMetadata(encoded, format)
+			assert.Equal(t, metadata.Copyright, m.Copyright)
+			assert.Equal(t, metadata.CaptureDate, m.CaptureDate)
+			assert.Equal(t, metadata.ICCProfile, m.ICCProfile)
+			decoded, _, err := image.Decode(bytes.NewReader(encoded))
+			assert.NoError(t, err)
+			assert.Equal(t, 16, decoded.Bounds().Dx())
+		})
+	}
+
+	t.Run("큰_ICC_profile은_여러_세그먼트로_나눔", func(t *testing.T) {
+		profile := bytes.Repeat([]byte("icc"), 50000)
+		body := bytes.NewBuffer([]byte{})
+		err := EncodeImage(body, &ImageUploadTask{BaseImageTask: &BaseImageTask{ImageData: imageData, Extension: "jpeg", Metadata: &ImageMetadata{ICCProfile: profile}}})
+		assert.NoError(t, err)
+		assert.Equal(t, profile, ReadMetadata(body.Bytes(), "jpeg").ICCProfile)
+	})
+}
+
+// copyright, 촬영 시각, ICC profile과 GPS 정보를 갖는 jpeg
+func testJPEGWithMetadata(t *testing.T, withGPS, withXmpGPS bool) []byte {
+	body := bytes.NewBuffer([]byte{})
+	assert.NoError(t, jpeg.Encode(body, image.NewRGBA(image.Rect(0, 0, 32, 16)), nil))
+	mc, err := jpgis.NewJpegMediaParser().ParseBytes(body.Bytes())
+	assert.NoError(t, err)
+	sl := mc.(*jpgis.SegmentList)
+
+	ib, err := buildExif(&ImageMetadata{Copyright: "khumu", CaptureDate: "2021:05:01 13:00:00"})
+	assert.NoError(t, err)
+	assert.NoError(t, ib.SetStandardWithName("Model", "dorm phone"))
+	if withGPS {
+		gpsIb, err := exif.GetOrCreateIbFromRootIb(ib, "IFD/GPSInfo")
+		assert.NoError(t, err)
+		assert.NoError(t, gpsIb.SetStandardWithName("GPSLatitudeRef", "N"))
+		assert.NoError(t, gpsIb.SetStandardWithName("GPSLatitude", []exifcommon.Rational{{Numerator: 37, Denominator: 1}, {Numerator: 14, Denominator: 1}, {Numerator: 0, Denominator: 1}}))
+	}
+	assert.NoError(t, sl.SetExif(ib))
+
+	segments := append([]*jpgis.Segment{}, sl.Segments()[:2]...)
+	segments = append(segments, jpegICCSegments(testICCProfile)...)
+	if withXmpGPS {
+		segments = append(segments, &jpgis.Segment{
+			MarkerId: 0xe1,
+			Data:     []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta><rdf:Description exif:GPSLatitude=\"37,14.0N\"/></x:xmpmeta>"),
+		})
+	}
+	segments = append(segments, sl.Segments()[2:]...)
+
+	out := bytes.NewBuffer([]byte{})
+	assert.NoError(t, jpgis.NewSegmentList(segments).Write(out))
+	return out.Bytes()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"io"
+	"time"
+)
+
+const metricsNamespace = "bumblebee"
+
+// 처리 단계별 소요 시간의 stage label
+const (
+	StageDecode    = "decode"
+	StageResize    = "resize"
+	StageThumbnail = "thumbnail"
+	StageEncode    = "encode"
+	StageUpload    = "upload"
+)
+
+// 워커 종류별 worker label
+const (
+	WorkerTransformer = "transformer"
+	WorkerUploader    = "uploader"
+)
+
+// GET /metrics 로 제공되는 Prometheus metric들
+var (
+	uploadsReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_received_total",
+		Help:      "업로드 요청으로 받은 이미지 수",
+	})
+	decodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "decode_failures_total",
+		Help:      "디코딩하지 못한 이미지 수. 포맷을 알 수 없거나 제한을 초과하면 format은 unknown",
+	}, []string{"format"})
+	stageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stage_duration_seconds",
+		Help:      "처리 단계(decode, resize, thumbnail, encode, upload)별 소요 시간",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage"})
+	bytesIn = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_in_total",
+		Help:      "업로드 요청으로 받은 원본 파일의 크기 합",
+	})
+	bytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_out_total",
+		Help:      "variant별로 저장소에 저장한 파일의 크기 합",
+	}, []string{"variant"})
+	workerBusySeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_busy_seconds_total",
+		Help:      "워커들이 작업을 처리하는 데에 사용한 시간의 합. rate(worker_busy_seconds_total) / workers가 워커들의 사용률이다.",
+	}, []string{"worker"})
+	workers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workers",
+		Help:      "실행 중인 워커 수",
+	}, []string{"worker"})
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_errors_total",
+		Help:      "저장소 backend(s3, disk)와 operation별 오류 수. 파일이 없는 경우는 제외한다.",
+	}, []string{"backend", "operation"})
+)
+
+func init() {
+	// 작업 채널들은 테스트나 InitTaskChannels에서 다시 만들어지므로 수집할 때마다 길이를 읽는다.
+	queues := map[string]func() (int, int){
+		"resize":    func() (int, int) { return len(ResizeTaskChan), cap(ResizeTaskChan) },
+		"thumbnail": func() (int, int) { return len(ThumbnailTaskChan), cap(ThumbnailTaskChan) },
+		"upload":    func() (int, int) { return len(UploadTaskChan), cap(UploadTaskChan) },
+	}
+	for queue, depth := range queues {
+		depth := depth
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "queue_depth",
+			Help:        "작업 채널에서 기다리는 작업 수",
+			ConstLabels: prometheus.Labels{"queue": queue},
+		}, func() float64 {
+			length, _ := depth()
+			return float64(length)
+		})
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "queue_capacity",
+			Help:        "작업 채널의 크기",
+			ConstLabels: prometheus.Labels{"queue": queue},
+		}, func() float64 {
+			_, capacity := depth()
+			return float64(capacity)
+		})
+	}
+}
+
+// start부터 지금까지의 시간을 stage의 소요 시간으로 기록한다. (e.g. defer observeStage(StageResize, time.Now()))
+func observeStage(stage string, start time.Time) {
+	stageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// start부터 지금까지 worker가 작업을 처리했음을 기록한다.
+func observeBusy(worker string, start time.Time) {
+	workerBusySeconds.WithLabelValues(worker).Add(time.Since(start).Seconds())
+}
+
+// 이미지를 디코딩하지 못했음을 기록한다. format은 알 수 없으면 비어있다.
+func observeDecodeFailure(format string) {
+	if format == "" {
+		format = "unknown"
+	}
+	decodeFailures.WithLabelValues(format).Inc()
+}
+
+// 저장소 operation의 오류를 storage_errors_total에 기록하는 Storage
+type MetricsStorage struct {
+	Storage
+	// storage_errors_total의 backend label (s3, disk)
+	Backend string
+}
+
+func NewMetricsStorage(storage Storage, backend string) *MetricsStorage {
+	return &MetricsStorage{Storage: storage, Backend: backend}
+}
+
+func (s *MetricsStorage) String() string {
+	return fmt.Sprintf("MetricsStorage(Backend: %s, Storage: %v)", s.Backend, s.Storage)
+}
+
+func (s *MetricsStorage) Put(key string, body io.Reader, contentType string) error {
+	return s.observe("put", s.Storage.Put(key, body, contentType))
+}
+
+func (s *MetricsStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	body, info, err := s.Storage.Get(key)
+	return body, info, s.observe("get", err)
+}
+
+func (s *MetricsStorage) Stat(key string) (*ObjectInfo, error) {
+	info, err := s.Storage.Stat(key)
+	return info, s.observe("stat", err)
+}
+
+func (s *MetricsStorage) List(prefix string) ([]*ObjectInfo, error) {
+	objects, err := s.Storage.List(prefix)
+	return objects, s.observe("list", err)
+}
+
+func (s *MetricsStorage) Delete(key string) error {
+	return s.observe("delete", s.Storage.Delete(key))
+}
+
+func (s *MetricsStorage) observe(operation string, err error) error {
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		storageErrors.WithLabelValues(s.Backend, operation).Inc()
+	}
+	return err
+}
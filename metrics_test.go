@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsStorage(t *testing.T) {
+	storage := NewMetricsStorage(&failingDeleteStorage{Storage: NewDiskStorage(t.TempDir(), 0), failKey: "original/abcd.png"}, "test")
+	errorsBefore := testutil.ToFloat64(storageErrors.WithLabelValues("test", "delete"))
+
+	assert.Error(t, storage.Delete("original/abcd.png"))
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(storageErrors.WithLabelValues("test", "delete")))
+	// 파일이 없는 것은 오류로 기록하지 않는다.
+	_, err := storage.Stat("original/none.png")
+	assert.True(t, errors.Is(err, ErrObjectNotFound))
+	assert.Equal(t, float64(0), testutil.ToFloat64(storageErrors.WithLabelValues("test", "stat")))
+}
+
+func TestStorageUploader_Upload_Metrics(t *testing.T) {
+	u := NewStorageUploader(nil, NewDiskStorage(t.TempDir(), 0), nil)
+	task := newTestUploadTask("metrics")
+	task.Variant = "metrics-test"
+	assert.NoError(t, u.Upload(task))
+	assert.Equal(t, float64(len("encoded")), testutil.ToFloat64(bytesOut.WithLabelValues("metrics-test")))
+}
+
+func TestMetricsRequestHandler(t *testing.T) {
+	originalConfig := Config
+	t.Cleanup(func() { Config = originalConfig })
+	Config = &BumblebeeConfig{}
+	Config.Metrics.Enabled = true
+	e := NewEcho()
+	decodeFailuresBefore := testutil.ToFloat64(decodeFailures.WithLabelValues("unknown"))
+
+	// 이미지가 아닌 파일
+	body := bytes.NewBuffer([]byte{})
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("image", "not_image.png")
+	assert.NoError(t, err)
+	_, err = part.Write([]byte("not an image"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/api/images", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 400, rec.Code)
+	assert.Equal(t, decodeFailuresBefore+1, testutil.ToFloat64(decodeFailures.WithLabelValues("unknown")))
+
+	observeStage(StageResize, time.Now())
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	metrics, err := ioutil.ReadAll(rec.Body)
+	assert.NoError(t, err)
+	for _, metric := range []string{
+		`bumblebee_uploads_received_total`,
+		`bumblebee_decode_failures_total{format="unknown"}`,
+		`bumblebee_queue_depth{queue="upload"}`,
+		`bumblebee_queue_capacity{queue="resize"}`,
+		`bumblebee_stage_duration_seconds_count{stage="resize"}`,
+	} {
+		assert.Contains(t, string(metrics), metric)
+	}
+
+	// 설정하지 않으면 제공하지 않는다.
+	Config.Metrics.Enabled = false
+	rec = httptest.NewRecorder()
+	NewEcho().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 404, rec.Code)
+}
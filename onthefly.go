@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidTransformParams = errors.New("잘못된 변환 파라미터입니다.")
+
+const (
+	// on-the-fly로 변환된 이미지를 저장하는 경로. cache/<hashed file name>/<params>.<format>에 저장된다.
+	onTheFlyCachePath = "cache"
+	// 크기를 변경하지 않는 경우 cache key에 사용하는 fit
+	fitNone = "none"
+)
+
+// on-the-fly 변환 요청의 URL 파라미터 (e.g. ?w=300&h=200&fit=fill&format=webp&q=70)
+type TransformParams struct {
+	// w, h. 0이면 지정하지 않음
+	Width  int
+	Height int
+	// fit. 생략하면 w만 있으면 width, h만 있으면 height, 둘 다 있으면 fit
+	Fit string
+	// format. 생략하면 원본 포맷
+	Format string
+	// q. jpeg, webp, avif의 인코딩 품질(1~100). 0이면 encoding 설정을 따른다.
+	Quality int
+	// bg. fit이 pad일 때 남는 공간을 채울 색 (e.g. ffffff)
+	Background string
+}
+
+// URL 파라미터를 해석하고 Config.OnTheFly의 제한을 확인한다.
+func ParseTransformParams(query url.Values) (TransformParams, error) {
+	p := TransformParams{
+		Fit:        strings.ToLower(query.Get("fit")),
+		Format:     normalizeFormat(query.Get("format")),
+		Background: strings.ToLower(strings.TrimPrefix(query.Get("bg"), "#")),
+	}
+	for _, param := range []struct {
+		name  string
+		value *int
+	}{{"w", &p.Width}, {"h", &p.Height}, {"q", &p.Quality}} {
+		if query.Get(param.name) == "" {
+			continue
+		}
+		value, err := strconv.Atoi(query.Get(param.name))
+		if err != nil || value < 0 {
+			return p, fmt.Errorf("%w %s는 0 이상의 정수여야합니다", ErrInvalidTransformParams, param.name)
+		}
+		*param.value = value
+	}
+
+	if p.Fit == "" && (p.Width > 0 || p.Height > 0) {
+		switch {
+		case p.Height == 0:
+			p.Fit = FitWidth
+		case p.Width == 0:
+			p.Fit = FitHeight
+		default:
+			p.Fit = FitContain
+		}
+	}
+	if p.Fit != "" {
+		if err := p.resizeOptions().Validate(); err != nil {
+			return p, fmt.Errorf("%w %v", ErrInvalidTransformParams, err)
+		}
+	}
+	if (Config.OnTheFly.MaxWidth > 0 && p.Width > Config.OnTheFly.MaxWidth) || (Config.OnTheFly.MaxHeight > 0 && p.Height > Config.OnTheFly.MaxHeight) {
+		return p, fmt.Errorf("%w 최대 크기는 %dx%d입니다", ErrInvalidTransformParams, Config.OnTheFly.MaxWidth, Config.OnTheFly.MaxHeight)
+	}
+	if p.Format != "" && !IsEncodableFormat(p.Format) {
+		return p, fmt.Errorf("%w 지원하지 않는 format입니다. format=%s", ErrInvalidTransformParams, p.Format)
+	}
+	if p.Quality > 100 {
+		return p, fmt.Errorf("%w q는 1~100이어야합니다", ErrInvalidTransformParams)
+	}
+	if p.Background != "" {
+		if _, err := ParseHexColor(p.Background); err != nil {
+			return p, fmt.Errorf("%w %v", ErrInvalidTransformParams, err)
+		}
+	}
+	return p, nil
+}
+
+func (p TransformParams) resizeOptions() ResizeOptions {
+	options := ResizeOptions{Width: p.Width, Height: p.Height, Fit: p.Fit}
+	if p.Background != "" {
+		options.Background, _ = ParseHexColor(p.Background)
+	}
+	return options
+}
+
+// 원본 포맷이 sourceFormat일 때 만들어질 이미지의 포맷
+func (p TransformParams) OutputFormat(sourceFormat string) string {
+	switch {
+	case p.Format != "":
+		return p.Format
+	case IsEncodableFormat(sourceFormat):
+		return sourceFormat
+	default:
+		return "png"
+	}
+}
+
+// 변환된 이미지를 저장할 key. 같은 파라미터의 요청은 항상 같은 key를 사용한다.
+// e.g. cache/abcd1234/w300_h200_fill_q70_bgffffff.webp
+func (p TransformParams) CacheKey(hashedFileName, sourceFormat string) string {
+	fit := p.Fit
+	if fit == "" {
+		fit = fitNone
+	}
+	name := fmt.Sprintf("w%d_h%d_%s_q%d", p.Width, p.Height, fit, p.Quality)
+	if p.Background != "" && p.Fit == FitPad {
+		name += "_bg" + p.Background
+	}
+	return path.Join(onTheFlyCachePath, hashedFileName, name+"."+p.OutputFormat(sourceFormat))
+}
+
+// 이 변환에 사용할 variant preset. Transformer의 리사이징 로직을 그대로 사용하기 위함.
+func (p TransformParams) preset() *VariantPreset {
+	override := EncoderOptions{
+		Jpeg: JpegOptions{Quality: p.Quality},
+		Webp: WebpOptions{Quality: p.Quality},
+		Avif: AvifOptions{Quality: p.Quality},
+	}
+	options := p.resizeOptions()
+	return &VariantPreset{
+		Name:       "on_the_fly",
+		Path:       onTheFlyCachePath,
+		Kind:       VariantKindResize,
+		Width:      p.Width,
+		Height:     p.Height,
+		Fit:        p.Fit,
+		Format:     p.Format,
+		background: options.Background,
+		encoding:   Config.Encoding.Merge(override),
+	}
+}
+
+// 저장소에서 hashedFileName의 원본 파일의 key를 찾는다.
+func findOriginalKey(storage Storage, hashedFileName string) (string, error) {
+	objects, err := storage.List(path.Join("original", hashedFileName) + ".")
+	if err != nil {
+		return "", err
+	}
+	for _, object := range objects {
+		if strings.TrimSuffix(path.Base(object.Key), path.Ext(object.Key)) == hashedFileName {
+			return object.Key, nil
+		}
+	}
+	return "", ErrImageNotFound
+}
+
+// 원본 파일을 파라미터에 따라 변환해 인코딩한다.
+// 업로드 시와 같이 회전, 메타데이터, ICC profile 정책을 적용한 뒤 Transformer의 리사이징 로직을 사용한다.
+// ctx가 끝나면(e.g. 요청이 끊기면) 인코딩을 중단한다.
+func TransformImage(ctx context.Context, data []byte, hashedFileName string, params TransformParams) ([]byte, error) {
+	imageData, orientation, gifImageData, ext, err := DecodeImageFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if orientation != 0 {
+		imageData = RotateImage(imageData, orientation)
+	}
+	metadata, _ := Config.Metadata.Apply(data, ext)
+	imageData, metadata = Config.ColorProfile.Apply(imageData, metadata, data, ext)
+
+	preset := params.preset()
+	task := &ImageResizeTask{
+		BaseImageTask: &BaseImageTask{
+			HashedFileName: hashedFileName,
+			ImageData:      imageData,
+			GIFImageData:   gifImageData,
+			Extension:      ext,
+			Metadata:       metadata,
+		},
+		Preset:              preset,
+		ResizedImageData:    imageData,
+		ResizedGIFImageData: gifImageData,
+	}
+	if params.Fit != "" {
+		(&Transformer{}).Resize(task)
+	}
+
+	body := bytes.NewBuffer([]byte{})
+	err = EncodeImageContext(ctx, body, &ImageUploadTask{
+		BaseImageTask: &BaseImageTask{
+			HashedFileName: hashedFileName,
+			ImageData:      task.ResizedImageData,
+			GIFImageData:   task.ResizedGIFImageData,
+			Extension:      params.OutputFormat(ext),
+			Metadata:       metadata,
+		},
+		UploadPath: preset.Path,
+		Encoding:   preset.EncoderOptions(),
+	})
+	return body.Bytes(), err
+}
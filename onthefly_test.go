@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func beforeEachOnTheFlyTest(t *testing.T) {
+	originalConfig, originalStorage := Config, ImageStorage
+	t.Cleanup(func() { Config, ImageStorage = originalConfig, originalStorage })
+	Config = &BumblebeeConfig{}
+	Config.OnTheFly.Enabled = true
+	Config.OnTheFly.MaxWidth = 1000
+	Config.OnTheFly.MaxHeight = 1000
+	ImageStorage = NewDiskStorage(t.TempDir(), 0)
+
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	assert.NoError(t, ImageStorage.Put("original/abcd.png", bytes.NewReader(data), "image/png"))
+}
+
+func TestParseTransformParams(t *testing.T) {
+	beforeEachOnTheFlyTest(t)
+
+	for _, tc := range []struct {
+		query    string
+		expected TransformParams
+	}{
+		{"", TransformParams{}},
+		{"w=100", TransformParams{Width: 100, Fit: FitWidth}},
+		{"h=100", TransformParams{Height: 100, Fit: FitHeight}},
+		{"w=100&h=50", TransformParams{Width: 100, Height: 50, Fit: FitContain}},
+		{"w=100&h=50&fit=PAD&bg=%23FFFFFF", TransformParams{Width: 100, Height: 50, Fit: FitPad, Background: "ffffff"}},
+		{"format=jpg&q=70", TransformParams{Format: "jpeg", Quality: 70}},
+	} {
+		params, err := ParseTransformParams(mustParseQuery(t, tc.query))
+		assert.NoError(t, err, tc.query)
+		assert.Equal(t, tc.expected, params, tc.query)
+	}
+
+	for _, query := range []string{
+		"w=abc", "w=-1", "w=1001", "h=1001", "fit=fill", "w=100&fit=unknown",
+		"format=tiff", "q=101", "w=100&h=50&fit=pad&bg=xyz",
+	} {
+		_, err := ParseTransformParams(mustParseQuery(t, query))
+		assert.ErrorIs(t, err, ErrInvalidTransformParams, query)
+	}
+}
+
+func TestTransformParams_CacheKey(t *testing.T) {
+	assert.Equal(t, "cache/abcd/w0_h0_none_q0.png", TransformParams{}.CacheKey("abcd", "png"))
+	assert.Equal(t, "cache/abcd/w100_h0_width_q70.jpeg", TransformParams{Width: 100, Fit: FitWidth, Format: "jpeg", Quality: 70}.CacheKey("abcd", "png"))
+	assert.Equal(t, "cache/abcd/w100_h50_pad_q0_bgffffff.png", TransformParams{Width: 100, Height: 50, Fit: FitPad, Background: "ffffff"}.CacheKey("abcd", "png"))
+	// pad가 아니면 bg는 결과에 영향을 주지 않는다.
+	assert.Equal(t, "cache/abcd/w100_h50_fill_q0.png", TransformParams{Width: 100, Height: 50, Fit: FitFill, Background: "ffffff"}.CacheKey("abcd", "png"))
+}
+
+func TestOnTheFlyImageRequestHandler(t *testing.T) {
+	beforeEachOnTheFlyTest(t)
+	e := NewEcho()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/images/abcd.png?w=100&h=50&fit=fill&format=jpeg&q=70", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	imageData, format, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), imageData.Bounds())
+
+	// 변환된 이미지는 저장소에 저장되어 같은 요청에는 저장된 파일을 제공한다.
+	info, err := ImageStorage.Stat("cache/abcd/w100_h50_fill_q70.jpeg")
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/images/abcd?w=100&h=50&fit=fill&format=jpeg&q=70", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, info.ETag, rec.Header().Get("ETag"))
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+
+	// 파라미터가 없으면 원본 포맷으로 다시 인코딩한다.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/images/abcd.png", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/images/abcd.png?w=5000", nil))
+	assert.Equal(t, 400, rec.Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/images/efgh.png?w=100", nil))
+	assert.Equal(t, 404, rec.Code)
+
+	// 삭제 시 변환된 이미지도 함께 삭제된다.
+	keys, err := ImageKeys(ImageStorage, "abcd")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"original/abcd.png", "cache/abcd/w100_h50_fill_q70.jpeg", "cache/abcd/w0_h0_none_q0.png"}, keys)
+}
+
+func mustParseQuery(t *testing.T, query string) url.Values {
+	values, err := url.ParseQuery(query)
+	assert.NoError(t, err)
+	return values
+}
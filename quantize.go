@@ -0,0 +1,214 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// median cut 방식으로 이미지에 사용된 색상들로부터 팔레트를 만드는 draw.Quantizer
+// 표준 라이브러리의 gif 인코더는 256색 미만을 지정하면 Plan9 팔레트의 앞부분만 사용하기 때문에 색이 크게 틀어진다.
+type medianCutQuantizer struct{}
+
+type colorCount struct {
+	c     color.NRGBA
+	count int
+}
+
+// p의 남은 용량만큼 색상을 추가한다. 투명한 픽셀이 있으면 투명색 하나를 위한 자리를 남겨둔다.
+func (q medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	size := cap(p) - len(p)
+	if size <= 0 {
+		return p
+	}
+
+	histogram := make(map[color.NRGBA]int)
+	transparent := false
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				transparent = true
+				continue
+			}
+			histogram[c]++
+		}
+	}
+	if transparent {
+		p = append(p, color.NRGBA{})
+		size--
+	}
+
+	colors := make([]colorCount, 0, len(histogram))
+	for c, count := range histogram {
+		colors = append(colors, colorCount{c: c, count: count})
+	}
+	// map 순회 순서에 따라 결과가 달라지지 않도록 함
+	sort.Slice(colors, func(i, j int) bool {
+		return nrgbaKey(colors[i].c) < nrgbaKey(colors[j].c)
+	})
+	for _, box := range splitColorBoxes(colors, size) {
+		p = append(p, box.average())
+	}
+	return p
+}
+
+type colorBox []colorCount
+
+// 가장 넓은 범위를 갖는 색상 축을 기준으로 상자를 반으로 나누는 것을 상자가 size개가 될 때까지 반복한다.
+func splitColorBoxes(colors []colorCount, size int) []colorBox {
+	if len(colors) == 0 || size <= 0 {
+		return nil
+	}
+	boxes := []colorBox{colors}
+	for len(boxes) < size {
+		target, channel, widest := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, width := box.widestChannel(); width > widest {
+				target, channel, widest = i, ch, width
+			}
+		}
+		if target < 0 {
+			break
+		}
+
+		box := boxes[target]
+		sort.SliceStable(box, func(i, j int) bool {
+			return channelOf(box[i].c, channel) < channelOf(box[j].c, channel)
+		})
+		total := 0
+		for _, cc := range box {
+			total += cc.count
+		}
+		// 픽셀 수 기준으로 중간 지점에서 나눈다. 양쪽 상자 모두 하나 이상의 색을 갖도록 함.
+		mid, acc := 1, box[0].count
+		for mid < len(box)-1 && acc*2 < total {
+			acc += box[mid].count
+			mid++
+		}
+		boxes[target] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+	return boxes
+}
+
+func (b colorBox) widestChannel() (int, int) {
+	channel, widest := 0, -1
+	for ch := 0; ch < 4; ch++ {
+		min, max := 255, 0
+		for _, cc := range b {
+			v := int(channelOf(cc.c, ch))
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		if max-min > widest {
+			channel, widest = ch, max-min
+		}
+	}
+	return channel, widest
+}
+
+// 상자에 속한 색상들의 픽셀 수로 가중치를 준 평균
+func (b colorBox) average() color.NRGBA {
+	var r, g, bl, a, total int
+	for _, cc := range b {
+		r += int(cc.c.R) * cc.count
+		g += int(cc.c.G) * cc.count
+		bl += int(cc.c.B) * cc.count
+		a += int(cc.c.A) * cc.count
+		total += cc.count
+	}
+	return color.NRGBA{
+		R: uint8((r + total/2) / total),
+		G: uint8((g + total/2) / total),
+		B: uint8((bl + total/2) / total),
+		A: uint8((a + total/2) / total),
+	}
+}
+
+func channelOf(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	default:
+		return c.A
+	}
+}
+
+func nrgbaKey(c color.NRGBA) uint32 {
+	return uint32(c.R)<<24 | uint32(c.G)<<16 | uint32(c.B)<<8 | uint32(c.A)
+}
+
+// 이미 팔레트를 사용하는 gif 프레임의 팔레트를 size개의 색상으로 줄인다.
+// 프레임 간의 투명 영역이 유지되도록 투명색은 투명색으로만 대응시킨다.
+func reduceFramePalette(frame *image.Paletted, size int) *image.Paletted {
+	if len(frame.Palette) <= size {
+		return frame
+	}
+	reducedPalette := medianCutQuantizer{}.Quantize(make(color.Palette, 0, size), frame)
+
+	transparentIndex := -1
+	for i, c := range reducedPalette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparentIndex = i
+			break
+		}
+	}
+	// 원본 팔레트의 각 색상이 새 팔레트의 어떤 색상에 대응되는지
+	mapping := make([]uint8, len(frame.Palette))
+	for i, c := range frame.Palette {
+		if _, _, _, a := c.RGBA(); a == 0 && transparentIndex >= 0 {
+			mapping[i] = uint8(transparentIndex)
+			continue
+		}
+		mapping[i] = uint8(reducedPalette.Index(c))
+	}
+
+	reduced := image.NewPaletted(frame.Bounds(), reducedPalette)
+	for i, index := range frame.Pix {
+		if int(index) < len(mapping) {
+			reduced.Pix[i] = mapping[index]
+		}
+	}
+	return reduced
+}
+
+// 사용된 색상이 maxColors개 이하이면 같은 색상들로 이루어진 팔레트 이미지로 변환한다.
+// 색상이 더 많으면 false를 반환한다.
+func toPalettedIfFewColors(m image.Image, maxColors int) (*image.Paletted, bool) {
+	if paletted, ok := m.(*image.Paletted); ok {
+		return paletted, true
+	}
+	bounds := m.Bounds()
+	p := make(color.Palette, 0, maxColors)
+	indices := make(map[color.NRGBA]bool)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if indices[c] {
+				continue
+			}
+			if len(p) == maxColors {
+				return nil, false
+			}
+			indices[c] = true
+			p = append(p, c)
+		}
+	}
+	paletted := image.NewPaletted(bounds, p)
+	draw.Draw(paletted, bounds, m, bounds.Min, draw.Src)
+	return paletted, true
+}
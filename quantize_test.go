@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"testing"
+)
+
+func TestMedianCutQuantizer(t *testing.T) {
+	imageData := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			imageData.Set(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	imageData.Set(0, 0, color.NRGBA{})
+
+	p := medianCutQuantizer{}.Quantize(make(color.Palette, 0, 16), imageData)
+	assert.Len(t, p, 16)
+	// 투명색을 위한 자리가 남아있어야한다.
+	_, _, _, a := p[0].RGBA()
+	assert.Equal(t, uint32(0), a)
+
+	t.Run("색상이_적은_경우", func(t *testing.T) {
+		imageData := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+		imageData.Set(0, 0, color.NRGBA{R: 255, A: 255})
+		p := medianCutQuantizer{}.Quantize(make(color.Palette, 0, 16), imageData)
+		assert.Len(t, p, 2)
+	})
+}
+
+func TestReduceFramePalette(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 16, 16), palette.Plan9)
+	for i := range frame.Pix {
+		frame.Pix[i] = uint8(i)
+	}
+	reduced := reduceFramePalette(frame, 32)
+	assert.LessOrEqual(t, len(reduced.Palette), 32)
+	assert.Equal(t, frame.Bounds(), reduced.Bounds())
+
+	// 이미 충분히 작은 팔레트는 그대로 사용한다.
+	assert.Same(t, frame, reduceFramePalette(frame, 256))
+}
+
+func TestToPalettedIfFewColors(t *testing.T) {
+	imageData := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	imageData.Set(1, 1, color.RGBA{R: 255, A: 255})
+	paletted, ok := toPalettedIfFewColors(imageData, 256)
+	assert.True(t, ok)
+	assert.Len(t, paletted.Palette, 2)
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(paletted.At(1, 1)))
+
+	imageData = image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			imageData.Set(x, y, color.RGBA{R: uint8(x * 8), G: uint8(y * 8), A: 255})
+		}
+	}
+	_, ok = toPalettedIfFewColors(imageData, 256)
+	assert.False(t, ok)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	quotaBucketName = "quota_usage"
+	// 이 수보다 많은 client의 token bucket이 생기면 가득 찬 bucket들을 정리한다.
+	maxIdleTokenBuckets = 10000
+	// 요청이 끊긴 client의 token bucket과 사용량 기록을 정리하는 주기
+	idleClientPruneInterval = time.Minute
+)
+
+var (
+	// Config.RateLimit.Enabled인 경우에만 사용된다.
+	UploadRateLimiter *RateLimiter
+	// Config.Quota.Enabled인 경우에만 사용된다.
+	UploadQuotas *QuotaStore
+
+	ErrInvalidRateLimitConfig = errors.New("잘못된 업로드 제한 설정입니다.")
+	ErrRateLimited            = errors.New("요청이 너무 많습니다. 잠시 후 다시 시도해주세요.")
+	ErrQuotaExceeded          = errors.New("업로드할 수 있는 용량을 초과했습니다. 잠시 후 다시 시도해주세요.")
+)
+
+// 업로드 요청 수 제한. client마다 Burst개의 token을 가진 bucket에 초당 Rate개의 token이 채워진다.
+type RateLimitConfig struct {
+	Enabled bool
+	// 초당 채워지는 token 수
+	Rate float64
+	// bucket의 크기. 한 번에 보낼 수 있는 최대 요청 수
+	Burst int
+}
+
+// 업로드 용량 제한. client마다 최근 Window분 동안 업로드한 원본 파일 크기의 합이 MaxBytes를 넘을 수 없다.
+type QuotaConfig struct {
+	Enabled  bool
+	MaxBytes int64
+	// rolling window(분)
+	Window int
+	// 사용량을 기록할 bbolt 파일
+	Path string
+}
+
+func (c *RateLimitConfig) Validate() error {
+	if c.Enabled && (c.Rate <= 0 || c.Burst < 1) {
+		return fmt.Errorf("%w rateLimit.rate는 0보다 크고 burst는 1 이상이어야합니다", ErrInvalidRateLimitConfig)
+	}
+	return nil
+}
+
+func (c *QuotaConfig) Validate() error {
+	if c.Enabled && (c.MaxBytes <= 0 || c.Window <= 0 || c.Path == "") {
+		return fmt.Errorf("%w quota.maxBytes, window는 0보다 커야하고 path는 필수입니다", ErrInvalidRateLimitConfig)
+	}
+	return nil
+}
+
+// 요청 수 제한과 용량 제한을 적용할 단위. 인증된 주체가 있으면 주체, 없으면 IP를 사용한다.
+// IP는 echo.IPExtractor(newIPExtractor 참고)를 따르므로 신뢰하지 않는 client가 보낸 X-Forwarded-For 등의 헤더로 바꿀 수 없다.
+func clientKeyOf(c echo.Context) string {
+	if principal := PrincipalOf(c); principal != nil {
+		return principal.String()
+	}
+	return "ip:" + c.RealIP()
+}
+
+// client IP를 정하는 방법. trustedProxies(CIDR)가 비어있으면 연결된 주소를 그대로 사용하고,
+// 있으면 trustedProxies에서 온 요청의 X-Forwarded-For 중 신뢰하지 않는 가장 가까운 주소를 사용한다.
+func newIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w trustedProxies는 CIDR이어야합니다. proxy=%s", ErrInvalidRateLimitConfig, proxy)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// 429로 응답하고 Retry-After 헤더에 다시 시도할 수 있을 때까지의 시간(초)을 설정한다.
+func respondTooManyRequests(c echo.Context, err error, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	logrus.Warnf("업로드 요청을 제한합니다. client=%s, retryAfter=%ds, err=%s", clientKeyOf(c), seconds, err)
+	return c.JSON(429, BaseResponse{Message: err.Error()})
+}
+
+// UploadRateLimiter가 설정되어있으면 client마다 요청 수를 제한한다.
+// 인증된 주체를 사용하므로 AuthMiddleware 이후에 실행되어야한다.
+func RateLimitMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if UploadRateLimiter == nil {
+			return handlerFunc(c)
+		}
+		if ok, retryAfter := UploadRateLimiter.Allow(clientKeyOf(c), time.Now()); !ok {
+			return respondTooManyRequests(c, ErrRateLimited, retryAfter)
+		}
+		return handlerFunc(c)
+	}
+}
+
+// client별 token bucket
+// 재시작 시 초기화되어도 문제가 없으므로 메모리에만 보관한다.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// 마지막으로 가득 찬 bucket들을 정리한 시각
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+}
+
+// client의 요청을 허용할지 결정한다. 허용하지 않으면 token이 채워질 때까지의 시간을 함께 반환한다.
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) >= maxIdleTokenBuckets || now.Sub(l.lastPrune) >= idleClientPruneInterval {
+		l.pruneLocked(now)
+	}
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// 다시 가득 찬 bucket은 새로 만든 것과 같으므로 지운다.
+// burst / rate초 이상 요청이 없던 client의 bucket이 지워진다.
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	l.lastPrune = now
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// client의 최근 window 동안의 업로드 사용량
+type QuotaUsage struct {
+	Client string `json:"client"`
+	// 업로드한 원본 파일 크기의 합
+	Bytes    int64 `json:"bytes"`
+	Uploads  int   `json:"uploads"`
+	MaxBytes int64 `json:"max_bytes"`
+	// 가장 오래된 기록이 window에서 빠지는 시각. 기록이 없으면 nil
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+// client별 업로드 기록을 bbolt에 저장해 rolling window 동안의 사용량을 계산한다.
+// quota_usage bucket 아래에 client마다 bucket이 있고, 각 기록의 key는 업로드 시각(unix nano), value는 크기이다.
+type QuotaStore struct {
+	db       *bolt.DB
+	maxBytes int64
+	window   time.Duration
+	// 마지막으로 client들의 기록을 정리한 시각. bolt의 쓰기 transaction 안에서만 접근한다.
+	lastPrune time.Time
+}
+
+func OpenQuotaStore(path string, maxBytes int64, window time.Duration) (*QuotaStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(quotaBucketName))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &QuotaStore{db: db, maxBytes: maxBytes, window: window}, nil
+}
+
+func (s *QuotaStore) Close() error {
+	return s.db.Close()
+}
+
+// client가 size byte를 업로드할 수 있으면 기록한다.
+// 초과하는 경우 ErrQuotaExceeded와 함께 업로드할 수 있게 될 때까지의 시간을 반환한다.
+func (s *QuotaStore) Consume(client string, size int64, now time.Time) (time.Duration, error) {
+	var retryAfter time.Duration
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if now.Sub(s.lastPrune) >= idleClientPruneInterval {
+			if err := s.pruneClients(tx, now); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.Bucket([]byte(quotaBucketName)).CreateBucketIfNotExists([]byte(client))
+		if err != nil {
+			return err
+		}
+		records, err := s.pruneAndRead(bucket, now)
+		if err != nil {
+			return err
+		}
+		used := int64(0)
+		for _, record := range records {
+			used += record.size
+		}
+		if used+size > s.maxBytes {
+			// 오래된 기록부터 window에서 빠졌을 때 업로드할 수 있게 되는 시점
+			retryAfter = s.window
+			for _, record := range records {
+				used -= record.size
+				if used+size <= s.maxBytes {
+					retryAfter = record.at.Add(s.window).Sub(now)
+					break
+				}
+			}
+			return ErrQuotaExceeded
+		}
+
+		// 같은 시각의 기록이 덮어써지지 않도록 한다.
+		key := now.UnixNano()
+		for bucket.Get(quotaRecordKey(key)) != nil {
+			key++
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(size))
+		return bucket.Put(quotaRecordKey(key), value)
+	})
+	return retryAfter, err
+}
+
+// Consume으로 기록한 업로드를 처리하지 못한 경우 기록을 지워 사용량을 되돌린다.
+// consumedAt은 Consume에 전달한 시각이다.
+func (s *QuotaStore) Refund(client string, size int64, consumedAt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(quotaBucketName)).Bucket([]byte(client))
+		if bucket == nil {
+			return nil
+		}
+		// 같은 시각의 기록이 있으면 Consume은 뒤의 key에 기록한다.
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(quotaRecordKey(consumedAt.UnixNano())); k != nil; k, v = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(v)) == size {
+				return bucket.Delete(k)
+			}
+		}
+		return nil
+	})
+}
+
+// client의 사용량
+func (s *QuotaStore) Usage(client string, now time.Time) (*QuotaUsage, error) {
+	usage := &QuotaUsage{Client: client, MaxBytes: s.maxBytes}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(quotaBucketName)).Bucket([]byte(client))
+		if bucket == nil {
+			return nil
+		}
+		s.aggregate(bucket, now, usage)
+		return nil
+	})
+	return usage, err
+}
+
+// 최근 window 동안 업로드한 모든 client의 사용량. 사용량이 많은 순서로 정렬된다.
+func (s *QuotaStore) AllUsage(now time.Time) ([]*QuotaUsage, error) {
+	usages := make([]*QuotaUsage, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(quotaBucketName)).ForEach(func(client, _ []byte) error {
+			usage := &QuotaUsage{Client: string(client), MaxBytes: s.maxBytes}
+			s.aggregate(tx.Bucket([]byte(quotaBucketName)).Bucket(client), now, usage)
+			if usage.Uploads > 0 {
+				usages = append(usages, usage)
+			}
+			return nil
+		})
+	})
+	sort.SliceStable(usages, func(i, j int) bool { return usages[i].Bytes > usages[j].Bytes })
+	return usages, err
+}
+
+type quotaRecord struct {
+	at   time.Time
+	size int64
+}
+
+func quotaRecordKey(unixNano int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(unixNano))
+	return key
+}
+
+// window가 지난 기록들을 지우고 남은 기록들을 오래된 순서로 반환한다.
+func (s *QuotaStore) pruneAndRead(bucket *bolt.Bucket, now time.Time) ([]quotaRecord, error) {
+	records := make([]quotaRecord, 0)
+	expired := make([][]byte, 0)
+	cursor := bucket.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+		if !at.Add(s.window).After(now) {
+			expired = append(expired, k)
+			continue
+		}
+		records = append(records, quotaRecord{at: at, size: int64(binary.BigEndian.Uint64(v))})
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// window가 지난 기록들을 지우고 기록이 남지 않은 client의 bucket을 지운다.
+func (s *QuotaStore) pruneClients(tx *bolt.Tx, now time.Time) error {
+	s.lastPrune = now
+	root := tx.Bucket([]byte(quotaBucketName))
+	// ForEach 중에는 bucket을 수정할 수 없으므로 client 목록을 먼저 읽는다.
+	clients := make([][]byte, 0)
+	root.ForEach(func(client, _ []byte) error {
+		clients = append(clients, append([]byte{}, client...))
+		return nil
+	})
+	for _, client := range clients {
+		records, err := s.pruneAndRead(root.Bucket(client), now)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			continue
+		}
+		if err := root.DeleteBucket(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *QuotaStore) aggregate(bucket *bolt.Bucket, now time.Time, usage *QuotaUsage) {
+	bucket.ForEach(func(k, v []byte) error {
+		at := time.Unix(0, int64(binary.BigEndian.Uint64(k)))
+		if !at.Add(s.window).After(now) {
+			return nil
+		}
+		if usage.ResetsAt == nil {
+			resetsAt := at.Add(s.window)
+			usage.ResetsAt = &resetsAt
+		}
+		usage.Bytes += int64(binary.BigEndian.Uint64(v))
+		usage.Uploads++
+		return nil
+	})
+}
+
+// 모든 client의 업로드 사용량을 조회한다. (GET /api/admin/quotas)
+func QuotaUsageRequestHandler(c echo.Context) error {
+	if UploadQuotas == nil {
+		return c.JSON(404, BaseResponse{Message: "업로드 용량 제한을 사용하지 않습니다."})
+	}
+	usages, err := UploadQuotas.AllUsage(time.Now())
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	return c.JSON(200, BaseResponse{Data: usages})
+}
+
+// client 하나의 업로드 사용량을 조회한다. (GET /api/admin/quotas/:client) client는 jwt:<sub>, api_key:<client>, ip:<ip> 형태이다.
+func ClientQuotaUsageRequestHandler(c echo.Context) error {
+	if UploadQuotas == nil {
+		return c.JSON(404, BaseResponse{Message: "업로드 용량 제한을 사용하지 않습니다."})
+	}
+	client, err := url.PathUnescape(c.Param("client"))
+	if err != nil {
+		return c.JSON(400, BaseResponse{Message: err.Error()})
+	}
+	usage, err := UploadQuotas.Usage(client, time.Now())
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	return c.JSON(200, BaseResponse{Data: usage})
+}
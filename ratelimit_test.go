@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	limiter := NewRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.Allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, retryAfter)
+	// 다른 client는 영향을 받지 않는다.
+	ok, _ = limiter.Allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = limiter.Allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+
+	// 오래 기다려도 burst보다 많이 쌓이지 않는다.
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("a", later)
+		assert.True(t, ok)
+	}
+	ok, _ = limiter.Allow("a", later)
+	assert.False(t, ok)
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	limiter := NewRateLimiter(0.1, 2)
+	now := time.Now()
+	limiter.Allow("a", now)
+	limiter.Allow("b", now.Add(idleClientPruneInterval-time.Second))
+	// a는 요청이 끊겨 bucket이 다시 가득 찼다.
+	limiter.Allow("c", now.Add(idleClientPruneInterval))
+	_, a := limiter.buckets["a"]
+	_, b := limiter.buckets["b"]
+	assert.False(t, a)
+	assert.True(t, b)
+}
+
+func TestNewIPExtractor(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 198.51.100.3")
+	req.Header.Set("X-Real-IP", "203.0.113.8")
+
+	// 신뢰하는 proxy가 없으면 헤더를 무시한다.
+	extract, err := newIPExtractor(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", extract(req))
+
+	extract, err = newIPExtractor([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+	assert.Equal(t, "198.51.100.3", extract(req))
+	// 신뢰하지 않는 주소에서 온 요청의 헤더는 무시한다.
+	req.RemoteAddr = "192.0.2.1:1234"
+	assert.Equal(t, "192.0.2.1", extract(req))
+
+	_, err = newIPExtractor([]string{"10.0.0.1"})
+	assert.ErrorIs(t, err, ErrInvalidRateLimitConfig)
+}
+
+func openTestQuotaStore(t *testing.T, maxBytes int64, window time.Duration) *QuotaStore {
+	store, err := OpenQuotaStore(filepath.Join(t.TempDir(), "quota.db"), maxBytes, window)
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestQuotaStore_Consume(t *testing.T) {
+	store := openTestQuotaStore(t, 100, time.Hour)
+	now := time.Now()
+
+	_, err := store.Consume("jwt:a", 60, now)
+	assert.NoError(t, err)
+	_, err = store.Consume("jwt:a", 30, now.Add(10*time.Minute))
+	assert.NoError(t, err)
+	retryAfter, err := store.Consume("jwt:a", 20, now.Add(20*time.Minute))
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	// 첫 번째 기록이 window에서 빠지면 업로드할 수 있다.
+	assert.Equal(t, 40*time.Minute, retryAfter)
+	_, err = store.Consume("jwt:b", 100, now)
+	assert.NoError(t, err)
+
+	usage, err := store.Usage("jwt:a", now.Add(20*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(90), usage.Bytes)
+	assert.Equal(t, 2, usage.Uploads)
+	assert.Equal(t, now.Add(time.Hour).UnixNano(), usage.ResetsAt.UnixNano())
+
+	_, err = store.Consume("jwt:a", 20, now.Add(time.Hour))
+	assert.NoError(t, err)
+	usage, err = store.Usage("jwt:a", now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(50), usage.Bytes)
+
+	usages, err := store.AllUsage(now.Add(time.Hour))
+	assert.NoError(t, err)
+	if assert.Len(t, usages, 1) {
+		assert.Equal(t, "jwt:a", usages[0].Client)
+	}
+}
+
+func TestQuotaStore_Refund(t *testing.T) {
+	store := openTestQuotaStore(t, 100, time.Hour)
+	now := time.Now()
+
+	_, err := store.Consume("jwt:a", 60, now)
+	assert.NoError(t, err)
+	_, err = store.Consume("jwt:a", 30, now)
+	assert.NoError(t, err)
+	// 같은 시각에 기록된 것 중 크기가 같은 기록만 지운다.
+	assert.NoError(t, store.Refund("jwt:a", 30, now))
+	assert.NoError(t, store.Refund("jwt:unknown", 30, now))
+	usage, err := store.Usage("jwt:a", now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60), usage.Bytes)
+	assert.Equal(t, 1, usage.Uploads)
+
+	_, err = store.Consume("jwt:a", 40, now.Add(time.Minute))
+	assert.NoError(t, err)
+}
+
+func TestQuotaStore_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.db")
+	store, err := OpenQuotaStore(path, 100, time.Hour)
+	assert.NoError(t, err)
+	_, err = store.Consume("ip:127.0.0.1", 70, time.Now())
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	store, err = OpenQuotaStore(path, 100, time.Hour)
+	assert.NoError(t, err)
+	defer store.Close()
+	_, err = store.Consume("ip:127.0.0.1", 70, time.Now())
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestQuotaStore_PruneIdleClients(t *testing.T) {
+	store := openTestQuotaStore(t, 100, time.Hour)
+	now := time.Now()
+	_, err := store.Consume("ip:192.0.2.1", 10, now)
+	assert.NoError(t, err)
+	_, err = store.Consume("ip:192.0.2.2", 10, now.Add(30*time.Minute))
+	assert.NoError(t, err)
+
+	// window가 지나 기록이 남지 않은 client의 bucket은 지워진다.
+	_, err = store.Consume("ip:192.0.2.3", 10, now.Add(time.Hour))
+	assert.NoError(t, err)
+	clients := make([]string, 0)
+	assert.NoError(t, store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(quotaBucketName)).ForEach(func(client, _ []byte) error {
+			clients = append(clients, string(client))
+			return nil
+		})
+	}))
+	assert.Equal(t, []string{"ip:192.0.2.2", "ip:192.0.2.3"}, clients)
+}
+
+func TestImageUploadRequestHandler_RateLimit(t *testing.T) {
+	originalLimiter, originalQuotas, originalConfig := UploadRateLimiter, UploadQuotas, Config
+	t.Cleanup(func() { UploadRateLimiter, UploadQuotas, Config = originalLimiter, originalQuotas, originalConfig })
+	Config = &BumblebeeConfig{}
+	Config.Admin.Token = "admin-token"
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	e := NewEcho()
+
+	upload := func() *httptest.ResponseRecorder {
+		body := bytes.NewBuffer([]byte{})
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("image", "test_png.png")
+		assert.NoError(t, err)
+		_, err = part.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+		req := httptest.NewRequest("POST", "/api/images", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("헤더로_client를_바꿀_수_없음", func(t *testing.T) {
+		UploadRateLimiter = NewRateLimiter(0.5, 1)
+		UploadQuotas = nil
+		UploadRateLimiter.Allow("ip:192.0.2.1", time.Now())
+		body := bytes.NewBuffer([]byte{})
+		writer := multipart.NewWriter(body)
+		assert.NoError(t, writer.Close())
+		req := httptest.NewRequest("POST", "/api/images", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Real-IP", "203.0.113.8")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, 429, rec.Code)
+	})
+
+	t.Run("요청_수", func(t *testing.T) {
+		UploadRateLimiter = NewRateLimiter(0.5, 1)
+		UploadQuotas = nil
+		// 같은 client의 이전 요청이 token을 모두 사용했다.
+		UploadRateLimiter.Allow("ip:192.0.2.1", time.Now())
+		rec := upload()
+		assert.Equal(t, 429, rec.Code)
+		assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	})
+
+	t.Run("용량", func(t *testing.T) {
+		UploadRateLimiter = nil
+		UploadQuotas = openTestQuotaStore(t, int64(len(data)), time.Hour)
+		_, err := UploadQuotas.Consume("ip:192.0.2.1", 1, time.Now())
+		assert.NoError(t, err)
+		rec := upload()
+		assert.Equal(t, 429, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+		req := httptest.NewRequest("GET", "/api/admin/quotas/ip:192.0.2.1", nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, 200, rec.Code)
+		resp := struct {
+			Data QuotaUsage `json:"data"`
+		}{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, int64(1), resp.Data.Bytes)
+		assert.Equal(t, int64(len(data)), resp.Data.MaxBytes)
+
+		req = httptest.NewRequest("GET", "/api/admin/quotas", nil)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, 401, rec.Code)
+	})
+
+	t.Run("처리하지_못한_업로드는_사용량에서_제외", func(t *testing.T) {
+		originalQueue := DurableTaskQueue
+		defer func() { DurableTaskQueue = originalQueue }()
+		queue, _, err := OpenDurableQueue(t.TempDir())
+		assert.NoError(t, err)
+		// 닫힌 queue는 작업을 기록하지 못한다.
+		assert.NoError(t, queue.Close())
+		DurableTaskQueue = queue
+		UploadRateLimiter = nil
+		UploadQuotas = openTestQuotaStore(t, int64(len(data)), time.Hour)
+
+		assert.Equal(t, 500, upload().Code)
+		usage, err := UploadQuotas.Usage("ip:192.0.2.1", time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), usage.Bytes)
+	})
+}
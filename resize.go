@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"strings"
+)
+
+// variant preset의 크기 변경 방식
+const (
+	// width에 맞춰 비율을 유지한 채 크기를 변경한다. 원본보다 커지지는 않는다.
+	FitWidth = "width"
+	// height에 맞춰 비율을 유지한 채 크기를 변경한다. 원본보다 커지지는 않는다.
+	FitHeight = "height"
+	// width x height 안에 들어가도록 비율을 유지한 채 크기를 변경한다. 원본보다 커지지는 않는다.
+	FitContain = "fit"
+	// width x height를 가득 채우도록 비율을 유지한 채 크기를 변경한 뒤 넘치는 부분을 가운데를 기준으로 잘라낸다.
+	FitFill = "fill"
+	// FitContain과 같이 크기를 변경한 뒤 남는 공간을 배경색으로 채워 width x height로 만든다.
+	FitPad = "pad"
+	// 비율과 관계 없이 width x height로 크기를 변경한다.
+	FitExact = "exact"
+)
+
+var (
+	ErrInvalidColor = errors.New("잘못된 색상 형식입니다. #rgb, #rrggbb, #rrggbbaa 형식을 사용해주세요.")
+
+	// pad 시 배경색을 지정하지 않은 경우의 배경색
+	defaultBackground = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+)
+
+type ResizeOptions struct {
+	Width  int
+	Height int
+	Fit    string
+	// FitPad에서 남는 공간을 채울 색
+	Background color.Color
+}
+
+// 원본 이미지가 결과 이미지 안에서 어떻게 배치되는지
+// 원본은 scaledW x scaledH로 크기가 변경된 뒤 outW x outH 크기의 결과 이미지의 (offsetX, offsetY)에 놓인다.
+// offset이 음수이면 잘려나가는 부분이 있고(fill), 양수이면 배경이 채워지는 부분이 있다(pad).
+type resizeGeometry struct {
+	scaledW, scaledH int
+	offsetX, offsetY int
+	outW, outH       int
+}
+
+func (g resizeGeometry) isIdentity(originalW, originalH int) bool {
+	return g.scaledW == originalW && g.scaledH == originalH &&
+		g.outW == originalW && g.outH == originalH &&
+		g.offsetX == 0 && g.offsetY == 0
+}
+
+// 해당 mode가 사용하는 width, height가 올바르게 설정되었는지 확인한다.
+func (o ResizeOptions) Validate() error {
+	switch o.Fit {
+	case FitWidth:
+		if o.Width <= 0 {
+			return errors.New("width mode는 width가 0보다 커야합니다")
+		}
+	case FitHeight:
+		if o.Height <= 0 {
+			return errors.New("height mode는 height가 0보다 커야합니다")
+		}
+	case FitContain, FitFill, FitPad, FitExact:
+		if o.Width <= 0 || o.Height <= 0 {
+			return fmt.Errorf("%s mode는 width와 height가 0보다 커야합니다", o.Fit)
+		}
+	default:
+		return fmt.Errorf("지원하지 않는 fit mode입니다. fit=%s", o.Fit)
+	}
+	return nil
+}
+
+func (o ResizeOptions) geometry(originalW, originalH int) resizeGeometry {
+	var g resizeGeometry
+	switch o.Fit {
+	case FitWidth:
+		g.scaledW, g.scaledH = scaleBy(originalW, originalH, minFloat(float64(o.Width)/float64(originalW), 1))
+	case FitHeight:
+		g.scaledW, g.scaledH = scaleBy(originalW, originalH, minFloat(float64(o.Height)/float64(originalH), 1))
+	case FitContain, FitPad:
+		ratio := minFloat(float64(o.Width)/float64(originalW), float64(o.Height)/float64(originalH))
+		g.scaledW, g.scaledH = scaleBy(originalW, originalH, minFloat(ratio, 1))
+	case FitFill:
+		ratio := float64(o.Width) / float64(originalW)
+		if heightRatio := float64(o.Height) / float64(originalH); heightRatio > ratio {
+			ratio = heightRatio
+		}
+		g.scaledW, g.scaledH = scaleBy(originalW, originalH, ratio)
+		// 반올림 오차로 인해 box보다 작아지지 않도록 함.
+		if g.scaledW < o.Width {
+			g.scaledW = o.Width
+		}
+		if g.scaledH < o.Height {
+			g.scaledH = o.Height
+		}
+	case FitExact:
+		g.scaledW, g.scaledH = o.Width, o.Height
+	}
+
+	g.outW, g.outH = g.scaledW, g.scaledH
+	if o.Fit == FitFill || o.Fit == FitPad {
+		g.outW, g.outH = o.Width, o.Height
+		g.offsetX = (g.outW - g.scaledW) / 2
+		g.offsetY = (g.outH - g.scaledH) / 2
+	}
+	return g
+}
+
+// 결과 이미지의 크기
+func (o ResizeOptions) OutputSize(originalW, originalH int) (int, int) {
+	g := o.geometry(originalW, originalH)
+	return g.outW, g.outH
+}
+
+// 이미지의 크기를 변경한다. 크기를 변경할 필요가 없으면 원본을 그대로 반환한다.
+func ResizeImage(imageData image.Image, o ResizeOptions) image.Image {
+	originalW, originalH := imageData.Bounds().Dx(), imageData.Bounds().Dy()
+	g := o.geometry(originalW, originalH)
+	if g.isIdentity(originalW, originalH) {
+		return imageData
+	}
+
+	scaled := resize.Resize(uint(g.scaledW), uint(g.scaledH), imageData, resize.Lanczos3)
+	if g.outW == g.scaledW && g.outH == g.scaledH {
+		return scaled
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, g.outW, g.outH))
+	if o.Fit == FitPad {
+		draw.Draw(out, out.Bounds(), image.NewUniform(o.background()), image.Point{}, draw.Src)
+	}
+	dst := image.Rect(g.offsetX, g.offsetY, g.offsetX+g.scaledW, g.offsetY+g.scaledH)
+	draw.Draw(out, dst, scaled, scaled.Bounds().Min, draw.Over)
+	return out
+}
+
+// gif의 모든 프레임의 크기를 변경한다. 크기를 변경할 필요가 없으면 원본을 그대로 반환한다.
+// 각 프레임은 gif 전체 크기 중 일부 영역일 수 있으므로 전체 크기를 기준으로 각 프레임의 위치와 크기를 계산한다.
+func ResizeGIF(gifImageData *gif.GIF, o ResizeOptions) *gif.GIF {
+	originalW, originalH := gifImageData.Config.Width, gifImageData.Config.Height
+	g := o.geometry(originalW, originalH)
+	if g.isIdentity(originalW, originalH) {
+		return gifImageData
+	}
+
+	// gif resize 참고. 상당히 어려움
+	// https://stackoverflow.com/a/54210633/9471220
+	// image.Image* => image.Palette 참고
+	// https://stackoverflow.com/questions/35850753/how-to-convert-image-rgba-image-image-to-image-paletted
+	// NewGIF 메소드를 제공하는 곳이 없어서 원본 GIF를 바탕으로 복사한다.
+	resized := &gif.GIF{
+		Image:           make([]*image.Paletted, 0, len(gifImageData.Image)),
+		Delay:           make([]int, 0, len(gifImageData.Delay)),
+		Disposal:        make([]byte, 0, len(gifImageData.Disposal)),
+		LoopCount:       gifImageData.LoopCount,
+		Config:          image.Config{ColorModel: gifImageData.Config.ColorModel, Width: g.outW, Height: g.outH},
+		BackgroundIndex: gifImageData.BackgroundIndex,
+	}
+	canvas := image.Rect(0, 0, g.outW, g.outH)
+	padded := o.Fit == FitPad && (g.outW != g.scaledW || g.outH != g.scaledH)
+	for i, frame := range gifImageData.Image {
+		bounds := frame.Bounds()
+		dst := image.Rect(
+			g.offsetX+bounds.Min.X*g.scaledW/originalW,
+			g.offsetY+bounds.Min.Y*g.scaledH/originalH,
+			g.offsetX+bounds.Max.X*g.scaledW/originalW,
+			g.offsetY+bounds.Max.Y*g.scaledH/originalH,
+		)
+		visible := dst.Intersect(canvas)
+		if visible.Empty() {
+			// 잘려나가서 보이지 않는 프레임도 타이밍을 유지하기 위해 1px 프레임으로 남긴다.
+			visible = image.Rect(0, 0, 1, 1)
+			dst = visible
+		}
+
+		scaled := resize.Resize(uint(dst.Dx()), uint(dst.Dy()), frame, resize.Lanczos3)
+		disposal := byte(gif.DisposalNone)
+		if i < len(gifImageData.Disposal) {
+			disposal = gifImageData.Disposal[i]
+		}
+		var palettedImage *image.Paletted
+		if i == 0 && padded {
+			// 여백은 어떤 프레임도 덮지 않으므로 첫 프레임을 전체 크기로 늘려 배경색으로 한 번만 칠한다.
+			// 정지 이미지와 마찬가지로 배경 위에 프레임을 합성하고, 여백이 지워지지 않도록 첫 프레임은 폐기하지 않는다.
+			palettedImage = image.NewPaletted(canvas, withColor(frame.Palette, o.background()))
+			draw.Draw(palettedImage, canvas, image.NewUniform(o.background()), image.Point{}, draw.Src)
+			draw.Draw(palettedImage, visible, scaled, scaled.Bounds().Min.Add(visible.Min.Sub(dst.Min)), draw.Over)
+			disposal = gif.DisposalNone
+		} else {
+			palettedImage = image.NewPaletted(visible, frame.Palette)
+			draw.Draw(palettedImage, visible, scaled, scaled.Bounds().Min.Add(visible.Min.Sub(dst.Min)), draw.Src)
+		}
+
+		resized.Image = append(resized.Image, palettedImage)
+		if i < len(gifImageData.Delay) {
+			resized.Delay = append(resized.Delay, gifImageData.Delay[i])
+		}
+		if i < len(gifImageData.Disposal) {
+			resized.Disposal = append(resized.Disposal, disposal)
+		}
+	}
+	return resized
+}
+
+// 팔레트에 색상이 없고 자리가 남아있으면 추가한다. 자리가 없으면 가장 가까운 색상으로 그려진다.
+func withColor(p color.Palette, c color.Color) color.Palette {
+	if len(p) >= 256 || (len(p) > 0 && color.RGBAModel.Convert(p.Convert(c)) == color.RGBAModel.Convert(c)) {
+		return p
+	}
+	extended := make(color.Palette, len(p), len(p)+1)
+	copy(extended, p)
+	return append(extended, c)
+}
+
+func (o ResizeOptions) background() color.Color {
+	if o.Background == nil {
+		return defaultBackground
+	}
+	return o.Background
+}
+
+// #rgb, #rrggbb, #rrggbbaa 형식의 색상을 해석한다.
+func ParseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return nil, fmt.Errorf("%w color=%s", ErrInvalidColor, s)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w color=%s", ErrInvalidColor, s)
+	}
+	return color.NRGBA{R: uint8(value >> 24), G: uint8(value >> 16), B: uint8(value >> 8), A: uint8(value)}, nil
+}
+
+func scaleBy(w, h int, ratio float64) (int, int) {
+	scaledW, scaledH := int(float64(w)*ratio+0.5), int(float64(h)*ratio+0.5)
+	if scaledW < 1 {
+		scaledW = 1
+	}
+	if scaledH < 1 {
+		scaledH = 1
+	}
+	return scaledW, scaledH
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"testing"
+)
+
+// 왼쪽 절반은 빨간색, 오른쪽 절반은 파란색인 200x100 이미지
+func newHalfRedHalfBlueImage() image.Image {
+	imageData := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(imageData, image.Rect(0, 0, 100, 100), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(imageData, image.Rect(100, 0, 200, 100), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	return imageData
+}
+
+func TestResizeImage(t *testing.T) {
+	imageData := newHalfRedHalfBlueImage()
+	for _, tc := range []struct {
+		name           string
+		options        ResizeOptions
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "width", options: ResizeOptions{Width: 100, Fit: FitWidth}, expectedWidth: 100, expectedHeight: 50},
+		{name: "width_원본보다_큰_경우", options: ResizeOptions{Width: 400, Fit: FitWidth}, expectedWidth: 200, expectedHeight: 100},
+		{name: "height", options: ResizeOptions{Height: 50, Fit: FitHeight}, expectedWidth: 100, expectedHeight: 50},
+		{name: "fit", options: ResizeOptions{Width: 50, Height: 50, Fit: FitContain}, expectedWidth: 50, expectedHeight: 25},
+		{name: "fill", options: ResizeOptions{Width: 50, Height: 50, Fit: FitFill}, expectedWidth: 50, expectedHeight: 50},
+		{name: "fill_원본보다_큰_경우", options: ResizeOptions{Width: 300, Height: 300, Fit: FitFill}, expectedWidth: 300, expectedHeight: 300},
+		{name: "pad", options: ResizeOptions{Width: 50, Height: 50, Fit: FitPad}, expectedWidth: 50, expectedHeight: 50},
+		{name: "exact", options: ResizeOptions{Width: 30, Height: 70, Fit: FitExact}, expectedWidth: 30, expectedHeight: 70},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, tc.options.Validate())
+			resized := ResizeImage(imageData, tc.options)
+			assert.Equal(t, tc.expectedWidth, resized.Bounds().Dx())
+			assert.Equal(t, tc.expectedHeight, resized.Bounds().Dy())
+			w, h := tc.options.OutputSize(200, 100)
+			assert.Equal(t, tc.expectedWidth, w)
+			assert.Equal(t, tc.expectedHeight, h)
+		})
+	}
+
+	t.Run("fill은_가운데를_기준으로_자름", func(t *testing.T) {
+		resized := ResizeImage(imageData, ResizeOptions{Width: 50, Height: 50, Fit: FitFill})
+		r, _, b, _ := resized.At(5, 25).RGBA()
+		assert.Greater(t, r, b)
+		r, _, b, _ = resized.At(45, 25).RGBA()
+		assert.Greater(t, b, r)
+	})
+
+	t.Run("pad는_남는_공간을_배경색으로_채움", func(t *testing.T) {
+		background, err := ParseHexColor("#00ff00")
+		assert.NoError(t, err)
+		resized := ResizeImage(imageData, ResizeOptions{Width: 50, Height: 50, Fit: FitPad, Background: background})
+		assert.Equal(t, color.RGBAModel.Convert(background), color.RGBAModel.Convert(resized.At(25, 0)))
+		assert.Equal(t, color.RGBAModel.Convert(background), color.RGBAModel.Convert(resized.At(25, 49)))
+	})
+
+	t.Run("크기_변경이_필요_없으면_원본을_반환", func(t *testing.T) {
+		resized := ResizeImage(imageData, ResizeOptions{Width: 200, Height: 200, Fit: FitContain})
+		assert.Equal(t, imageData, resized)
+	})
+}
+
+func TestResizeGIF(t *testing.T) {
+	gifImageData := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 200, 100), palette.Plan9),
+			// 일부 영역만 갱신하는 프레임
+			image.NewPaletted(image.Rect(100, 50, 150, 100), palette.Plan9),
+			// fill로 잘려나가는 영역만 갱신하는 프레임
+			image.NewPaletted(image.Rect(0, 0, 20, 20), palette.Plan9),
+		},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 200, Height: 100},
+	}
+
+	resized := ResizeGIF(gifImageData, ResizeOptions{Width: 50, Height: 50, Fit: FitFill})
+	assert.Equal(t, 50, resized.Config.Width)
+	assert.Equal(t, 50, resized.Config.Height)
+	// 잘려나가는 프레임도 타이밍을 유지하기 위해 남아있어야한다.
+	assert.Len(t, resized.Image, 3)
+	assert.Equal(t, []int{10, 20, 30}, resized.Delay)
+	assert.Equal(t, image.Rect(0, 0, 50, 50), resized.Image[0].Bounds())
+	// 가운데 아래 영역은 fill로 잘린 뒤에는 오른쪽 아래에 위치한다.
+	assert.Equal(t, image.Rect(25, 25, 50, 50), resized.Image[1].Bounds())
+	assert.Equal(t, image.Rect(0, 0, 1, 1), resized.Image[2].Bounds())
+
+	t.Run("pad는_여백을_배경색으로_채운다", func(t *testing.T) {
+		background := color.NRGBA{R: 12, G: 34, B: 56, A: 255}
+		gifImageData := &gif.GIF{
+			Image: []*image.Paletted{
+				image.NewPaletted(image.Rect(0, 0, 200, 100), color.Palette{color.Black}),
+				image.NewPaletted(image.Rect(100, 50, 150, 100), color.Palette{color.Black}),
+			},
+			Delay:    []int{10, 20},
+			Disposal: []byte{gif.DisposalBackground, gif.DisposalNone},
+			Config:   image.Config{Width: 200, Height: 100},
+		}
+
+		resized := ResizeGIF(gifImageData, ResizeOptions{Width: 50, Height: 50, Fit: FitPad, Background: background})
+		assert.Equal(t, image.Rect(0, 0, 50, 50), resized.Image[0].Bounds())
+		assert.Equal(t, color.RGBAModel.Convert(background), color.RGBAModel.Convert(resized.Image[0].At(25, 0)))
+		assert.Equal(t, color.RGBAModel.Convert(background), color.RGBAModel.Convert(resized.Image[0].At(25, 49)))
+		assert.Equal(t, color.RGBAModel.Convert(color.Black), color.RGBAModel.Convert(resized.Image[0].At(25, 25)))
+		// 첫 프레임을 폐기하면 여백도 지워지므로 남겨둬야한다.
+		assert.Equal(t, []byte{gif.DisposalNone, gif.DisposalNone}, resized.Disposal)
+	})
+}
+
+func TestResizeOptions_Validate(t *testing.T) {
+	assert.Error(t, ResizeOptions{Fit: FitWidth}.Validate())
+	assert.Error(t, ResizeOptions{Width: 100, Fit: FitFill}.Validate())
+	assert.Error(t, ResizeOptions{Width: 100, Height: 100, Fit: "crop"}.Validate())
+	assert.NoError(t, ResizeOptions{Height: 100, Fit: FitHeight}.Validate())
+}
+
+func TestParseHexColor(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected color.NRGBA
+		isError  bool
+	}{
+		{input: "#fff", expected: color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{input: "#102030", expected: color.NRGBA{R: 16, G: 32, B: 48, A: 255}},
+		{input: "10203040", expected: color.NRGBA{R: 16, G: 32, B: 48, A: 64}},
+		{input: "#12", isError: true},
+		{input: "#gggggg", isError: true},
+	} {
+		c, err := ParseHexColor(tc.input)
+		if tc.isError {
+			assert.ErrorIs(t, err, ErrInvalidColor)
+		} else {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, c)
+		}
+	}
+}
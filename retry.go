@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RetryPolicy.Multiplier를 지정하지 않았을 때 재시도마다 대기 시간에 곱하는 값
+	defaultRetryMultiplier = 2
+	deadLetterMetaSuffix   = ".json"
+	deadLetterDataSuffix   = ".data"
+)
+
+var (
+	// Config.DeadLetter.Enabled인 경우에만 사용된다.
+	DeadLetters *DeadLetterStore
+
+	ErrInvalidRetryPolicy = errors.New("잘못된 재시도 정책입니다.")
+	ErrDeadLetterNotFound = errors.New("해당 dead letter를 찾을 수 없습니다.")
+	ErrDeadLetterDisabled = errors.New("dead letter를 사용하지 않습니다.")
+	ErrDeadLetterOrphaned = errors.New("원본 이미지가 삭제되어 dead letter를 다시 업로드하지 않고 지웠습니다.")
+	deadLetterIDPattern   = regexp.MustCompile(`^[0-9A-Za-z-]+$`)
+)
+
+// 저장소 업로드가 실패했을 때 재시도하는 정책. 재시도 사이의 대기 시간은
+// InitialBackoff부터 Multiplier배씩 늘어나고 MaxBackoff를 넘지 않는다.
+type RetryPolicy struct {
+	// 첫 시도를 포함한 최대 시도 횟수. 0이면 재시도하지 않는다.
+	MaxAttempts int
+	// 첫 재시도 전 대기 시간(ms)
+	InitialBackoff int
+	// 대기 시간의 상한(ms). 0이면 제한하지 않는다.
+	MaxBackoff int
+	// 재시도마다 대기 시간에 곱하는 값. 0이면 2
+	Multiplier float64
+	// 대기 시간을 무작위로 줄이는 비율(0~1). 0.2이면 계산된 대기 시간의 80~100%만큼 기다린다.
+	// 여러 작업이 같은 시점에 한꺼번에 재시도하지 않도록 한다.
+	Jitter float64
+}
+
+// 재시도를 모두 실패한 업로드 작업을 보관할 곳
+type DeadLetterConfig struct {
+	Enabled bool
+	// dead letter들을 저장할 디렉토리
+	Path string
+}
+
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.InitialBackoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("%w maxAttempts, initialBackoff, maxBackoff는 0 이상이어야합니다", ErrInvalidRetryPolicy)
+	}
+	if p.Multiplier != 0 && p.Multiplier < 1 {
+		return fmt.Errorf("%w multiplier는 1 이상이어야합니다", ErrInvalidRetryPolicy)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("%w jitter는 0~1이어야합니다", ErrInvalidRetryPolicy)
+	}
+	return nil
+}
+
+func (c *DeadLetterConfig) Validate() error {
+	if c.Enabled && c.Path == "" {
+		return fmt.Errorf("%w deadLetter.path는 필수입니다", ErrInvalidRetryPolicy)
+	}
+	return nil
+}
+
+// override에서 지정한 값(0이 아닌 값)만 덮어쓴 정책을 반환한다.
+func (p RetryPolicy) Merge(override RetryPolicy) RetryPolicy {
+	if override.MaxAttempts != 0 {
+		p.MaxAttempts = override.MaxAttempts
+	}
+	if override.InitialBackoff != 0 {
+		p.InitialBackoff = override.InitialBackoff
+	}
+	if override.MaxBackoff != 0 {
+		p.MaxBackoff = override.MaxBackoff
+	}
+	if override.Multiplier != 0 {
+		p.Multiplier = override.Multiplier
+	}
+	if override.Jitter != 0 {
+		p.Jitter = override.Jitter
+	}
+	return p
+}
+
+// failures번 실패한 뒤 다시 시도할 수 있는지
+func (p RetryPolicy) ShouldRetry(failures int) bool {
+	return failures < p.MaxAttempts
+}
+
+// failures번 실패한 뒤 다음 시도까지 기다릴 시간
+func (p RetryPolicy) Backoff(failures int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = defaultRetryMultiplier
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(failures-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff -= backoff * p.Jitter * mathrand.Float64()
+	return time.Duration(backoff * float64(time.Millisecond))
+}
+
+// 업로드에 실패한 시도 하나
+type UploadFailure struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// 재시도를 모두 실패한 업로드 작업. 인코딩된 파일은 별도의 파일에 저장된다.
+type DeadLetter struct {
+	ID             string          `json:"id"`
+	Key            string          `json:"key"`
+	ContentType    string          `json:"content_type"`
+	HashedFileName string          `json:"hashed_file_name"`
+	Variant        string          `json:"variant"`
+	Size           int             `json:"size"`
+	Failures       []UploadFailure `json:"failures"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// dead letter들을 디렉토리에 <id>.json(정보)과 <id>.data(인코딩된 파일)로 저장한다.
+type DeadLetterStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+func OpenDeadLetterStore(dir string) (*DeadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{dir: dir}, nil
+}
+
+// 인코딩된 파일을 먼저 기록한 뒤 정보를 기록하므로 정보가 있는 dead letter는 항상 파일도 있다.
+func (s *DeadLetterStore) Add(task *ImageUploadTask) (*DeadLetter, error) {
+	id, err := newDeadLetterID()
+	if err != nil {
+		return nil, err
+	}
+	letter := &DeadLetter{
+		ID:             id,
+		Key:            task.Key(),
+		ContentType:    ContentTypeOf(task.Extension),
+		HashedFileName: task.HashedFileName,
+		Variant:        task.Variant,
+		Size:           len(task.RawData),
+		Failures:       task.Failures,
+		CreatedAt:      time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeFileAtomic(s.path(id, deadLetterDataSuffix), task.RawData); err != nil {
+		return nil, err
+	}
+	if err := s.writeLocked(letter); err != nil {
+		os.Remove(s.path(id, deadLetterDataSuffix))
+		return nil, err
+	}
+	return letter, nil
+}
+
+// 모든 dead letter를 만들어진 순서로 반환한다.
+func (s *DeadLetterStore) List() ([]*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), deadLetterMetaSuffix) {
+			continue
+		}
+		letter, err := s.readLocked(strings.TrimSuffix(entry.Name(), deadLetterMetaSuffix))
+		if err != nil {
+			logrus.Errorf("dead letter를 읽을 수 없습니다. file=%s, err=%v", entry.Name(), err)
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].CreatedAt.Before(letters[j].CreatedAt) })
+	return letters, nil
+}
+
+// dead letter와 인코딩된 파일을 반환한다.
+func (s *DeadLetterStore) Get(id string) (*DeadLetter, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, err := s.readLocked(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(s.path(id, deadLetterDataSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+	return letter, data, nil
+}
+
+// 다시 업로드하는 데에 실패한 기록을 추가한다.
+func (s *DeadLetterStore) AddFailure(id string, failure UploadFailure) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	letter, err := s.readLocked(id)
+	if err != nil {
+		return err
+	}
+	letter.Failures = append(letter.Failures, failure)
+	return s.writeLocked(letter)
+}
+
+func (s *DeadLetterStore) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.readLocked(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(id, deadLetterMetaSuffix)); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(id, deadLetterDataSuffix)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *DeadLetterStore) readLocked(id string) (*DeadLetter, error) {
+	if !deadLetterIDPattern.MatchString(id) {
+		return nil, ErrDeadLetterNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(id, deadLetterMetaSuffix))
+	if os.IsNotExist(err) {
+		return nil, ErrDeadLetterNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(data, letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func (s *DeadLetterStore) writeLocked(letter *DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(letter.ID, deadLetterMetaSuffix), data)
+}
+
+func (s *DeadLetterStore) path(id, suffix string) string {
+	return filepath.Join(s.dir, id+suffix)
+}
+
+// 만들어진 순서대로 정렬되는 id (e.g. 20211003T120000-000-1a2b3c4d)
+func newDeadLetterID() (string, error) {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return strings.Replace(time.Now().UTC().Format("20060102T150405.000"), ".", "-", 1) + "-" + hex.EncodeToString(random), nil
+}
+
+// 임시 파일에 기록한 뒤 이름을 바꿔 중간에 종료되더라도 일부만 기록된 파일이 남지 않도록 한다.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := writeFileSync(tmp, data); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// dead letter 목록을 조회한다. (GET /api/admin/dead-letters)
+func DeadLetterListRequestHandler(c echo.Context) error {
+	if DeadLetters == nil {
+		return c.JSON(404, BaseResponse{Message: ErrDeadLetterDisabled.Error()})
+	}
+	letters, err := DeadLetters.List()
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	return c.JSON(200, BaseResponse{Data: letters})
+}
+
+// dead letter의 파일을 저장소에 다시 업로드하고, 성공하면 dead letter를 지운다. (POST /api/admin/dead-letters/:id/replay)
+// 그 사이 이미지가 삭제되어 원본이 없으면 삭제된 variant를 다시 만들지 않도록 dead letter를 지우고 410으로 응답한다.
+func DeadLetterReplayRequestHandler(c echo.Context) error {
+	if DeadLetters == nil {
+		return c.JSON(404, BaseResponse{Message: ErrDeadLetterDisabled.Error()})
+	}
+	id := c.Param("id")
+	letter, data, err := DeadLetters.Get(id)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		return c.JSON(404, BaseResponse{Message: err.Error()})
+	} else if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	// 원본의 dead letter는 원본이 업로드되지 않았으므로 확인하지 않는다.
+	if letter.Variant != "original" {
+		if _, err := findOriginalKey(ImageStorage, letter.HashedFileName); errors.Is(err, ErrImageNotFound) {
+			if err := DeadLetters.Remove(id); err != nil {
+				logrus.Error(err)
+			}
+			logrus.Warnf("원본 이미지가 삭제되어 dead letter를 지웠습니다. id=%s, key=%s", id, letter.Key)
+			return c.JSON(410, BaseResponse{Message: ErrDeadLetterOrphaned.Error()})
+		} else if err != nil {
+			logrus.Error(err)
+			return c.JSON(500, BaseResponse{Message: err.Error()})
+		}
+	}
+
+	if err := ImageStorage.Put(letter.Key, bytes.NewReader(data), letter.ContentType); err != nil {
+		logrus.Errorf("dead letter를 다시 업로드하지 못했습니다. id=%s, key=%s, err=%v", id, letter.Key, err)
+		if err := DeadLetters.AddFailure(id, UploadFailure{At: time.Now(), Error: err.Error()}); err != nil {
+			logrus.Error(err)
+		}
+		return c.JSON(502, BaseResponse{Message: err.Error()})
+	}
+	if err := DeadLetters.Remove(id); err != nil {
+		logrus.Error(err)
+	}
+	Jobs.SetStatus(letter.HashedFileName, letter.Variant, JobStatusDone)
+	logrus.Infof("dead letter를 다시 업로드했습니다. id=%s, key=%s", id, letter.Key)
+	return c.JSON(200, BaseResponse{Data: letter})
+}
+
+// dead letter를 업로드하지 않고 지운다. (DELETE /api/admin/dead-letters/:id)
+func DeadLetterDiscardRequestHandler(c echo.Context) error {
+	if DeadLetters == nil {
+		return c.JSON(404, BaseResponse{Message: ErrDeadLetterDisabled.Error()})
+	}
+	id := c.Param("id")
+	err := DeadLetters.Remove(id)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		return c.JSON(404, BaseResponse{Message: err.Error()})
+	} else if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	logrus.Infof("dead letter를 지웠습니다. id=%s", id)
+	return c.JSON(200, BaseResponse{Message: "삭제했습니다."})
+}
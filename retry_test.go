@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 처음 failures번의 Put은 실패하는 저장소
+type flakyPutStorage struct {
+	Storage
+	mu       sync.Mutex
+	failures int
+	puts     int
+}
+
+func (s *flakyPutStorage) Put(key string, body io.Reader, contentType string) error {
+	s.mu.Lock()
+	s.puts++
+	fail := s.puts <= s.failures
+	s.mu.Unlock()
+	if fail {
+		return errors.New("일시적인 업로드 실패")
+	}
+	return s.Storage.Put(key, body, contentType)
+}
+
+func newTestUploadTask(hashedFileName string) *ImageUploadTask {
+	return &ImageUploadTask{
+		BaseImageTask: &BaseImageTask{HashedFileName: hashedFileName, Extension: "png"},
+		UploadPath:    "original",
+		Variant:       "original",
+		RawData:       []byte("encoded"),
+		Retry:         RetryPolicy{MaxAttempts: 3, InitialBackoff: 1},
+	}
+}
+
+func waitForJobFinished(t *testing.T, hashedFileName string) *Job {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		job, err := Jobs.Get(hashedFileName)
+		assert.NoError(t, err)
+		if job.isFinished() || time.Now().After(deadline) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100, MaxBackoff: 500}
+	assert.Equal(t, 100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Backoff(2))
+	assert.Equal(t, 400*time.Millisecond, policy.Backoff(3))
+	assert.Equal(t, 500*time.Millisecond, policy.Backoff(4))
+	assert.True(t, policy.ShouldRetry(4))
+	assert.False(t, policy.ShouldRetry(5))
+
+	policy.Multiplier, policy.Jitter = 3, 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert.True(t, backoff >= 150*time.Millisecond && backoff <= 300*time.Millisecond, backoff)
+	}
+	// 설정하지 않으면 재시도하지 않는다.
+	assert.False(t, RetryPolicy{}.ShouldRetry(1))
+}
+
+func TestRetryPolicy_Merge(t *testing.T) {
+	global := RetryPolicy{MaxAttempts: 5, InitialBackoff: 500, MaxBackoff: 30000, Multiplier: 2, Jitter: 0.5}
+	assert.Equal(t, RetryPolicy{MaxAttempts: 10, InitialBackoff: 500, MaxBackoff: 30000, Multiplier: 2, Jitter: 0.5}, global.Merge(RetryPolicy{MaxAttempts: 10}))
+
+	assert.NoError(t, global.Validate())
+	assert.ErrorIs(t, (&RetryPolicy{MaxAttempts: -1}).Validate(), ErrInvalidRetryPolicy)
+	assert.ErrorIs(t, (&RetryPolicy{Multiplier: 0.5}).Validate(), ErrInvalidRetryPolicy)
+	assert.ErrorIs(t, (&RetryPolicy{Jitter: 1.5}).Validate(), ErrInvalidRetryPolicy)
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	store, err := OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	task := newTestUploadTask("abcd")
+	task.Failures = []UploadFailure{{At: time.Now(), Error: "실패"}}
+
+	letter, err := store.Add(task)
+	assert.NoError(t, err)
+	assert.Equal(t, "original/abcd.png", letter.Key)
+	assert.Equal(t, "image/png", letter.ContentType)
+	second, err := store.Add(newTestUploadTask("efgh"))
+	assert.NoError(t, err)
+
+	letters, err := store.List()
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 2) {
+		assert.Equal(t, letter.ID, letters[0].ID)
+		assert.Equal(t, second.ID, letters[1].ID)
+	}
+
+	assert.NoError(t, store.AddFailure(letter.ID, UploadFailure{At: time.Now(), Error: "다시 실패"}))
+	stored, data, err := store.Get(letter.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("encoded"), data)
+	assert.Len(t, stored.Failures, 2)
+
+	assert.NoError(t, store.Remove(letter.ID))
+	_, _, err = store.Get(letter.ID)
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound)
+	assert.ErrorIs(t, store.Remove("../"+second.ID), ErrDeadLetterNotFound)
+}
+
+func TestStorageUploader_Retry(t *testing.T) {
+	originalDeadLetters := DeadLetters
+	t.Cleanup(func() { DeadLetters = originalDeadLetters })
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+
+	t.Run("재시도_후_성공", func(t *testing.T) {
+		storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 2}
+		taskChan := make(chan *ImageUploadTask, 1)
+		done := new(sync.WaitGroup)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done.Add(1)
+		go NewStorageUploader(taskChan, storage, done).Start(ctx)
+		Jobs.Register("retry-success", "original")
+		taskChan <- newTestUploadTask("retry-success")
+
+		job := waitForJobFinished(t, "retry-success")
+		assert.Equal(t, JobStatusDone, job.Status)
+		assert.Equal(t, 3, storage.puts)
+		_, err := storage.Stat("original/retry-success.png")
+		assert.NoError(t, err)
+	})
+
+	t.Run("dead_letter", func(t *testing.T) {
+		storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 100}
+		taskChan := make(chan *ImageUploadTask, 1)
+		done := new(sync.WaitGroup)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		done.Add(1)
+		go NewStorageUploader(taskChan, storage, done).Start(ctx)
+		Jobs.Register("retry-dead", "original")
+		taskChan <- newTestUploadTask("retry-dead")
+
+		job := waitForJobFinished(t, "retry-dead")
+		assert.Equal(t, JobStatusFailed, job.Status)
+		assert.Equal(t, 3, storage.puts)
+		letters, err := DeadLetters.List()
+		assert.NoError(t, err)
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, "original/retry-dead.png", letters[0].Key)
+			assert.Len(t, letters[0].Failures, 3)
+			assert.Contains(t, job.Variants["original"].Error, letters[0].ID)
+		}
+	})
+}
+
+func TestDeadLetterRequestHandlers(t *testing.T) {
+	originalConfig, originalDeadLetters, originalStorage := Config, DeadLetters, ImageStorage
+	t.Cleanup(func() { Config, DeadLetters, ImageStorage = originalConfig, originalDeadLetters, originalStorage })
+	Config = &BumblebeeConfig{}
+	Config.Admin.Token = "admin-token"
+	storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 1}
+	ImageStorage = storage
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	letter, err := DeadLetters.Add(newTestUploadTask("dead-letter-http"))
+	assert.NoError(t, err)
+	discarded, err := DeadLetters.Add(newTestUploadTask("dead-letter-discard"))
+	assert.NoError(t, err)
+	e := NewEcho()
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", "/api/admin/dead-letters")
+	assert.Equal(t, 200, rec.Code)
+	resp := struct {
+		Data []*DeadLetter `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Len(t, resp.Data, 2)
+
+	// 다시 업로드에 실패하면 기록을 남기고 보관한다.
+	assert.Equal(t, 502, serve("POST", "/api/admin/dead-letters/"+letter.ID+"/replay").Code)
+	stored, _, err := DeadLetters.Get(letter.ID)
+	assert.NoError(t, err)
+	assert.Len(t, stored.Failures, 1)
+
+	assert.Equal(t, 200, serve("POST", "/api/admin/dead-letters/"+letter.ID+"/replay").Code)
+	object, _, err := storage.Get("original/dead-letter-http.png")
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(object)
+		object.Close()
+		assert.Equal(t, []byte("encoded"), data)
+	}
+	assert.Equal(t, 404, serve("POST", "/api/admin/dead-letters/"+letter.ID+"/replay").Code)
+
+	// 원본이 삭제된 이미지의 variant는 다시 업로드하지 않고 dead letter를 지운다.
+	orphanTask := newTestUploadTask("dead-letter-orphan")
+	orphanTask.UploadPath, orphanTask.Variant = "thumbnail", "thumbnail"
+	orphan, err := DeadLetters.Add(orphanTask)
+	assert.NoError(t, err)
+	assert.Equal(t, 410, serve("POST", "/api/admin/dead-letters/"+orphan.ID+"/replay").Code)
+	_, err = storage.Stat("thumbnail/dead-letter-orphan.png")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, _, err = DeadLetters.Get(orphan.ID)
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound)
+	// 원본이 남아있으면 다시 업로드한다.
+	variantTask := newTestUploadTask("dead-letter-http")
+	variantTask.UploadPath, variantTask.Variant = "thumbnail", "thumbnail"
+	variant, err := DeadLetters.Add(variantTask)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, serve("POST", "/api/admin/dead-letters/"+variant.ID+"/replay").Code)
+	_, err = storage.Stat("thumbnail/dead-letter-http.png")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 200, serve("DELETE", "/api/admin/dead-letters/"+discarded.ID).Code)
+	assert.Equal(t, 404, serve("DELETE", "/api/admin/dead-letters/"+discarded.ID).Code)
+
+	req := httptest.NewRequest("GET", "/api/admin/dead-letters", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, 401, rec.Code)
+}
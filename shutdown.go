@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// 작업을 채널로 보내는 goroutine(durable queue 복구)들이 모두 끝났는지를 관리하는 WaitGroup
+	dispatcherWG = new(sync.WaitGroup)
+
+	// 시간 안에 끝나지 않아 Uploader를 멈출 때 처리 중인 업로드를 기다리는 최대 시간
+	uploaderStopTimeout = 5 * time.Second
+
+	ErrShutdownTimeout = errors.New("graceful shutdown의 max timeout 안에 처리하지 못했습니다.")
+)
+
+// graceful shutdown 시에 각 단계의 워커들을 종료시키는 함수들
+type ShutdownHooks struct {
+	StopDispatchers  context.CancelFunc
+	StopTransformers context.CancelFunc
+	StopUploaders    context.CancelFunc
+}
+
+// 종료 신호를 받은 뒤 다음 순서로 작업들을 마무리한다. 모든 단계는 Config.GracefulShutdown.MaxTimeout 안에 끝나야한다.
+//  1. 새 HTTP 요청을 받지 않고, 처리 중인 요청을 마무리한다.
+//  2. 작업을 채널로 보내는 goroutine들을 멈춘다. 보내지 못한 작업은 durable queue에 남는다.
+//  3. Transformer들이 채널에 남은 변환 작업을 처리한다.
+//  4. Uploader가 채널에 남은 업로드 작업과 재시도를 기다리는 작업을 처리한다.
+//
+// 시간 안에 끝나지 않으면 Uploader를 멈춘 뒤 남은 작업들을 보관하거나 보고하고 false를 반환한다.
+func Shutdown(e *echo.Echo, hooks ShutdownHooks) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(Config.GracefulShutdown.MaxTimeout)*time.Second)
+	defer cancel()
+
+	logrus.Info("새 요청을 받지 않고 처리 중인 요청을 마무리합니다.")
+	if err := e.Shutdown(ctx); err != nil {
+		logrus.Error(err)
+	}
+	hooks.StopDispatchers()
+	ok := waitWorkers(ctx, "Dispatcher", dispatcherWG, nil)
+	if ok {
+		hooks.StopTransformers()
+		ok = waitWorkers(ctx, "Transformer", transformerWorkersWG, func() int {
+			return len(ResizeTaskChan) + len(ThumbnailTaskChan)
+		})
+	}
+	if ok {
+		hooks.StopUploaders()
+		ok = waitWorkers(ctx, "Uploader", uploaderWorkersWG, UploaderWorker.Pending)
+	}
+	if !ok {
+		stopUploader()
+		ReportUnfinishedWork()
+	}
+	return ok
+}
+
+// Uploader가 채널에서 더 이상 작업을 가져가지 않도록 멈추고 처리 중인 업로드가 끝나기를 잠시 기다린다.
+func stopUploader() {
+	if UploaderWorker == nil {
+		return
+	}
+	UploaderWorker.Stop()
+	stopped := make(chan struct{})
+	go func() {
+		uploaderWorkersWG.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		logrus.Info("Uploader를 멈췄습니다.")
+	case <-time.After(uploaderStopTimeout):
+		// 처리 중인 업로드가 끝나더라도 Uploader는 채널에서 작업을 더 가져가지 않는다.
+		logrus.Errorf("%v 안에 처리 중인 업로드가 끝나지 않았습니다. 남은 작업 수=%d", uploaderStopTimeout, UploaderWorker.Pending())
+	}
+}
+
+// wg의 워커들이 모두 종료될 때까지 기다리며 1초마다 남은 작업 수를 기록한다. ctx가 먼저 끝나면 false를 반환한다.
+func waitWorkers(ctx context.Context, name string, wg *sync.WaitGroup, remaining func() int) bool {
+	completed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(completed)
+	}()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-completed:
+			logrus.Infof("%s 워커들이 모두 종료되었습니다.", name)
+			return true
+		case <-ticker.C:
+			if remaining != nil {
+				logrus.Infof("%s 워커들의 종료를 기다립니다. 남은 작업 수=%d", name, remaining())
+			}
+		case <-ctx.Done():
+			logrus.Errorf("Graceful shutdown의 Max timeout인 %d초가 경과되었음에도 %s 워커들이 작업을 모두 완료하지 못했습니다.", Config.GracefulShutdown.MaxTimeout, name)
+			return false
+		}
+	}
+}
+
+// 시간 안에 처리하지 못한 작업들을 버리지 않고 보관하거나 보고한다.
+// 업로드 채널에 남아있는 인코딩된 작업은 dead letter로 보관한다.
+// 그 외의 작업은 durable queue를 사용하면 재시작 후 다시 처리되고, 사용하지 않으면 log로 보고된다.
+// 업로드 채널을 Uploader와 동시에 비우지 않도록 Uploader를 멈춘 뒤에 호출해야한다.
+func ReportUnfinishedWork() {
+	for drained := false; !drained; {
+		select {
+		case task := <-UploadTaskChan:
+			persistUnfinishedUpload(task)
+		default:
+			drained = true
+		}
+	}
+
+	unfinished := Jobs.Unfinished()
+	names := make([]string, 0, len(unfinished))
+	for name := range unfinished {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if DurableTaskQueue != nil {
+			logrus.Warnf("완료되지 않은 작업은 재시작 후 다시 처리됩니다. name=%s, variants=%v", name, unfinished[name])
+		} else {
+			logrus.Errorf("완료되지 않은 작업을 처리하지 못하고 종료합니다. name=%s, variants=%v", name, unfinished[name])
+		}
+	}
+}
+
+func persistUnfinishedUpload(task *ImageUploadTask) {
+	// 인코딩 전의 작업은 durable queue에 남아있는 원본으로 다시 만들 수 있다.
+	if task.RawData == nil {
+		if DurableTaskQueue != nil {
+			logrus.Warnf("인코딩하지 못한 업로드 작업은 재시작 후 다시 처리됩니다. name=%s, variant=%s", task.HashedFileName, task.Variant)
+		} else {
+			logrus.Errorf("인코딩하지 못한 업로드 작업을 버립니다. name=%s, variant=%s", task.HashedFileName, task.Variant)
+		}
+		return
+	}
+	if DeadLetters == nil {
+		logrus.Errorf("dead letter를 사용하지 않아 업로드하지 못한 작업을 버립니다. name=%s, variant=%s, key=%s", task.HashedFileName, task.Variant, task.Key())
+		return
+	}
+	task.Failures = append(task.Failures, UploadFailure{At: time.Now(), Error: ErrShutdownTimeout.Error()})
+	letter, err := DeadLetters.Add(task)
+	if err != nil {
+		logrus.Errorf("dead letter를 저장하지 못했습니다. key=%s, err=%v", task.Key(), err)
+		return
+	}
+	logrus.Warnf("업로드하지 못한 작업을 dead letter로 보관합니다. key=%s, id=%s", task.Key(), letter.ID)
+	Jobs.SetFailed(task.HashedFileName, task.Variant, ErrShutdownTimeout)
+	FinishAdmittedVariants(task.BaseImageTask, 1)
+}
+
+// 종료 전에 디스크에 기록 중인 저장소들을 닫고 남은 span들을 내보낸다.
+func CloseResources() {
+	if DurableTaskQueue != nil {
+		if err := DurableTaskQueue.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if UploadQuotas != nil {
+		if err := UploadQuotas.Close(); err != nil {
+			logrus.Error(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	defer cancel()
+	if err := ShutdownTracing(ctx); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitWorkers(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.False(t, waitWorkers(ctx, "test", wg, func() int { return 1 }))
+
+	wg.Done()
+	assert.True(t, waitWorkers(context.Background(), "test", wg, nil))
+}
+
+func TestShutdown(t *testing.T) {
+	originalConfig, originalUploader, originalChan := Config, UploaderWorker, UploadTaskChan
+	t.Cleanup(func() { Config, UploaderWorker, UploadTaskChan = originalConfig, originalUploader, originalChan })
+	Config = &BumblebeeConfig{}
+	Config.GracefulShutdown.MaxTimeout = 5
+	UploadTaskChan = make(chan *ImageUploadTask, 2)
+	storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 1}
+
+	transformerCtx, stopTransformers := context.WithCancel(context.Background())
+	uploaderCtx, stopUploaders := context.WithCancel(context.Background())
+	transformerWorkersWG.Add(1)
+	go NewTransformer(make(chan *ImageResizeTask), make(chan *ImageGenerateThumbnailTask), UploadTaskChan, transformerWorkersWG).Start(transformerCtx)
+	UploaderWorker = NewStorageUploader(UploadTaskChan, storage, uploaderWorkersWG)
+	uploaderWorkersWG.Add(1)
+	go UploaderWorker.Start(uploaderCtx)
+	Jobs.Register("shutdown", "original")
+	task := newTestUploadTask("shutdown")
+	task.Retry.InitialBackoff = 100
+	UploadTaskChan <- task
+
+	// 재시도를 기다리는 업로드 작업까지 처리한 뒤 종료한다.
+	assert.True(t, Shutdown(NewEcho(), ShutdownHooks{
+		StopDispatchers:  func() {},
+		StopTransformers: stopTransformers,
+		StopUploaders:    stopUploaders,
+	}))
+	job, err := Jobs.Get("shutdown")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusDone, job.Status)
+	assert.Equal(t, 0, UploaderWorker.Pending())
+}
+
+func TestShutdown_Timeout(t *testing.T) {
+	originalConfig, originalUploader, originalChan, originalDeadLetters := Config, UploaderWorker, UploadTaskChan, DeadLetters
+	t.Cleanup(func() {
+		Config, UploaderWorker, UploadTaskChan, DeadLetters = originalConfig, originalUploader, originalChan, originalDeadLetters
+	})
+	Config = &BumblebeeConfig{}
+	Config.GracefulShutdown.MaxTimeout = 1
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	UploadTaskChan = make(chan *ImageUploadTask, 2)
+	storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 1}
+
+	uploaderCtx, stopUploaders := context.WithCancel(context.Background())
+	UploaderWorker = NewStorageUploader(UploadTaskChan, storage, uploaderWorkersWG)
+	uploaderWorkersWG.Add(1)
+	go UploaderWorker.Start(uploaderCtx)
+	Jobs.Register("shutdown-timeout", "original")
+	task := newTestUploadTask("shutdown-timeout")
+	// 재시도를 기다리는 동안 max timeout이 지난다.
+	task.Retry.InitialBackoff = 60 * 1000
+	UploadTaskChan <- task
+
+	assert.False(t, Shutdown(NewEcho(), ShutdownHooks{
+		StopDispatchers:  func() {},
+		StopTransformers: func() {},
+		StopUploaders:    stopUploaders,
+	}))
+	// Uploader를 멈춘 뒤 재시도를 기다리던 작업을 dead letter로 보관한다.
+	assert.Equal(t, 0, UploaderWorker.Pending())
+	letters, err := DeadLetters.List()
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "original/shutdown-timeout.png", letters[0].Key)
+	}
+	job, err := Jobs.Get("shutdown-timeout")
+	assert.NoError(t, err)
+	assert.Equal(t, JobStatusFailed, job.Status)
+}
+
+func TestStorageUploader_Stop_FiredRetry(t *testing.T) {
+	originalDeadLetters := DeadLetters
+	t.Cleanup(func() { DeadLetters = originalDeadLetters })
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	uploader := NewStorageUploader(make(chan *ImageUploadTask, 1), NewDiskStorage(t.TempDir(), 0), new(sync.WaitGroup)).(*StorageUploader)
+	Jobs.Register("fired-retry", "original")
+
+	uploader.scheduleRetry(newTestUploadTask("fired-retry"), time.Millisecond)
+	// timer가 실행되어 lock을 기다리는 동안 Stop이 uploader를 멈춘다.
+	uploader.mu.Lock()
+	time.Sleep(50 * time.Millisecond)
+	uploader.stopOnce.Do(func() { close(uploader.stopped) })
+	uploader.mu.Unlock()
+
+	// 채널로 보내지 않고 dead letter로 보관한다.
+	job := waitForJobFinished(t, "fired-retry")
+	assert.Equal(t, JobStatusFailed, job.Status)
+	assert.Len(t, uploader.UploadTaskChan, 0)
+	assert.Equal(t, 0, uploader.Pending())
+	letters, err := DeadLetters.List()
+	assert.NoError(t, err)
+	assert.Len(t, letters, 1)
+}
+
+func TestReportUnfinishedWork(t *testing.T) {
+	originalDeadLetters, originalChan := DeadLetters, UploadTaskChan
+	t.Cleanup(func() { DeadLetters, UploadTaskChan = originalDeadLetters, originalChan })
+	var err error
+	DeadLetters, err = OpenDeadLetterStore(t.TempDir())
+	assert.NoError(t, err)
+	UploadTaskChan = make(chan *ImageUploadTask, 2)
+	Jobs.Register("unfinished", "original", "thumbnail")
+	UploadTaskChan <- newTestUploadTask("unfinished")
+	// 인코딩 전의 작업은 실패 처리하지 않고 durable queue에서 다시 처리되도록 남겨둔다.
+	notEncoded := newTestUploadTask("unfinished")
+	notEncoded.UploadPath, notEncoded.Variant, notEncoded.RawData = "thumbnail", "thumbnail", nil
+	UploadTaskChan <- notEncoded
+
+	ReportUnfinishedWork()
+	assert.Len(t, UploadTaskChan, 0)
+	letters, err := DeadLetters.List()
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, "original/unfinished.png", letters[0].Key)
+		assert.Equal(t, ErrShutdownTimeout.Error(), letters[0].Failures[0].Error)
+	}
+	assert.Equal(t, []string{"thumbnail"}, Jobs.Unfinished()["unfinished"])
+}
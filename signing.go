@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 서명된 URL의 query parameter
+const (
+	signatureParam     = "sig"
+	signatureKeyParam  = "kid"
+	signatureExpParam  = "exp"
+	onTheFlyPathPrefix = "/api/images/"
+)
+
+var (
+	ErrInvalidSigningConfig = errors.New("잘못된 URL 서명 설정입니다.")
+	ErrSigningKeyNotFound   = errors.New("URL 서명에 사용할 key가 없습니다.")
+	ErrInvalidSignature     = errors.New("URL의 서명이 올바르지 않습니다.")
+	ErrSignedURLExpired     = errors.New("만료된 URL입니다.")
+	ErrAdminTokenRequired   = errors.New("관리자 token이 필요합니다.")
+)
+
+// on-the-fly 변환 URL의 서명 설정
+// 서명은 이미지 이름과 sig를 제외한 모든 query parameter(변환 파라미터, kid, exp)에 대한 HMAC-SHA256이다.
+type URLSigningConfig struct {
+	// true이면 서명되지 않은 on-the-fly 변환 요청을 거부한다.
+	Enabled bool
+	// 새 URL을 서명할 때 사용할 key의 ID. 비어있으면 Keys의 첫 번째 key를 사용한다.
+	ActiveKeyID string
+	// 서명을 검증할 수 있는 key들. kid로 어떤 key로 서명되었는지 구분한다.
+	Keys []SigningKey
+	// 발급하는 URL의 기본 유효 시간(초). 0이면 만료되지 않는다.
+	DefaultTTL int
+}
+
+type SigningKey struct {
+	ID     string
+	Secret string
+}
+
+func (c *URLSigningConfig) Validate() error {
+	if c.DefaultTTL < 0 {
+		return fmt.Errorf("%w defaultTTL은 0 이상이어야합니다", ErrInvalidSigningConfig)
+	}
+	ids := make(map[string]bool, len(c.Keys))
+	for i, key := range c.Keys {
+		if key.ID == "" || key.Secret == "" {
+			return fmt.Errorf("%w keys[%d]: id와 secret은 필수입니다", ErrInvalidSigningConfig, i)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("%w keys[%d]: 중복된 id입니다. id=%s", ErrInvalidSigningConfig, i, key.ID)
+		}
+		ids[key.ID] = true
+	}
+	if c.Enabled && len(c.Keys) == 0 {
+		return fmt.Errorf("%w 서명을 사용하려면 key가 하나 이상 필요합니다", ErrInvalidSigningConfig)
+	}
+	if c.ActiveKeyID != "" && !ids[c.ActiveKeyID] {
+		return fmt.Errorf("%w activeKeyID에 해당하는 key가 없습니다. activeKeyID=%s", ErrInvalidSigningConfig, c.ActiveKeyID)
+	}
+	return nil
+}
+
+func (c *URLSigningConfig) key(id string) *SigningKey {
+	for i := range c.Keys {
+		if c.Keys[i].ID == id {
+			return &c.Keys[i]
+		}
+	}
+	return nil
+}
+
+// 새 URL을 서명할 때 사용할 key
+func (c *URLSigningConfig) activeKey() *SigningKey {
+	if c.ActiveKeyID != "" {
+		return c.key(c.ActiveKeyID)
+	}
+	if len(c.Keys) == 0 {
+		return nil
+	}
+	return &c.Keys[0]
+}
+
+// name의 이미지를 query의 파라미터로 변환하는 서명된 경로를 만든다. (e.g. /api/images/abcd.png?exp=...&kid=...&sig=...&w=100)
+// ttl이 0이면 만료되지 않는 URL을 만든다.
+func (c *URLSigningConfig) SignURL(name string, query url.Values, ttl time.Duration) (string, error) {
+	key := c.activeKey()
+	if key == nil {
+		return "", ErrSigningKeyNotFound
+	}
+	signed := url.Values{}
+	for k, v := range query {
+		if k != signatureParam && k != signatureKeyParam && k != signatureExpParam {
+			signed[k] = v
+		}
+	}
+	signed.Set(signatureKeyParam, key.ID)
+	if ttl > 0 {
+		signed.Set(signatureExpParam, strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	}
+	signed.Set(signatureParam, signature(key.Secret, name, signed))
+	return onTheFlyPathPrefix + url.PathEscape(name) + "?" + signed.Encode(), nil
+}
+
+// name과 query의 서명을 검증한다.
+func (c *URLSigningConfig) Verify(name string, query url.Values, now time.Time) error {
+	key := c.key(query.Get(signatureKeyParam))
+	if key == nil {
+		return fmt.Errorf("%w 알 수 없는 kid입니다. kid=%s", ErrInvalidSignature, query.Get(signatureKeyParam))
+	}
+	expected := signature(key.Secret, name, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(signatureParam))) {
+		return ErrInvalidSignature
+	}
+	if exp := query.Get(signatureExpParam); exp != "" {
+		unix, err := strconv.ParseInt(exp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w 잘못된 exp입니다. exp=%s", ErrInvalidSignature, exp)
+		}
+		if now.Unix() > unix {
+			return ErrSignedURLExpired
+		}
+	}
+	return nil
+}
+
+// name과 sig를 제외한 query를 정렬한 문자열에 대한 HMAC-SHA256
+// 같은 이미지를 확장자를 포함하거나 제외한 이름으로 요청할 수 있으므로 hashed file name을 서명한다.
+func signature(secret, name string, query url.Values) string {
+	canonical := url.Values{}
+	for k, v := range query {
+		if k != signatureParam {
+			canonical[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(hashedFileNameOf(name) + "\n" + canonical.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Config.Signing이 활성화되어있으면 서명되지 않았거나 만료된 요청을 403으로 거부한다.
+func VerifySignedURLMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !Config.Signing.Enabled {
+			return handlerFunc(c)
+		}
+		if err := Config.Signing.Verify(c.Param("name"), c.QueryParams(), time.Now()); err != nil {
+			logrus.Warnf("서명되지 않은 변환 요청을 거부합니다. uri=%s, err=%s", c.Request().RequestURI, err)
+			return c.JSON(403, BaseResponse{Message: err.Error()})
+		}
+		return handlerFunc(c)
+	}
+}
+
+// Authorization: Bearer <Config.Admin.Token> 헤더가 있는 요청만 허용한다.
+// Config.Admin.Token이 비어있으면 관리자 API를 사용할 수 없다.
+func AdminTokenMiddleware(handlerFunc echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if Config.Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(Config.Admin.Token)) != 1 {
+			return c.JSON(401, BaseResponse{Message: ErrAdminTokenRequired.Error()})
+		}
+		return handlerFunc(c)
+	}
+}
+
+// 서명된 URL 발급 요청
+type SignURLRequest struct {
+	FileName string            `json:"file_name"`
+	Params   map[string]string `json:"params"`
+	// 유효 시간(초). 생략하면 Config.Signing.DefaultTTL
+	ExpiresIn *int `json:"expires_in"`
+}
+
+// 백엔드 서비스가 클라이언트에게 전달할 on-the-fly 변환 URL을 발급한다. (POST /api/admin/signed-urls)
+// 응답의 url은 bumblebee의 주소를 제외한 경로이다.
+func SignURLRequestHandler(c echo.Context) error {
+	req := new(SignURLRequest)
+	if err := c.Bind(req); err != nil || req.FileName == "" {
+		return c.JSON(400, BaseResponse{Message: "file_name은 필수입니다."})
+	}
+	query := url.Values{}
+	for k, v := range req.Params {
+		query.Set(k, v)
+	}
+	// 잘못된 파라미터의 URL은 발급하지 않는다.
+	if _, err := ParseTransformParams(query); err != nil {
+		return c.JSON(400, BaseResponse{Message: err.Error()})
+	}
+	ttl := Config.Signing.DefaultTTL
+	if req.ExpiresIn != nil {
+		ttl = *req.ExpiresIn
+	}
+	if ttl < 0 {
+		return c.JSON(400, BaseResponse{Message: "expires_in은 0 이상이어야합니다."})
+	}
+
+	signedURL, err := Config.Signing.SignURL(req.FileName, query, time.Duration(ttl)*time.Second)
+	if err != nil {
+		logrus.Error(err)
+		return c.JSON(500, BaseResponse{Message: err.Error()})
+	}
+	return c.JSON(200, BaseResponse{Data: map[string]string{"url": signedURL}})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSigningConfig() URLSigningConfig {
+	return URLSigningConfig{
+		Enabled:     true,
+		ActiveKeyID: "new",
+		Keys:        []SigningKey{{ID: "old", Secret: "old-secret"}, {ID: "new", Secret: "new-secret"}},
+	}
+}
+
+func parseSignedURL(t *testing.T, signedURL string) (string, url.Values) {
+	u, err := url.Parse(signedURL)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(u.Path, onTheFlyPathPrefix))
+	return strings.TrimPrefix(u.Path, onTheFlyPathPrefix), u.Query()
+}
+
+func TestURLSigningConfig_Verify(t *testing.T) {
+	c := testSigningConfig()
+	signedURL, err := c.SignURL("abcd.png", url.Values{"w": {"100"}, "format": {"webp"}}, time.Hour)
+	assert.NoError(t, err)
+	name, query := parseSignedURL(t, signedURL)
+	assert.Equal(t, "new", query.Get("kid"))
+	assert.NoError(t, c.Verify(name, query, time.Now()))
+	// 확장자를 제외한 이름으로도 같은 서명을 사용할 수 있다.
+	assert.NoError(t, c.Verify("abcd", query, time.Now()))
+
+	t.Run("변조", func(t *testing.T) {
+		tampered := url.Values{}
+		for k, v := range query {
+			tampered[k] = v
+		}
+		tampered.Set("w", "2000")
+		assert.ErrorIs(t, c.Verify(name, tampered, time.Now()), ErrInvalidSignature)
+		assert.ErrorIs(t, c.Verify("efgh.png", query, time.Now()), ErrInvalidSignature)
+		tampered = url.Values{}
+		for k, v := range query {
+			tampered[k] = v
+		}
+		tampered.Set("exp", "9999999999")
+		assert.ErrorIs(t, c.Verify(name, tampered, time.Now()), ErrInvalidSignature)
+	})
+
+	t.Run("만료", func(t *testing.T) {
+		assert.ErrorIs(t, c.Verify(name, query, time.Now().Add(2*time.Hour)), ErrSignedURLExpired)
+	})
+
+	t.Run("key_교체", func(t *testing.T) {
+		// 이전 key로 서명된 URL은 이전 key가 남아있는 동안 유효하다.
+		old := testSigningConfig()
+		old.ActiveKeyID = "old"
+		signedURL, err := old.SignURL("abcd.png", url.Values{"w": {"100"}}, 0)
+		assert.NoError(t, err)
+		name, query := parseSignedURL(t, signedURL)
+		assert.Empty(t, query.Get("exp"))
+		assert.NoError(t, c.Verify(name, query, time.Now()))
+
+		c.Keys = c.Keys[1:]
+		assert.ErrorIs(t, c.Verify(name, query, time.Now()), ErrInvalidSignature)
+	})
+}
+
+func TestURLSigningConfig_Validate(t *testing.T) {
+	c := testSigningConfig()
+	assert.NoError(t, c.Validate())
+	assert.NoError(t, (&URLSigningConfig{}).Validate())
+	assert.ErrorIs(t, (&URLSigningConfig{Enabled: true}).Validate(), ErrInvalidSigningConfig)
+	assert.ErrorIs(t, (&URLSigningConfig{Keys: []SigningKey{{ID: "a"}}}).Validate(), ErrInvalidSigningConfig)
+	assert.ErrorIs(t, (&URLSigningConfig{Keys: []SigningKey{{ID: "a", Secret: "x"}, {ID: "a", Secret: "y"}}}).Validate(), ErrInvalidSigningConfig)
+	assert.ErrorIs(t, (&URLSigningConfig{ActiveKeyID: "b", Keys: []SigningKey{{ID: "a", Secret: "x"}}}).Validate(), ErrInvalidSigningConfig)
+
+	// 서명 없이 on-the-fly 변환을 사용할 수 없다.
+	cfg := &BumblebeeConfig{}
+	cfg.OnTheFly.Enabled = true
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidSigningConfig)
+	cfg.Signing = testSigningConfig()
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestSignedOnTheFlyImageRequest(t *testing.T) {
+	beforeEachOnTheFlyTest(t)
+	Config.Signing = testSigningConfig()
+	Config.Admin.Token = "admin-token"
+	e := NewEcho()
+
+	serve := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, 403, serve("GET", "/api/images/abcd.png?w=100", "", "").Code)
+
+	body := `{"file_name": "abcd.png", "params": {"w": "100"}, "expires_in": 60}`
+	assert.Equal(t, 401, serve("POST", "/api/admin/signed-urls", body, "").Code)
+	assert.Equal(t, 401, serve("POST", "/api/admin/signed-urls", body, "wrong").Code)
+	assert.Equal(t, 400, serve("POST", "/api/admin/signed-urls", `{"file_name": "abcd.png", "params": {"w": "-1"}}`, "admin-token").Code)
+
+	rec := serve("POST", "/api/admin/signed-urls", body, "admin-token")
+	assert.Equal(t, 200, rec.Code)
+	resp := struct {
+		Data struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	_, query := parseSignedURL(t, resp.Data.URL)
+	assert.NotEmpty(t, query.Get("exp"))
+
+	rec = serve("GET", resp.Data.URL, "", "")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	// 서명은 변환 결과의 cache key에 영향을 주지 않는다.
+	_, err := ImageStorage.Stat("cache/abcd/w100_h0_width_q0.png")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 403, serve("GET", strings.Replace(resp.Data.URL, "w=100", "w=200", 1), "", "").Code)
+}
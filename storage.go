@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// 업로드, 변환된 이미지 파일들이 저장된 저장소
+	ImageStorage Storage
+
+	ErrObjectNotFound   = errors.New("저장소에 존재하지 않는 파일입니다.")
+	ErrInvalidObjectKey = errors.New("잘못된 파일 경로입니다.")
+	ErrInvalidStorage   = errors.New("잘못된 storage 설정입니다.")
+)
+
+// 이미지 파일을 저장하는 저장소. key는 /로 구분된 경로이다. (e.g. thumbnail/abcd1234.png)
+// 존재하지 않는 key를 조회하거나 삭제하면 ErrObjectNotFound를 반환한다.
+type Storage interface {
+	Put(key string, body io.Reader, contentType string) error
+	// 반환된 io.ReadCloser는 호출한 쪽에서 닫아야한다.
+	Get(key string) (io.ReadCloser, *ObjectInfo, error)
+	Stat(key string) (*ObjectInfo, error)
+	// prefix로 시작하는 모든 파일을 key 순서로 반환한다.
+	List(prefix string) ([]*ObjectInfo, error)
+	Delete(key string) error
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+	// 파일의 내용이 바뀌면 함께 바뀌는 값. HTTP의 ETag 헤더에 그대로 사용할 수 있도록 따옴표를 포함한다.
+	ETag string
+}
+
+// S3 혹은 MinIO 같은 S3 호환 저장소에 대한 설정
+type AwsStorageConfig struct {
+	Enabled    bool
+	BucketName string
+	// 업로드 응답의 root_endpoint. CDN 등 클라이언트가 파일을 받아갈 주소 (e.g. https://drive.dev.khumu.me/)
+	Endpoint string
+	// S3 API를 호출할 주소. 비어있으면 AWS의 S3를 사용한다. (e.g. http://localhost:9000)
+	ApiEndpoint string
+	// 비어있으면 ap-northeast-2
+	Region string
+	// bucket을 도메인이 아닌 경로로 구분한다. (e.g. http://localhost:9000/<bucket>/<key>) MinIO는 보통 true로 사용한다.
+	ForcePathStyle bool
+	Credentials    struct {
+		// default: AWS SDK의 기본 순서(환경 변수, ~/.aws/credentials, IAM role 등)로 찾는다.
+		// static: AccessKeyID, SecretAccessKey, SessionToken을 사용한다.
+		// env: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY 환경 변수를 사용한다.
+		// shared: SharedFile(비어있으면 ~/.aws/credentials)의 Profile을 사용한다.
+		// anonymous: 서명하지 않는다.
+		Source          string
+		AccessKeyID     string
+		SecretAccessKey string
+		SessionToken    string
+		SharedFile      string
+		Profile         string
+	}
+	TLS struct {
+		// ApiEndpoint의 인증서를 검증할 때 사용할 CA 인증서(PEM) 파일
+		CAFile string
+		// 인증서를 검증하지 않는다. 테스트 환경에서만 사용한다.
+		InsecureSkipVerify bool
+	}
+}
+
+const (
+	AwsCredentialsSourceDefault   = "default"
+	AwsCredentialsSourceStatic    = "static"
+	AwsCredentialsSourceEnv       = "env"
+	AwsCredentialsSourceShared    = "shared"
+	AwsCredentialsSourceAnonymous = "anonymous"
+
+	defaultAwsRegion = "ap-northeast-2"
+)
+
+func (c *AwsStorageConfig) Validate() error {
+	switch c.Credentials.Source {
+	case "", AwsCredentialsSourceDefault, AwsCredentialsSourceEnv, AwsCredentialsSourceShared, AwsCredentialsSourceAnonymous:
+	case AwsCredentialsSourceStatic:
+		if c.Credentials.AccessKeyID == "" || c.Credentials.SecretAccessKey == "" {
+			return fmt.Errorf("%w credentials.source가 static이면 accessKeyID와 secretAccessKey가 필요합니다", ErrInvalidStorage)
+		}
+	default:
+		return fmt.Errorf("%w 지원하지 않는 credentials.source입니다. source=%s", ErrInvalidStorage, c.Credentials.Source)
+	}
+	if c.ApiEndpoint != "" {
+		if u, err := url.Parse(c.ApiEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%w 잘못된 apiEndpoint입니다. apiEndpoint=%s", ErrInvalidStorage, c.ApiEndpoint)
+		}
+	}
+	return nil
+}
+
+// 설정에 따라 S3 API를 호출할 session을 만든다.
+func NewAwsSession(c *AwsStorageConfig) (*session.Session, error) {
+	region := c.Region
+	if region == "" {
+		region = defaultAwsRegion
+	}
+	cfg := aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(c.ForcePathStyle),
+	}
+	if c.ApiEndpoint != "" {
+		cfg.Endpoint = aws.String(c.ApiEndpoint)
+	}
+
+	switch c.Credentials.Source {
+	case AwsCredentialsSourceStatic:
+		cfg.Credentials = credentials.NewStaticCredentials(c.Credentials.AccessKeyID, c.Credentials.SecretAccessKey, c.Credentials.SessionToken)
+	case AwsCredentialsSourceEnv:
+		cfg.Credentials = credentials.NewEnvCredentials()
+	case AwsCredentialsSourceShared:
+		cfg.Credentials = credentials.NewSharedCredentials(c.Credentials.SharedFile, c.Credentials.Profile)
+	case AwsCredentialsSourceAnonymous:
+		cfg.Credentials = credentials.AnonymousCredentials
+	}
+
+	if c.TLS.InsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+	options := session.Options{Config: cfg}
+	if c.TLS.CAFile != "" {
+		// AWS_CA_BUNDLE 환경 변수보다 우선한다.
+		pem, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		options.CustomCABundle = bytes.NewReader(pem)
+	}
+
+	return session.NewSessionWithOptions(options)
+}
+
+type S3Storage struct {
+	bucketName string
+	sess       *session.Session
+	s3         *s3.S3
+	uploader   *s3manager.Uploader
+}
+
+func NewS3Storage(sess *session.Session, bucketName string) *S3Storage {
+	return &S3Storage{
+		bucketName: bucketName,
+		sess:       sess,
+		s3:         s3.New(sess),
+		uploader:   s3manager.NewUploader(sess),
+	}
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("S3Storage(bucketName: %s)", s.bucketName)
+}
+
+func (s *S3Storage) Put(key string, body io.Reader, contentType string) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.bucketName),
+		Body:        body,
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	output, err := s.s3.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucketName), Key: aws.String(key)})
+	if err != nil {
+		return nil, nil, s3Error(key, err)
+	}
+	return output.Body, &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		ContentType:  aws.StringValue(output.ContentType),
+		LastModified: aws.TimeValue(output.LastModified),
+		ETag:         aws.StringValue(output.ETag),
+	}, nil
+}
+
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	output, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.bucketName), Key: aws.String(key)})
+	if err != nil {
+		return nil, s3Error(key, err)
+	}
+	return &ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(output.ContentLength),
+		ContentType:  aws.StringValue(output.ContentType),
+		LastModified: aws.TimeValue(output.LastModified),
+		ETag:         aws.StringValue(output.ETag),
+	}, nil
+}
+
+func (s *S3Storage) List(prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+	err := s.s3.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: aws.String(s.bucketName), Prefix: aws.String(prefix)},
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, &ObjectInfo{
+					Key:          aws.StringValue(object.Key),
+					Size:         aws.Int64Value(object.Size),
+					LastModified: aws.TimeValue(object.LastModified),
+					ETag:         aws.StringValue(object.ETag),
+				})
+			}
+			return true
+		})
+	return objects, err
+}
+
+// S3의 DeleteObject는 존재하지 않는 key도 성공으로 응답하므로 먼저 확인한다.
+func (s *S3Storage) Delete(key string) error {
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucketName), Key: aws.String(key)})
+	return s3Error(key, err)
+}
+
+func s3Error(key string, err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return fmt.Errorf("%w key=%s", ErrObjectNotFound, key)
+		}
+	}
+	return err
+}
+
+// 로컬 디스크의 root 디렉토리 아래에 key 경로로 파일을 저장하는 저장소
+// shardDepth가 0보다 크면 한 디렉토리에 파일이 너무 많아지지 않도록
+// 파일 이름(확장자 제외)의 hash로 하위 디렉토리를 만든다. (e.g. thumbnail/abcd.png => thumbnail/3f/a2/abcd.png)
+// 같은 이미지의 다른 포맷들은 같은 디렉토리에 저장된다.
+type DiskStorage struct {
+	root       string
+	shardDepth int
+}
+
+const (
+	// 하위 디렉토리를 최대 몇 단계까지 만들 수 있는지
+	maxDiskShardDepth = 4
+	// 쓰는 중인 파일의 이름 prefix. List에서 제외된다.
+	diskTempFilePrefix = ".bumblebee-tmp-"
+)
+
+func NewDiskStorage(root string, shardDepth int) *DiskStorage {
+	if root == "" {
+		root = "."
+	}
+	return &DiskStorage{root: root, shardDepth: shardDepth}
+}
+
+func (s *DiskStorage) String() string {
+	return fmt.Sprintf("DiskStorage(root: %s, shardDepth: %d)", s.root, s.shardDepth)
+}
+
+// key를 root 아래의 파일 경로로 바꾼다. root 밖을 가리키는 key는 허용하지 않는다.
+func (s *DiskStorage) filePath(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if key == "" || cleaned == "/" || strings.Contains(key, "\\") || cleaned != "/"+key || strings.HasPrefix(path.Base(key), diskTempFilePrefix) {
+		return "", fmt.Errorf("%w key=%s", ErrInvalidObjectKey, key)
+	}
+	dir, name := path.Split(cleaned)
+	return filepath.Join(s.root, filepath.FromSlash(path.Join(dir, s.shard(name), name))), nil
+}
+
+// 파일 이름에 해당하는 하위 디렉토리 경로 (e.g. 3f/a2)
+func (s *DiskStorage) shard(name string) string {
+	if s.shardDepth <= 0 {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(strings.TrimSuffix(name, path.Ext(name))))
+	hexHash := hex.EncodeToString(hash[:])
+	dirs := make([]string, s.shardDepth)
+	for i := range dirs {
+		dirs[i] = hexHash[i*2 : i*2+2]
+	}
+	return path.Join(dirs...)
+}
+
+// root로부터의 파일 경로를 key로 바꾼다. shard 디렉토리가 파일 이름과 맞지 않으면 false를 반환한다.
+func (s *DiskStorage) keyOf(rel string) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < s.shardDepth+1 {
+		return "", false
+	}
+	name := parts[len(parts)-1]
+	shardStart := len(parts) - 1 - s.shardDepth
+	if path.Join(parts[shardStart:len(parts)-1]...) != s.shard(name) {
+		return "", false
+	}
+	return path.Join(append(parts[:shardStart:shardStart], name)...), true
+}
+
+// 임시 파일에 모두 쓴 뒤 fsync하고 rename하므로 읽는 쪽에서 쓰다 만 파일을 볼 수 없고
+// 쓰는 도중에 실패하거나 서버가 종료되어도 기존 파일이 손상되지 않는다.
+func (s *DiskStorage) Put(key string, body io.Reader, contentType string) (err error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, diskTempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = io.Copy(tmp, body); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filePath); err != nil {
+		return err
+	}
+	// rename 결과도 디스크에 기록되도록 디렉토리를 fsync한다.
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *DiskStorage) Get(key string) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	filePath, _ := s.filePath(key)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, diskError(key, err)
+	}
+	return file, info, nil
+}
+
+func (s *DiskStorage) Stat(key string) (*ObjectInfo, error) {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, diskError(key, err)
+	}
+	if stat.IsDir() {
+		return nil, fmt.Errorf("%w key=%s", ErrObjectNotFound, key)
+	}
+	return diskObjectInfo(key, stat), nil
+}
+
+func (s *DiskStorage) List(prefix string) ([]*ObjectInfo, error) {
+	// prefix가 속한 디렉토리부터 찾는다. (e.g. thumbnail/abcd => thumbnail)
+	dir := path.Dir("/" + prefix)
+	if strings.HasSuffix(prefix, "/") {
+		dir = path.Clean("/" + prefix)
+	}
+	objects := make([]*ObjectInfo, 0)
+	err := filepath.Walk(filepath.Join(s.root, filepath.FromSlash(dir)), func(filePath string, stat os.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if stat.IsDir() || strings.HasPrefix(stat.Name(), diskTempFilePrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, filePath)
+		if err != nil {
+			return err
+		}
+		key, ok := s.keyOf(rel)
+		if ok && strings.HasPrefix(key, prefix) {
+			objects = append(objects, diskObjectInfo(key, stat))
+		}
+		return nil
+	})
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, err
+}
+
+func (s *DiskStorage) Delete(key string) error {
+	filePath, err := s.filePath(key)
+	if err != nil {
+		return err
+	}
+	return diskError(key, os.Remove(filePath))
+}
+
+// 디스크의 파일은 수정 시각과 크기로 ETag를 만든다. (nginx와 같은 방식)
+func diskObjectInfo(key string, stat os.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		ContentType:  ContentTypeOf(strings.TrimPrefix(path.Ext(key), ".")),
+		LastModified: stat.ModTime(),
+		ETag:         fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size()),
+	}
+}
+
+func diskError(key string, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w key=%s", ErrObjectNotFound, key)
+	}
+	return err
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStorage(t *testing.T) {
+	for _, shardDepth := range []int{0, 2} {
+		t.Run(fmt.Sprintf("shardDepth_%d", shardDepth), func(t *testing.T) {
+			testDiskStorage(t, shardDepth)
+		})
+	}
+}
+
+func testDiskStorage(t *testing.T, shardDepth int) {
+	root := t.TempDir()
+	storage := NewDiskStorage(root, shardDepth)
+
+	for _, key := range []string{"original/abcd.png", "thumbnail/abcd.png", "thumbnail/abcd.webp", "thumbnail/efgh.png"} {
+		assert.NoError(t, storage.Put(key, bytes.NewBufferString(key), "image/png"))
+	}
+	filePath, err := storage.filePath("thumbnail/abcd.webp")
+	assert.NoError(t, err)
+	_, err = os.Stat(filePath)
+	assert.NoError(t, err)
+
+	t.Run("Get", func(t *testing.T) {
+		body, info, err := storage.Get("thumbnail/abcd.webp")
+		assert.NoError(t, err)
+		defer body.Close()
+		data, err := ioutil.ReadAll(body)
+		assert.NoError(t, err)
+		assert.Equal(t, "thumbnail/abcd.webp", string(data))
+		assert.Equal(t, "image/webp", info.ContentType)
+		assert.Equal(t, int64(len(data)), info.Size)
+
+		_, _, err = storage.Get("thumbnail/none.png")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		info, err := storage.Stat("original/abcd.png")
+		assert.NoError(t, err)
+		assert.Equal(t, "original/abcd.png", info.Key)
+		assert.False(t, info.LastModified.IsZero())
+
+		_, err = storage.Stat("original")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		keys := func(prefix string) []string {
+			objects, err := storage.List(prefix)
+			assert.NoError(t, err)
+			keys := make([]string, 0)
+			for _, object := range objects {
+				keys = append(keys, object.Key)
+			}
+			return keys
+		}
+		assert.Equal(t, []string{"thumbnail/abcd.png", "thumbnail/abcd.webp", "thumbnail/efgh.png"}, keys("thumbnail/"))
+		assert.Equal(t, []string{"thumbnail/abcd.png", "thumbnail/abcd.webp"}, keys("thumbnail/abcd"))
+		assert.Equal(t, []string{"original/abcd.png", "thumbnail/abcd.png", "thumbnail/abcd.webp", "thumbnail/efgh.png"}, keys(""))
+		assert.Empty(t, keys("resized/"))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		assert.NoError(t, storage.Delete("thumbnail/efgh.png"))
+		_, err := storage.Stat("thumbnail/efgh.png")
+		assert.ErrorIs(t, err, ErrObjectNotFound)
+		assert.ErrorIs(t, storage.Delete("thumbnail/efgh.png"), ErrObjectNotFound)
+	})
+
+	t.Run("root_밖의_경로", func(t *testing.T) {
+		for _, key := range []string{"", "../abcd.png", "thumbnail/../../abcd.png", "/abcd.png"} {
+			assert.ErrorIs(t, storage.Put(key, bytes.NewBufferString(key), "image/png"), ErrInvalidObjectKey, "key=%s", key)
+			_, err := storage.Stat(key)
+			assert.ErrorIs(t, err, ErrInvalidObjectKey, "key=%s", key)
+		}
+	})
+}
+
+func TestDiskStorage_Shard(t *testing.T) {
+	root := t.TempDir()
+	storage := NewDiskStorage(root, 2)
+	assert.NoError(t, storage.Put("thumbnail/abcd.png", bytes.NewBufferString("png"), "image/png"))
+	assert.NoError(t, storage.Put("thumbnail/abcd.webp", bytes.NewBufferString("webp"), "image/webp"))
+
+	// sha256("abcd") = 88d4266f...
+	for _, name := range []string{"abcd.png", "abcd.webp"} {
+		_, err := os.Stat(filepath.Join(root, "thumbnail", "88", "d4", name))
+		assert.NoError(t, err)
+	}
+	// shard 디렉토리가 맞지 않는 파일은 무시한다.
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "thumbnail", "00", "00"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "thumbnail", "00", "00", "abcd.gif"), []byte("gif"), 0644))
+	objects, err := storage.List("thumbnail/")
+	assert.NoError(t, err)
+	assert.Len(t, objects, 2)
+}
+
+// 임시 파일에 쓴 뒤 rename하므로 쓰는 도중 실패해도 기존 파일은 그대로이고 임시 파일도 남지 않는다.
+func TestDiskStorage_PutAtomic(t *testing.T) {
+	root := t.TempDir()
+	storage := NewDiskStorage(root, 0)
+	assert.NoError(t, storage.Put("original/abcd.png", bytes.NewBufferString("old"), "image/png"))
+
+	err := storage.Put("original/abcd.png", io.MultiReader(bytes.NewBufferString("new"), &failingReader{}), "image/png")
+	assert.Error(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(root, "original", "abcd.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "original"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, os.FileMode(0644), files[0].Mode().Perm())
+
+	// 임시 파일 이름의 key는 사용할 수 없다.
+	assert.ErrorIs(t, storage.Put("original/"+diskTempFilePrefix+"abcd", bytes.NewBufferString(""), "image/png"), ErrInvalidObjectKey)
+}
+
+type failingReader struct{}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("읽기 실패")
+}
+
+func TestStorageUploader_Upload(t *testing.T) {
+	storage := NewDiskStorage(t.TempDir(), 0)
+	u := NewStorageUploader(nil, storage, nil)
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+
+	task := &ImageUploadTask{
+		BaseImageTask: &BaseImageTask{HashedFileName: "abcd1234", Extension: "png"},
+		UploadPath:    "original",
+		RawData:       data,
+	}
+	assert.NoError(t, u.Upload(task))
+	body, info, err := storage.Get("original/abcd1234.png")
+	assert.NoError(t, err)
+	defer body.Close()
+	uploaded, err := ioutil.ReadAll(body)
+	assert.NoError(t, err)
+	assert.Equal(t, data, uploaded)
+	assert.Equal(t, "image/png", info.ContentType)
+
+	assert.ErrorIs(t, u.Upload(&ImageUploadTask{BaseImageTask: &BaseImageTask{HashedFileName: "empty", Extension: "png"}}), ErrNoImageDataToUpload)
+}
+
+// 테스트에서 AWS 대신 사용하는 S3 API 서버. path style 요청의 PutObject, GetObject, HeadObject, DeleteObject, ListObjectsV2만 지원한다.
+type fakeS3 struct {
+	bucketName string
+	mutex      sync.Mutex
+	objects    map[string]fakeS3Object
+	// 마지막 요청의 Authorization 헤더
+	authorization string
+}
+
+type fakeS3Object struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3ListContent
+}
+
+type fakeS3ListContent struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+}
+
+func newFakeS3Server(t *testing.T, bucketName string, useTLS bool) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{bucketName: bucketName, objects: make(map[string]fakeS3Object)}
+	server := httptest.NewUnstartedServer(s3)
+	if useTLS {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+	t.Cleanup(server.Close)
+	return s3, server
+}
+
+func (o fakeS3Object) etag() string {
+	return fmt.Sprintf("\"%x\"", md5.Sum(o.data))
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.authorization = r.Header.Get("Authorization")
+
+	bucketName, key := r.URL.Path[1:], ""
+	if i := strings.Index(bucketName, "/"); i >= 0 {
+		bucketName, key = bucketName[:i], bucketName[i+1:]
+	}
+	if bucketName != s.bucketName {
+		s.writeError(w, 404, "NoSuchBucket")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && key == "":
+		result := fakeS3ListResult{Name: s.bucketName, Prefix: r.URL.Query().Get("prefix")}
+		keys := make([]string, 0)
+		for key := range s.objects {
+			if strings.HasPrefix(key, result.Prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			object := s.objects[key]
+			result.Contents = append(result.Contents, fakeS3ListContent{
+				Key: key, LastModified: object.lastModified.Format(time.RFC3339), ETag: object.etag(), Size: len(object.data),
+			})
+		}
+		result.KeyCount = len(keys)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "PUT":
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.writeError(w, 400, "IncompleteBody")
+			return
+		}
+		object := fakeS3Object{data: data, contentType: r.Header.Get("Content-Type"), lastModified: time.Now().UTC().Truncate(time.Second)}
+		s.objects[key] = object
+		w.Header().Set("ETag", object.etag())
+	case r.Method == "GET" || r.Method == "HEAD":
+		object, ok := s.objects[key]
+		if !ok {
+			s.writeError(w, 404, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.lastModified.Format(http.TimeFormat))
+		w.Header().Set("ETag", object.etag())
+		if r.Method == "GET" {
+			w.Write(object.data)
+		}
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(204)
+	default:
+		s.writeError(w, 405, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+// fake S3 서버를 사용하는 설정
+func fakeS3Config(server *httptest.Server, bucketName string) *AwsStorageConfig {
+	c := &AwsStorageConfig{Enabled: true, BucketName: bucketName, ApiEndpoint: server.URL, Region: "us-east-1", ForcePathStyle: true}
+	c.Credentials.Source = AwsCredentialsSourceStatic
+	c.Credentials.AccessKeyID = "test-access-key"
+	c.Credentials.SecretAccessKey = "test-secret-key"
+	return c
+}
+
+func TestS3Storage(t *testing.T) {
+	fake, server := newFakeS3Server(t, "khumu-test", false)
+	sess, err := NewAwsSession(fakeS3Config(server, "khumu-test"))
+	assert.NoError(t, err)
+	storage := NewS3Storage(sess, "khumu-test")
+
+	for _, key := range []string{"original/abcd.png", "thumbnail/abcd.png", "thumbnail/abcd.webp"} {
+		assert.NoError(t, storage.Put(key, bytes.NewBufferString(key), ContentTypeOf(path.Ext(key)[1:])))
+	}
+	assert.Contains(t, fake.authorization, "Credential=test-access-key/")
+
+	body, info, err := storage.Get("thumbnail/abcd.webp")
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "thumbnail/abcd.webp", string(data))
+	assert.Equal(t, "image/webp", info.ContentType)
+	assert.NotEmpty(t, info.ETag)
+
+	info, err = storage.Stat("original/abcd.png")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("original/abcd.png")), info.Size)
+
+	objects, err := storage.List("thumbnail/")
+	assert.NoError(t, err)
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "thumbnail/abcd.png", objects[0].Key)
+	}
+
+	assert.NoError(t, storage.Delete("thumbnail/abcd.png"))
+	_, err = storage.Stat("thumbnail/abcd.png")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, _, err = storage.Get("thumbnail/abcd.png")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	assert.ErrorIs(t, storage.Delete("thumbnail/abcd.png"), ErrObjectNotFound)
+}
+
+func TestNewAwsSession_TLS(t *testing.T) {
+	_, server := newFakeS3Server(t, "khumu-test", true)
+	c := fakeS3Config(server, "khumu-test")
+
+	// 사설 인증서는 검증할 수 없다.
+	sess, err := NewAwsSession(c)
+	assert.NoError(t, err)
+	assert.Error(t, NewS3Storage(sess, "khumu-test").Put("original/abcd.png", bytes.NewBufferString("png"), "image/png"))
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644))
+	c.TLS.CAFile = caFile
+	sess, err = NewAwsSession(c)
+	assert.NoError(t, err)
+	assert.NoError(t, NewS3Storage(sess, "khumu-test").Put("original/abcd.png", bytes.NewBufferString("png"), "image/png"))
+
+	c.TLS.CAFile = ""
+	c.TLS.InsecureSkipVerify = true
+	sess, err = NewAwsSession(c)
+	assert.NoError(t, err)
+	assert.NoError(t, NewS3Storage(sess, "khumu-test").Put("original/abcd.png", bytes.NewBufferString("png"), "image/png"))
+}
+
+func TestAwsStorageConfig_Validate(t *testing.T) {
+	c := &AwsStorageConfig{}
+	assert.NoError(t, c.Validate())
+
+	c.Credentials.Source = AwsCredentialsSourceStatic
+	assert.ErrorIs(t, c.Validate(), ErrInvalidStorage)
+	c.Credentials.AccessKeyID, c.Credentials.SecretAccessKey = "a", "b"
+	assert.NoError(t, c.Validate())
+
+	c.Credentials.Source = "vault"
+	assert.ErrorIs(t, c.Validate(), ErrInvalidStorage)
+
+	c = &AwsStorageConfig{ApiEndpoint: "localhost:9000"}
+	assert.ErrorIs(t, c.Validate(), ErrInvalidStorage)
+}
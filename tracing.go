@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"time"
+)
+
+const (
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+
+	tracerName = "github.com/khu-dev/bumblebee"
+	// 종료 시에 남은 span들을 내보내기 위해 기다리는 최대 시간
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+var (
+	// Config.Tracing.Enabled인 경우에만 사용된다. 종료 시에 남은 span들을 내보내기 위해 보관한다.
+	TracerProvider *sdktrace.TracerProvider
+
+	ErrInvalidTracingConfig = errors.New("잘못된 tracing 설정입니다.")
+)
+
+// 업로드 요청부터 변환, 업로드 작업까지를 하나의 trace로 기록하는 설정
+type TracingConfig struct {
+	Enabled bool
+	// span들을 내보낼 곳 (otlp, stdout)
+	Exporter string
+	// otlp exporter가 span들을 보낼 collector의 주소(host:port). 비어있으면 localhost:4318
+	Endpoint string
+	// collector와 TLS 없이 통신한다.
+	Insecure bool
+	// trace에 기록될 service.name. 비어있으면 bumblebee
+	ServiceName string
+	// 새로 시작하는 trace 중 기록할 비율(0~1). 0이면 모두 기록한다.
+	// 요청에 부모 trace가 있으면 부모의 sampling 여부를 따른다.
+	SampleRatio float64
+}
+
+func (c *TracingConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Exporter != TracingExporterOTLP && c.Exporter != TracingExporterStdout {
+		return fmt.Errorf("%w exporter는 otlp, stdout 중 하나여야합니다. exporter=%s", ErrInvalidTracingConfig, c.Exporter)
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("%w sampleRatio는 0~1이어야합니다", ErrInvalidTracingConfig)
+	}
+	return nil
+}
+
+// Config.Tracing에 따라 span들을 내보낼 TracerProvider를 전역으로 등록한다.
+// 사용하지 않으면 otel의 기본 TracerProvider가 span을 기록하지 않는다.
+func InitTracing() error {
+	if !Config.Tracing.Enabled {
+		return nil
+	}
+	exporter, err := newTracingExporter(&Config.Tracing)
+	if err != nil {
+		return err
+	}
+	serviceName := Config.Tracing.ServiceName
+	if serviceName == "" {
+		serviceName = "bumblebee"
+	}
+	sampleRatio := Config.Tracing.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+	TracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(TracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+func newTracingExporter(c *TracingConfig) (sdktrace.SpanExporter, error) {
+	switch c.Exporter {
+	case TracingExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		options := make([]otlptracehttp.Option, 0)
+		if c.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), options...)
+	}
+}
+
+// 아직 내보내지 않은 span들을 내보내고 TracerProvider를 닫는다.
+func ShutdownTracing(ctx context.Context) error {
+	if TracerProvider == nil {
+		return nil
+	}
+	return TracerProvider.Shutdown(ctx)
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// 요청의 traceparent 헤더를 이어받아 요청마다 span을 만든다.
+// span은 요청의 context에 담기므로 handler는 c.Request().Context()로 span을 이어갈 수 있다.
+func TracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// health check, metric 수집 요청은 기록하지 않는다.
+		if uri := c.Request().URL.RequestURI(); uri == "/healthz" || uri == "/metrics" {
+			return next(c)
+		}
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer().Start(ctx, fmt.Sprintf("HTTP %s %s", req.Method, c.Path()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPRouteKey.String(c.Path())),
+		)
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			span.RecordError(err)
+			// 응답의 status code를 기록할 수 있도록 여기에서 오류 응답을 만든다.
+			c.Error(err)
+		}
+		status := c.Response().Status
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		return nil
+	}
+}
+
+// task를 만든 span의 자식 span을 시작한다. task가 span 없이 만들어졌으면 새 trace를 시작한다.
+func startTaskSpan(task *BaseImageTask, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := trace.ContextWithSpanContext(context.Background(), task.SpanContext)
+	attrs = append(attrs, attribute.String("bumblebee.name", task.HashedFileName))
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// span에 오류를 기록한다.
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestTracingConfig_Validate(t *testing.T) {
+	assert.NoError(t, (&TracingConfig{Exporter: "unknown"}).Validate())
+	assert.NoError(t, (&TracingConfig{Enabled: true, Exporter: TracingExporterStdout, SampleRatio: 0.5}).Validate())
+	assert.ErrorIs(t, (&TracingConfig{Enabled: true, Exporter: "jaeger"}).Validate(), ErrInvalidTracingConfig)
+	assert.ErrorIs(t, (&TracingConfig{Enabled: true, Exporter: TracingExporterOTLP, SampleRatio: 2}).Validate(), ErrInvalidTracingConfig)
+}
+
+func TestTracing_Upload(t *testing.T) {
+	originalConfig, originalAdmission := Config, TaskAdmission
+	originalChans := []interface{}{ResizeTaskChan, ThumbnailTaskChan, UploadTaskChan}
+	originalProvider, originalPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		Config, TaskAdmission = originalConfig, originalAdmission
+		ResizeTaskChan = originalChans[0].(chan *ImageResizeTask)
+		ThumbnailTaskChan = originalChans[1].(chan *ImageGenerateThumbnailTask)
+		UploadTaskChan = originalChans[2].(chan *ImageUploadTask)
+		otel.SetTracerProvider(originalProvider)
+		otel.SetTextMapPropagator(originalPropagator)
+	})
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	Config = &BumblebeeConfig{Variants: []*VariantPreset{{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 16}}}
+	Config.Tracing.Enabled = true
+	InitTaskChannels()
+	InitAdmission()
+
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	body := bytes.NewBuffer([]byte{})
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("image", "tracing.png")
+	assert.NoError(t, err)
+	_, err = part.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.WriteField("hashing", "false"))
+	assert.NoError(t, writer.Close())
+	req := httptest.NewRequest("POST", "/api/images", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	// 요청을 보낸 쪽의 trace를 이어간다.
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rec := httptest.NewRecorder()
+	NewEcho().ServeHTTP(rec, req)
+	assert.Equal(t, 200, rec.Code)
+
+	// 종료된 ctx로 시작하면 채널에 남은 작업들을 처리한 뒤 반환한다.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := new(sync.WaitGroup)
+	done.Add(2)
+	NewTransformer(ResizeTaskChan, ThumbnailTaskChan, UploadTaskChan, done).Start(ctx)
+	NewStorageUploader(UploadTaskChan, NewDiskStorage(t.TempDir(), 0), done).Start(ctx)
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String(), span.Name())
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	if !assert.Len(t, spans["HTTP POST /api/images"], 1) || !assert.Len(t, spans["dispatch"], 1) ||
+		!assert.Len(t, spans["transformer.thumbnail"], 1) || !assert.Len(t, spans["uploader.upload"], 2) {
+		return
+	}
+	request, dispatch, thumbnail := spans["HTTP POST /api/images"][0], spans["dispatch"][0], spans["transformer.thumbnail"][0]
+	assert.Equal(t, "b7ad6b7169203331", request.Parent().SpanID().String())
+	assert.Equal(t, request.SpanContext().SpanID(), dispatch.Parent().SpanID())
+	assert.Equal(t, dispatch.SpanContext().SpanID(), thumbnail.Parent().SpanID())
+	// 원본은 dispatch에서, 썸네일은 변환 작업에서 업로드된다.
+	parents := map[string]string{}
+	for _, upload := range spans["uploader.upload"] {
+		for _, attr := range upload.Attributes() {
+			if attr.Key == "bumblebee.variant" {
+				parents[attr.Value.AsString()] = upload.Parent().SpanID().String()
+			}
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"original":  dispatch.SpanContext().SpanID().String(),
+		"thumbnail": thumbnail.SpanContext().SpanID().String(),
+	}, parents)
+}
@@ -1,22 +1,17 @@
 package main
 
 import (
-	"github.com/nfnt/resize"
+	"context"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"image"
-	"image/color/palette"
-	"image/draw"
 	"image/gif"
-	"path"
-	"strconv"
 	"sync"
 	"time"
 )
 
 var (
-	ThumbnailWidth = 128
-	// 새로운 사이즈의 리사이징이 필요할 경우 이곳만 바꿔주면 된다.
-	ResizeSizes                = []int{256, 512, 1024}
 	autoIncrementTransformerID = 0
 )
 
@@ -29,171 +24,148 @@ type Transformer struct {
 	ResizeTaskChan <-chan *ImageResizeTask
 	// 이미지 변환 후 업로드하기 위한 작업 요청 채널
 	UploadTaskChan chan<- *ImageUploadTask
-	// 테스트 진행 시에나 graceful shutdown을 통해 Transformer에게 종료이벤트를 전달하기 위함
-	Quit chan interface{}
-	// Quit channel을 통해 quit 요청이 들어와서 quit하고자 하는 상태인지
-	quit bool
 	// 작업을 모두 마무리했는지 보고하기 위함.
 	done *sync.WaitGroup
 }
 
-func NewTransformer(resizeChan chan *ImageResizeTask, thumbnailChan chan *ImageGenerateThumbnailTask, uploadChan chan *ImageUploadTask, quit chan interface{}, done *sync.WaitGroup) *Transformer {
+func NewTransformer(resizeChan chan *ImageResizeTask, thumbnailChan chan *ImageGenerateThumbnailTask, uploadChan chan *ImageUploadTask, done *sync.WaitGroup) *Transformer {
 	autoIncrementTransformerID++
 	return &Transformer{
 		ID:                autoIncrementTransformerID,
 		ResizeTaskChan:    resizeChan,
 		ThumbnailTaskChan: thumbnailChan,
 		UploadTaskChan:    uploadChan,
-		Quit:              quit,
 		done:              done,
 	}
 }
 
-// transformer가 이미지 변환작업을 시작한다.
-func (t *Transformer) Start() {
+// transformer가 이미지 변환작업을 시작한다. 작업이 들어올 때까지 채널에서 기다린다.
+// ctx가 끝나면 채널에 남아있는 작업들을 모두 처리한 뒤 종료하고 done에 보고한다.
+// done.Add는 Start를 호출하는 쪽에서 해야한다.
+func (t *Transformer) Start(ctx context.Context) {
 	logrus.Print("Started Transformer")
 	defer logrus.Info("Finished Transformer")
-	t.done.Add(1)
 	defer t.done.Done()
-loop:
 	for {
 		select {
 		case thumbnailTask := <-t.ThumbnailTaskChan:
-			logrus.Println("ThumbnailTask", thumbnailTask)
-			err := thumbnailTask.Validate()
-			if err != nil {
-				logrus.Error(err)
-				// 이건 for문 break이 아니라 밑을 실행 안한다는 것임
-				break
-			}
+			t.handleThumbnailTask(thumbnailTask)
+		case resizeTask := <-t.ResizeTaskChan:
+			t.handleResizeTask(resizeTask)
+		case <-ctx.Done():
+			logrus.Info("Transformer에 대한 종료 시그널이 도착했습니다. 남은 작업들을 처리합니다.")
+			t.drain()
+			return
+		}
+	}
+}
 
-			t.GenerateThumbnail(thumbnailTask)
-			uploadTask := &ImageUploadTask{
-				BaseImageTask: &BaseImageTask{
-					OriginalFileName: thumbnailTask.OriginalFileName,
-					HashedFileName:   thumbnailTask.HashedFileName,
-					ImageData:        thumbnailTask.ThumbnailImageData,
-					GIFImageData:     thumbnailTask.ThumbnailGIFImageData,
-					Extension:        thumbnailTask.Extension,
-				},
-				UploadPath: "thumbnail",
-			}
-			t.UploadTaskChan <- uploadTask
-			logrus.Println("Add UploadTask", uploadTask)
+// 채널에 남아있는 작업이 없을 때까지 처리한다.
+func (t *Transformer) drain() {
+	for {
+		select {
+		case thumbnailTask := <-t.ThumbnailTaskChan:
+			t.handleThumbnailTask(thumbnailTask)
 		case resizeTask := <-t.ResizeTaskChan:
-			logrus.Println("ResizeTask", resizeTask)
-			err := resizeTask.Validate()
-			if err != nil {
-				logrus.Error(err)
-				// 이건 for문 break이 아니라 밑을 실행 안한다는 것임
-				break
-			}
-			originalWidth, err := resizeTask.GetOriginalWidth()
-			if err != nil {
-				logrus.Error(err)
-				break
-			}
+			t.handleResizeTask(resizeTask)
+		default:
+			logrus.Info("Transformer에 더 이상 남은 작업이 없습니다.")
+			return
+		}
+	}
+}
+
+func (t *Transformer) handleThumbnailTask(thumbnailTask *ImageGenerateThumbnailTask) {
+	defer observeBusy(WorkerTransformer, time.Now())
+	logrus.Println("ThumbnailTask", thumbnailTask)
+	outputs := thumbnailTask.outputs()
+	setOutputsStatus(thumbnailTask.HashedFileName, outputs, JobStatusTransforming)
+	_, span := startTaskSpan(thumbnailTask.BaseImageTask, "transformer.thumbnail", attribute.String("bumblebee.preset", thumbnailTask.Preset.Name))
+	defer span.End()
+	if err := thumbnailTask.Validate(); err != nil {
+		logrus.Error(err)
+		recordSpanError(span, err)
+		setOutputsFailed(thumbnailTask.BaseImageTask, outputs, err)
+		return
+	}
 
-			if resizeTask.ResizingWidth < originalWidth {
-				t.Resize(resizeTask)
-			} else {
-				// Resize 필요 없음.
-				resizeTask.ResizedImageData = resizeTask.ImageData
-				resizeTask.ResizedGIFImageData = resizeTask.GIFImageData
-			}
+	t.GenerateThumbnail(thumbnailTask)
+	t.enqueueUploadTasks(span.SpanContext(), thumbnailTask.BaseImageTask, thumbnailTask.Preset, outputs, thumbnailTask.ThumbnailImageData, thumbnailTask.ThumbnailGIFImageData)
+}
 
-			uploadTask := &ImageUploadTask{
-				BaseImageTask: &BaseImageTask{
-					OriginalFileName: resizeTask.OriginalFileName,
-					HashedFileName:   resizeTask.HashedFileName,
-					ImageData:        resizeTask.ResizedImageData,
-					GIFImageData:     resizeTask.ResizedGIFImageData,
-					Extension:        resizeTask.Extension,
-				},
-				UploadPath: path.Join("resized", strconv.Itoa(resizeTask.ResizingWidth)),
-			}
-			logrus.Info("Resized image 업로드 작업 요청", uploadTask)
-			t.UploadTaskChan <- uploadTask
+func (t *Transformer) handleResizeTask(resizeTask *ImageResizeTask) {
+	defer observeBusy(WorkerTransformer, time.Now())
+	logrus.Println("ResizeTask", resizeTask)
+	outputs := resizeTask.outputs()
+	setOutputsStatus(resizeTask.HashedFileName, outputs, JobStatusTransforming)
+	_, span := startTaskSpan(resizeTask.BaseImageTask, "transformer.resize", attribute.String("bumblebee.preset", resizeTask.Preset.Name))
+	defer span.End()
+	if err := resizeTask.Validate(); err != nil {
+		logrus.Error(err)
+		recordSpanError(span, err)
+		setOutputsFailed(resizeTask.BaseImageTask, outputs, err)
+		return
+	}
 
-		case <-t.Quit:
-			logrus.Info("Transformer에 대한 종료 시그널이 도착했습니다.")
-			t.quit = true
-		default:
-			if t.quit {
-				logrus.Info("Transformer에 대한 종료 시그널을 받았었고, 더 이상 작업이 없습니다.")
-				break loop
-			} else {
-				logrus.Debug("처리할 작업이 없습니다. 3초 대기합니다.")
-				time.Sleep(3 * time.Second)
-			}
+	t.Resize(resizeTask)
+	t.enqueueUploadTasks(span.SpanContext(), resizeTask.BaseImageTask, resizeTask.Preset, outputs, resizeTask.ResizedImageData, resizeTask.ResizedGIFImageData)
+}
+
+// 변환된 이미지를 각 출력 포맷마다 업로드하도록 요청한다. 업로드 작업은 변환 작업의 span인 spanContext의 자식 span에서 처리된다.
+func (t *Transformer) enqueueUploadTasks(spanContext trace.SpanContext, base *BaseImageTask, preset *VariantPreset, outputs []VariantOutput, imageData image.Image, gifImageData *gif.GIF) {
+	for _, output := range outputs {
+		uploadTask := &ImageUploadTask{
+			BaseImageTask: &BaseImageTask{
+				OriginalFileName: base.OriginalFileName,
+				HashedFileName:   base.HashedFileName,
+				ImageData:        imageData,
+				GIFImageData:     gifImageData,
+				Extension:        output.OutputFormat(base.Extension),
+				Metadata:         base.Metadata,
+				AdmissionID:      base.AdmissionID,
+				SpanContext:      spanContext,
+			},
+			UploadPath: preset.Path,
+			Variant:    output.Variant,
+			Encoding:   preset.EncoderOptions(),
+			Retry:      preset.RetryPolicy(),
 		}
+		t.UploadTaskChan <- uploadTask
+		logrus.Println("Add UploadTask", uploadTask)
+	}
+}
+
+func setOutputsStatus(hashedFileName string, outputs []VariantOutput, status JobStatus) {
+	for _, output := range outputs {
+		Jobs.SetStatus(hashedFileName, output.Variant, status)
+	}
+}
+
+func setOutputsFailed(task *BaseImageTask, outputs []VariantOutput, err error) {
+	for _, output := range outputs {
+		Jobs.SetFailed(task.HashedFileName, output.Variant, err)
 	}
+	FinishAdmittedVariants(task, len(outputs))
 }
 
+// preset의 크기 변경 방식에 따라 이미지의 크기를 변경한다.
+// 크기를 변경할 필요가 없으면 원본 이미지를 그대로 사용한다.
 func (t *Transformer) Resize(task *ImageResizeTask) {
+	defer observeStage(StageResize, time.Now())
+	options := task.Preset.ResizeOptions()
 	if task.ImageData != nil {
-		w, h := t.getProperSizeBasedOnWidth(task.ResizingWidth, task.ImageData.Bounds().Dx(), task.ImageData.Bounds().Dy())
-		task.ResizedImageData = resize.Resize(w, h, task.ImageData, resize.Lanczos3)
+		task.ResizedImageData = ResizeImage(task.ImageData, options)
 	} else if task.GIFImageData != nil {
-		w, h := t.getProperSizeBasedOnWidth(task.ResizingWidth, task.GIFImageData.Config.Width, task.GIFImageData.Config.Height)
-		// gif resize 참고. 상당히 어려움
-		// https://stackoverflow.com/a/54210633/9471220
-		// image.Image* => image.Palette 참고
-		// https://stackoverflow.com/questions/35850753/how-to-convert-image-rgba-image-image-to-image-paletted
-		// NewGIF 메소드를 제공하는 곳이 없어서 원본 GIF를 바탕으로 복사한다.
-		task.ResizedGIFImageData = &gif.GIF{
-			Image:           make([]*image.Paletted, len(task.GIFImageData.Image)),
-			Delay:           task.GIFImageData.Delay,
-			Disposal:        task.GIFImageData.Disposal,
-			Config:          image.Config{ColorModel: task.GIFImageData.Config.ColorModel, Width: int(w), Height: int(h)},
-			BackgroundIndex: task.GIFImageData.BackgroundIndex,
-		}
-		for i := range task.GIFImageData.Image {
-			rgbImage := resize.Resize(w, h, task.GIFImageData.Image[i], resize.Lanczos3)
-			palettedImage := image.NewPaletted(rgbImage.Bounds(), palette.Plan9)
-			draw.Draw(palettedImage, palettedImage.Rect, rgbImage, rgbImage.Bounds().Min, draw.Over)
-			task.ResizedGIFImageData.Image[i] = palettedImage
-		}
+		task.ResizedGIFImageData = ResizeGIF(task.GIFImageData, options)
 	}
 }
 
 func (t *Transformer) GenerateThumbnail(task *ImageGenerateThumbnailTask) {
+	defer observeStage(StageThumbnail, time.Now())
+	options := task.Preset.ResizeOptions()
 	if task.ImageData != nil {
-		w, h := t.getProperSizeBasedOnWidth(ThumbnailWidth, task.ImageData.Bounds().Dx(), task.ImageData.Bounds().Dy())
-		task.ThumbnailImageData = resize.Resize(w, h, task.ImageData, resize.Lanczos3)
+		task.ThumbnailImageData = ResizeImage(task.ImageData, options)
 	} else if task.GIFImageData != nil {
-		w, h := t.getProperSizeBasedOnWidth(ThumbnailWidth, task.GIFImageData.Config.Width, task.GIFImageData.Config.Height)
-		// gif resize 참고. 상당히 어려움
-		// https://stackoverflow.com/a/54210633/9471220
-		// image.Image* => image.Palette 참고
-		// https://stackoverflow.com/questions/35850753/how-to-convert-image-rgba-image-image-to-image-paletted
-		// NewGIF 메소드를 제공하는 곳이 없어서 원본 GIF를 바탕으로 복사한다.
-		task.ThumbnailGIFImageData = &gif.GIF{
-			Image:           make([]*image.Paletted, len(task.GIFImageData.Image)),
-			Delay:           task.GIFImageData.Delay,
-			Disposal:        task.GIFImageData.Disposal,
-			Config:          image.Config{ColorModel: task.GIFImageData.Config.ColorModel, Width: int(w), Height: int(h)},
-			BackgroundIndex: task.GIFImageData.BackgroundIndex,
-		}
-		for i := range task.GIFImageData.Image {
-			rgbImage := resize.Resize(w, h, task.GIFImageData.Image[i], resize.Lanczos3)
-			palettedImage := image.NewPaletted(rgbImage.Bounds(), palette.Plan9)
-			draw.Draw(palettedImage, palettedImage.Rect, rgbImage, rgbImage.Bounds().Min, draw.Over)
-			task.ThumbnailGIFImageData.Image[i] = palettedImage
-		}
-	}
-
-}
-
-func (t *Transformer) getProperSizeBasedOnWidth(desiredWidth, originalW, originalH int) (uint, uint) {
-	// resize 안해도 됨.
-	var width, height int
-	if desiredWidth > originalW {
-		width = originalW
-		height = originalW
-	} else {
-		width = desiredWidth
-		height = originalH * desiredWidth / originalW
+		task.ThumbnailGIFImageData = ResizeGIF(task.GIFImageData, options)
 	}
-	return uint(width), uint(height)
 }
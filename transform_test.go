@@ -1,10 +1,12 @@
 package main
 
 import (
-	"github.com/nfnt/resize"
+	"bytes"
+	"context"
 	"github.com/stretchr/testify/assert"
 	"image"
 	"image/png"
+	"io/ioutil"
 	"net/http"
 	"sync"
 	"testing"
@@ -34,12 +36,10 @@ func DownloadSampleImage(t *testing.T) image.Image {
 }
 
 func TestTransformer_Resize(t *testing.T) {
-	transformerQuit := make(chan interface{})
 	transformer := NewTransformer(
 		make(chan *ImageResizeTask),
 		make(chan *ImageGenerateThumbnailTask),
 		make(chan *ImageUploadTask),
-		transformerQuit,
 		new(sync.WaitGroup),
 	)
 	var imageData image.Image = DownloadSampleImage(t)
@@ -48,7 +48,7 @@ func TestTransformer_Resize(t *testing.T) {
 		BaseImageTask: &BaseImageTask{
 			OriginalFileName: "google_logo.png",
 			ImageData:        imageData,
-		}, ResizingWidth: 128,
+		}, Preset: &VariantPreset{Name: "resized_128", Path: "resized/128", Kind: VariantKindResize, Width: 128, Fit: FitWidth},
 	}
 	transformer.Resize(imageResizeTask)
 	assert.Equal(t, 128, imageResizeTask.ResizedImageData.Bounds().Dx())
@@ -58,87 +58,114 @@ func TestTransformer_Resize(t *testing.T) {
 }
 
 func TestTransformer_GenerateThumbnail(t *testing.T) {
-	transformerQuit := make(chan interface{})
 	transformer := NewTransformer(
 		make(chan *ImageResizeTask),
 		make(chan *ImageGenerateThumbnailTask),
 		make(chan *ImageUploadTask),
-		transformerQuit,
 		new(sync.WaitGroup),
 	)
 
 	var imageData image.Image = DownloadSampleImage(t)
 	assert.NotNil(t, imageData)
+	preset := &VariantPreset{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, Fit: FitWidth}
 	imageThumbnailTask := &ImageGenerateThumbnailTask{
 		BaseImageTask: &BaseImageTask{
 			OriginalFileName: "google_logo.png",
 			ImageData:        imageData,
 		},
+		Preset: preset,
 	}
 	transformer.GenerateThumbnail(imageThumbnailTask)
-	assert.Equal(t, ThumbnailWidth, imageThumbnailTask.ThumbnailImageData.Bounds().Dx())
+	assert.Equal(t, preset.Width, imageThumbnailTask.ThumbnailImageData.Bounds().Dx())
 }
 
 func TestTransformer_Start(t *testing.T) {
 	t.Run("썸네일", func(t *testing.T) {
 		thumbnailTaskChan := make(chan *ImageGenerateThumbnailTask)
 		uploadTaskChan := make(chan *ImageUploadTask)
-		transformerQuit := make(chan interface{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := new(sync.WaitGroup)
 		transformer := NewTransformer(
 			make(chan *ImageResizeTask),
 			thumbnailTaskChan,
 			uploadTaskChan,
-			transformerQuit,
-			new(sync.WaitGroup),
+			done,
 		)
-		go transformer.Start()
+		done.Add(1)
+		go transformer.Start(ctx)
 		imageData := DownloadSampleImage(t)
 		thumbnailTaskChan <- &ImageGenerateThumbnailTask{
 			BaseImageTask: &BaseImageTask{
 				OriginalFileName: "google_logo.png",
 				ImageData:        imageData,
 			},
+			Preset: &VariantPreset{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 128, Fit: FitWidth},
 		}
 		select {
 		case <-uploadTaskChan:
 		case <-time.After(10 * time.Second):
 			t.Fatal("[TimeOutError] Thumbnail 생성 후 UploadTaskChan에 Message가 들어오지 않습니다.")
 		}
-		transformerQuit <- struct{}{}
+		cancel()
+		done.Wait()
 	})
 
 	t.Run("리사이즈", func(t *testing.T) {
 		resizeTaskChan := make(chan *ImageResizeTask)
 		uploadTaskChan := make(chan *ImageUploadTask)
-		transformerQuit := make(chan interface{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := new(sync.WaitGroup)
 		transformer := NewTransformer(
 			resizeTaskChan,
 			make(chan *ImageGenerateThumbnailTask),
 			uploadTaskChan,
-			transformerQuit,
-			new(sync.WaitGroup),
+			done,
 		)
-		go transformer.Start()
+		done.Add(1)
+		go transformer.Start(ctx)
 		imageData := DownloadSampleImage(t)
 		resizeTaskChan <- &ImageResizeTask{
 			BaseImageTask: &BaseImageTask{
 				OriginalFileName: "google_logo.png",
 				ImageData:        imageData,
-			}, ResizingWidth: 128,
+			}, Preset: &VariantPreset{Name: "resized_128", Path: "resized/128", Kind: VariantKindResize, Width: 128, Fit: FitWidth},
 		}
 		select {
 		case <-uploadTaskChan:
 		case <-time.After(5 * time.Second):
 			t.Fatal("[TimeOutError] Resize 후 UploadTaskChan에 Message가 들어오지 않습니다.")
 		}
-		transformerQuit <- struct{}{}
+		cancel()
+		done.Wait()
 	})
 }
 
+// 종료 신호를 받으면 채널에 남은 작업들을 모두 처리한 뒤 종료한다.
+func TestTransformer_Start_Drain(t *testing.T) {
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	imageData, _, err := image.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
+	resizeTaskChan := make(chan *ImageResizeTask, 1)
+	thumbnailTaskChan := make(chan *ImageGenerateThumbnailTask, 1)
+	uploadTaskChan := make(chan *ImageUploadTask, 2)
+	done := new(sync.WaitGroup)
+	transformer := NewTransformer(resizeTaskChan, thumbnailTaskChan, uploadTaskChan, done)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	base := &BaseImageTask{OriginalFileName: "test_png.png", HashedFileName: "drain", ImageData: imageData, Extension: "png"}
+	resizeTaskChan <- &ImageResizeTask{BaseImageTask: base, Preset: &VariantPreset{Name: "resized_16", Path: "resized/16", Kind: VariantKindResize, Width: 16, Fit: FitWidth}}
+	thumbnailTaskChan <- &ImageGenerateThumbnailTask{BaseImageTask: base, Preset: &VariantPreset{Name: "thumbnail", Path: "thumbnail", Kind: VariantKindThumbnail, Width: 8, Fit: FitWidth}}
+
+	done.Add(1)
+	go transformer.Start(ctx)
+	done.Wait()
+	assert.Len(t, uploadTaskChan, 2)
+}
+
 // concurrent benchmark를 위한 것
 func (t *Transformer) resizeBenchmarkConcurrent(task *ImageResizeTask) {
-	w, h := t.getProperSizeBasedOnWidth(task.ResizingWidth, task.ImageData.Bounds().Dx(), task.ImageData.Bounds().Dy())
-	task.ResizedImageData = resize.Resize(w, h, task.ImageData, resize.Lanczos3)
+	task.ResizedImageData = ResizeImage(task.ImageData, task.Preset.ResizeOptions())
 	//task.ImageData = nil // 이제 필요 없으니 지워줘서 GC가 처리할 수 있게 함.
 	t.UploadTaskChan <- &ImageUploadTask{
 		BaseImageTask: &BaseImageTask{
@@ -191,7 +218,7 @@ func (t *Transformer) resizeBenchmarkConcurrent(task *ImageResizeTask) {
 //					BaseImageTask: &BaseImageTask{
 //						OriginalFileName: "google_logo.png",
 //						ImageData:        imageData,
-//					}, ResizingWidth: 128,
+//					}, Preset: &VariantPreset{Name: "resized_128", Path: "resized/128", Kind: VariantKindResize, Width: 128, Fit: FitWidth},
 //				}
 //			}
 //		}()
@@ -214,7 +241,7 @@ func (t *Transformer) resizeBenchmarkConcurrent(task *ImageResizeTask) {
 //					BaseImageTask: &BaseImageTask{
 //						OriginalFileName: "google_logo.png",
 //						ImageData:        imageData,
-//					}, ResizingWidth: 128,
+//					}, Preset: &VariantPreset{Name: "resized_128", Path: "resized/128", Kind: VariantKindResize, Width: 128, Fit: FitWidth},
 //				}
 //			}
 //		}()
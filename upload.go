@@ -2,18 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
-	"log"
-	"os"
-	"path"
+	"go.opentelemetry.io/otel/attribute"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -22,158 +18,233 @@ var (
 )
 
 type Uploader interface {
-	Start()
+	Start(ctx context.Context)
 	Upload(task *ImageUploadTask) error
+	// 아직 끝나지 않은 업로드 작업 수
+	Pending() int
+	// 처리 중인 작업만 마무리하고 채널에서 더 이상 작업을 가져가지 않고 종료한다.
+	// 재시도를 기다리는 작업은 곧바로 채널로 돌려보낸다.
+	Stop()
 }
 
-type S3Uploader struct {
+// 업로드 작업을 받아 이미지를 인코딩한 뒤 Storage에 저장한다.
+// S3, 디스크 등 어떤 저장소를 사용할지는 Storage에 따라 정해진다.
+type StorageUploader struct {
 	ID             int
 	UploadTaskChan chan *ImageUploadTask
-	Quit           <-chan interface{}
-	sess           *session.Session
-	s3Uploader     *s3manager.Uploader
-	bucketName     string
+	Storage        Storage
+	// 작업을 모두 마무리했는지 보고하기 위함.
+	done *sync.WaitGroup
+	// 업로드 중인 작업 수
+	inFlight int32
+	// 다시 채널로 보내지기를 기다리는 재시도 작업 수
+	retrying int32
+	// 재시도를 기다리는 작업 => 채널로 다시 보낼 timer
+	retryTimers map[*ImageUploadTask]*time.Timer
+	mu          sync.Mutex
+	// Stop이 호출되면 닫힌다.
+	stopped  chan struct{}
+	stopOnce sync.Once
 }
 
-type DiskUploader struct {
-	ID             int
-	UploadTaskChan chan *ImageUploadTask
-	Quit           <-chan interface{} // 테스트 진행 시 Start를 끝내기 위함
-}
-
-func NewS3Uploader(taskChan chan *ImageUploadTask, quit chan interface{}, sess *session.Session) Uploader {
+func NewStorageUploader(taskChan chan *ImageUploadTask, storage Storage, done *sync.WaitGroup) Uploader {
 	autoIncrementUploaderID++
-	return &S3Uploader{
+	return &StorageUploader{
 		ID:             autoIncrementUploaderID,
 		UploadTaskChan: taskChan,
-		Quit:           quit,
-		bucketName:     Config.Storage.Aws.BucketName,
-		sess:           sess,
-		s3Uploader:     s3manager.NewUploader(sess),
+		Storage:        storage,
+		done:           done,
+		retryTimers:    make(map[*ImageUploadTask]*time.Timer),
+		stopped:        make(chan struct{}),
 	}
 }
 
-func (u *S3Uploader) String() string {
-	return fmt.Sprintf("S3Uploader(ID: %d, bucketName: %s)", u.ID, u.bucketName)
+func (u *StorageUploader) String() string {
+	return fmt.Sprintf("StorageUploader(ID: %d, Storage: %v)", u.ID, u.Storage)
 }
 
-func (u *S3Uploader) Start() {
-	logrus.Print("Started S3Uploader")
-	defer logrus.Print("Finished S3Uploader")
-
-	for loop := true; loop; {
+// 업로드 작업이 들어올 때까지 채널에서 기다린다.
+// ctx가 끝나면 채널에 남아있는 작업과 재시도를 기다리는 작업을 모두 처리한 뒤 종료하고 done에 보고한다.
+// Transformer들이 모두 종료된 뒤에 ctx를 끝내야 변환된 이미지의 업로드 작업이 남지 않는다.
+// Stop이 호출되면 남은 작업을 처리하지 않고 종료한다.
+// done.Add는 Start를 호출하는 쪽에서 해야한다.
+func (u *StorageUploader) Start(ctx context.Context) {
+	logrus.Print("Started StorageUploader")
+	defer logrus.Print("Finished StorageUploader")
+	defer u.done.Done()
+
+	for !u.isStopped() {
 		select {
+		case <-u.stopped:
+			return
 		case uploadTask := <-u.UploadTaskChan:
-			logrus.Println("Start uploading", uploadTask)
-			if err := u.Upload(uploadTask); err != nil {
-				logrus.Error(err)
-			}
-			logrus.Println("Finish uploading", uploadTask)
-		case <-u.Quit:
-			loop = true
+			u.handleTask(uploadTask)
+		case <-ctx.Done():
+			logrus.Info("StorageUploader에 대한 종료 시그널이 도착했습니다. 남은 작업들을 처리합니다.")
+			u.drain()
+			return
 		}
 	}
-	logrus.Print("Finished S3Uploader")
 }
 
-func (u *S3Uploader) Upload(task *ImageUploadTask) error {
-	logrus.Println("Uploading...", task)
-	defer logrus.Println("Finished ", task)
-	body := bytes.NewBuffer([]byte{})
-
-	switch task.Extension {
-	case "png":
-		err := png.Encode(body, task.ImageData)
-		if err != nil {
-			logrus.Error(err)
-		}
-	case "jpg", "jpeg":
-		err := jpeg.Encode(body, task.ImageData, nil)
-		if err != nil {
-			logrus.Error(err)
-		}
-	case "gif":
-		err := gif.EncodeAll(body, task.GIFImageData)
-		if err != nil {
-			logrus.Error(err)
+// 처리 중인 작업만 마무리하고 종료하도록 한다. 종료되었는지는 done으로 확인한다.
+func (u *StorageUploader) Stop() {
+	u.mu.Lock()
+	// retry timer가 stopped를 확인한 뒤 채널로 보내는 동안 닫히지 않도록 lock을 잡고 닫는다.
+	u.stopOnce.Do(func() { close(u.stopped) })
+	waiting := make([]*ImageUploadTask, 0, len(u.retryTimers))
+	for task, timer := range u.retryTimers {
+		// 이미 실행된 timer는 멈춘 것을 확인하고 작업을 dead letter로 보관한다.
+		if timer.Stop() {
+			waiting = append(waiting, task)
+			delete(u.retryTimers, task)
 		}
 	}
-
-	_, err := u.s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket:      aws.String(u.bucketName),
-		Body:        body,
-		Key:         aws.String(path.Join(task.UploadPath, task.HashedFileName+"."+task.Extension)),
-		ContentType: aws.String("image/" + task.Extension),
-	})
-
-	if err != nil {
-		return err
+	u.mu.Unlock()
+	for _, task := range waiting {
+		u.UploadTaskChan <- task
+		atomic.AddInt32(&u.retrying, -1)
 	}
-
-	return nil
 }
 
-func (u *DiskUploader) String() string {
-	return fmt.Sprintf("DiskUploader(ID: %d)", u.ID)
+func (u *StorageUploader) isStopped() bool {
+	select {
+	case <-u.stopped:
+		return true
+	default:
+		return false
+	}
 }
 
-func (u *DiskUploader) Start() {
-	logrus.Print("Started DiskUploader")
-	defer logrus.Print("Finished DiskUploader")
-
-	for loop := true; loop; {
+// 채널에 남아있는 작업이 없고 재시도를 기다리는 작업도 없을 때까지 처리한다.
+// 재시도 작업은 채널로 보내진 뒤에 retrying이 줄어들므로 retrying이 0이 아니면 채널에서 기다리면 된다.
+func (u *StorageUploader) drain() {
+	for !u.isStopped() {
 		select {
 		case uploadTask := <-u.UploadTaskChan:
-			if err := u.Upload(uploadTask); err != nil {
-				logrus.Error(err)
+			u.handleTask(uploadTask)
+		default:
+			if atomic.LoadInt32(&u.retrying) == 0 {
+				logrus.Info("StorageUploader에 더 이상 남은 작업이 없습니다.")
+				return
+			}
+			select {
+			case uploadTask := <-u.UploadTaskChan:
+				u.handleTask(uploadTask)
+			case <-u.stopped:
 			}
-		case <-u.Quit:
-			loop = true
 		}
 	}
 }
 
-func (u *DiskUploader) Upload(task *ImageUploadTask) error {
+// 채널에서 기다리는 작업, 업로드 중인 작업, 재시도를 기다리는 작업 수의 합
+func (u *StorageUploader) Pending() int {
+	return len(u.UploadTaskChan) + int(atomic.LoadInt32(&u.inFlight)) + int(atomic.LoadInt32(&u.retrying))
+}
+
+func (u *StorageUploader) handleTask(uploadTask *ImageUploadTask) {
+	atomic.AddInt32(&u.inFlight, 1)
+	defer atomic.AddInt32(&u.inFlight, -1)
+	defer observeBusy(WorkerUploader, time.Now())
+	logrus.Println("Start uploading", uploadTask)
+	// 재시도마다 span을 만든다.
+	_, span := startTaskSpan(uploadTask.BaseImageTask, "uploader.upload",
+		attribute.String("bumblebee.variant", uploadTask.Variant),
+		attribute.String("bumblebee.key", uploadTask.Key()),
+		attribute.Int("bumblebee.attempt", len(uploadTask.Failures)+1),
+	)
+	defer span.End()
+	Jobs.SetStatus(uploadTask.HashedFileName, uploadTask.Variant, JobStatusUploading)
+	if err := u.Upload(uploadTask); err != nil {
+		logrus.Error(err)
+		recordSpanError(span, err)
+		u.handleFailure(uploadTask, err)
+	} else {
+		Jobs.SetStatus(uploadTask.HashedFileName, uploadTask.Variant, JobStatusDone)
+		FinishAdmittedVariants(uploadTask.BaseImageTask, 1)
+	}
+	logrus.Println("Finish uploading", uploadTask)
+}
+
+func (u *StorageUploader) Upload(task *ImageUploadTask) error {
 	logrus.Println("Uploading...", task)
 	defer logrus.Println("Finished ", task)
-	if task.ImageData == nil && task.GIFImageData == nil {
+	if task.RawData == nil && task.ImageData == nil && task.GIFImageData == nil {
 		logrus.Error(ErrNoImageDataToUpload)
 		return ErrNoImageDataToUpload
 	}
 
-	file, err := os.Create(path.Join(task.UploadPath, task.HashedFileName+"."+task.Extension))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			err := os.MkdirAll(task.UploadPath, 0755)
-			file, err = os.Create(path.Join(task.UploadPath, task.HashedFileName+"."+task.Extension))
-			if err != nil {
-				logrus.Error(err)
-				return err
-			}
-		} else {
-			logrus.Error(err)
+	// 재시도 시에 다시 인코딩하지 않도록 인코딩된 결과를 RawData에 보관한다.
+	if task.RawData == nil {
+		start := time.Now()
+		body := bytes.NewBuffer([]byte{})
+		// 워커의 ctx는 남은 작업을 처리하라는 신호이므로 인코딩을 중단시키지 않는다.
+		// 외부 command를 사용하는 인코더는 Config.Encoding.CommandTimeout 안에 종료된다.
+		if err := EncodeImageContext(context.Background(), body, task); err != nil {
 			return err
 		}
+		observeStage(StageEncode, start)
+		task.RawData = body.Bytes()
+	}
+	start := time.Now()
+	if err := u.Storage.Put(task.Key(), bytes.NewReader(task.RawData), ContentTypeOf(task.Extension)); err != nil {
+		return err
+	}
+	observeStage(StageUpload, start)
+	bytesOut.WithLabelValues(task.Variant).Add(float64(len(task.RawData)))
+	return nil
+}
 
+// 업로드에 실패한 task를 task.Retry에 따라 잠시 후 다시 채널로 보낸다.
+// 재시도를 모두 실패하면 dead letter로 보관하고 실패 처리한다. 인코딩에 실패한 경우는 재시도하지 않는다.
+func (u *StorageUploader) handleFailure(task *ImageUploadTask, err error) {
+	if task.RawData == nil {
+		Jobs.SetFailed(task.HashedFileName, task.Variant, err)
+		FinishAdmittedVariants(task.BaseImageTask, 1)
+		return
+	}
+	task.Failures = append(task.Failures, UploadFailure{At: time.Now(), Error: err.Error()})
+	if task.Retry.ShouldRetry(len(task.Failures)) {
+		backoff := task.Retry.Backoff(len(task.Failures))
+		logrus.Warnf("%v 후에 업로드를 다시 시도합니다. key=%s, attempts=%d/%d", backoff, task.Key(), len(task.Failures), task.Retry.MaxAttempts)
+		Jobs.SetStatus(task.HashedFileName, task.Variant, JobStatusRetrying)
+		// 채널에서 꺼낸 task를 다시 넣는 것이고 재시도 중인 작업의 자원은 반환되지 않았으므로 채널에 여유가 있다.
+		u.scheduleRetry(task, backoff)
+		return
 	}
 
-	switch task.Extension {
-	case "png":
-		err := png.Encode(file, task.ImageData)
-		if err != nil {
-			log.Fatal(3, err)
-		}
-	case "jpeg":
-		err := jpeg.Encode(file, task.ImageData, nil)
-		if err != nil {
-			log.Fatal(4, err)
-		}
-	case "gif":
-		err := gif.EncodeAll(file, task.GIFImageData)
-		if err != nil {
-			logrus.Error(err)
+	if DeadLetters != nil {
+		letter, deadLetterErr := DeadLetters.Add(task)
+		if deadLetterErr != nil {
+			logrus.Errorf("dead letter를 저장하지 못했습니다. key=%s, err=%v", task.Key(), deadLetterErr)
+		} else {
+			logrus.Errorf("업로드를 %d번 실패해 dead letter로 보관합니다. key=%s, id=%s", len(task.Failures), task.Key(), letter.ID)
+			err = fmt.Errorf("%w (dead letter id=%s)", err, letter.ID)
 		}
 	}
+	Jobs.SetFailed(task.HashedFileName, task.Variant, err)
+	FinishAdmittedVariants(task.BaseImageTask, 1)
+}
 
-	return nil
+// backoff 후에 task를 다시 채널로 보낸다. Stop이 호출되면 곧바로 보내고,
+// Stop이 호출될 때 이미 실행되고 있던 timer는 작업을 dead letter로 보관한다.
+func (u *StorageUploader) scheduleRetry(task *ImageUploadTask, backoff time.Duration) {
+	atomic.AddInt32(&u.retrying, 1)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.retryTimers[task] = time.AfterFunc(backoff, func() {
+		u.mu.Lock()
+		delete(u.retryTimers, task)
+		if u.isStopped() {
+			u.mu.Unlock()
+			// 멈춘 뒤에는 채널에 남은 작업이 이미 정리되었을 수 있으므로 곧바로 보관한다.
+			persistUnfinishedUpload(task)
+			atomic.AddInt32(&u.retrying, -1)
+			return
+		}
+		// Stop이 채널을 비우기 전에 보내지도록 lock을 잡은 채로 보낸다. 채널에서 꺼낸 task이므로 막히지 않는다.
+		u.UploadTaskChan <- task
+		atomic.AddInt32(&u.retrying, -1)
+		u.mu.Unlock()
+	})
 }
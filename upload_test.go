@@ -1,23 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/stretchr/testify/assert"
 	"github.com/umi0410/ezconfig"
+	"image"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"sync"
 	"testing"
-	"time"
 )
 
 var (
 	uploader          Uploader
 	uploadTaskChan    chan *ImageUploadTask
-	uploaderQuit      chan interface{}
+	uploaderDone      *sync.WaitGroup
 	uploadPathForTest string = "test_data" // 주의. 이 패스는 수행 후 사라짐.
 )
 
@@ -26,12 +28,9 @@ func init() {
 }
 
 func BeforeEachUploadTest_DiskUploader(tb testing.TB) {
-	uploaderQuit = make(chan interface{}, 100)
+	uploaderDone = new(sync.WaitGroup)
 	uploadTaskChan = make(chan *ImageUploadTask, 100)
-	uploader = &DiskUploader{
-		UploadTaskChan: uploadTaskChan,
-		Quit:           uploaderQuit,
-	}
+	uploader = NewStorageUploader(uploadTaskChan, NewDiskStorage("", 0), uploaderDone)
 	err := os.Mkdir(uploadPathForTest, 0755)
 	assert.NoError(tb, err)
 }
@@ -39,70 +38,57 @@ func BeforeEachUploadTest_DiskUploader(tb testing.TB) {
 func AfterEachUploadTest_DiskUploader(tb testing.TB) {
 	err := os.RemoveAll(uploadPathForTest)
 	assert.NoError(tb, err)
-	uploaderQuit = nil
+	uploaderDone = nil
 	uploadTaskChan = nil
 	uploader = nil
 }
 
-func BeforeEachUploadTest_S3Uploader(tb testing.TB) {
+// 실제 AWS 대신 fake S3 서버를 사용한다.
+func BeforeEachUploadTest_S3Uploader(t *testing.T) *httptest.Server {
 	uploadTaskChan = make(chan *ImageUploadTask, 100)
-	uploaderQuit = make(chan interface{}, 100)
-	sess, err := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region: aws.String("ap-northeast-2"),
-		},
-	})
-	assert.NoError(tb, err)
-	uploader = NewS3Uploader(uploadTaskChan, uploaderQuit, sess)
+	uploaderDone = new(sync.WaitGroup)
+	_, server := newFakeS3Server(t, "khumu-test", false)
+	sess, err := NewAwsSession(fakeS3Config(server, "khumu-test"))
+	assert.NoError(t, err)
+	uploader = NewStorageUploader(uploadTaskChan, NewS3Storage(sess, "khumu-test"), uploaderDone)
+	return server
 }
 
 // S3의 테스트 데이터도 지운다.
 func AfterEachUploadTest_S3Uploader(tb testing.TB) {
-	s3Service := s3.New(uploader.(*S3Uploader).sess)
-	objects, err := s3Service.ListObjects(
-		&s3.ListObjectsInput{
-			Bucket: aws.String(uploader.(*S3Uploader).bucketName),
-			Prefix: aws.String(uploadPathForTest),
-		},
-	)
+	storage := uploader.(*StorageUploader).Storage
+	objects, err := storage.List(uploadPathForTest)
 	assert.NoError(tb, err)
-	objectIdentifiers := make([]*s3.ObjectIdentifier, 0)
-	for _, object := range objects.Contents {
-		objectIdentifiers = append(objectIdentifiers, &s3.ObjectIdentifier{Key: object.Key})
+	for _, object := range objects {
+		assert.NoError(tb, storage.Delete(object.Key))
 	}
 
-	_, err = s3Service.DeleteObjects(
-		&s3.DeleteObjectsInput{
-			Bucket: aws.String(uploader.(*S3Uploader).bucketName),
-			Delete: &s3.Delete{
-				Objects: objectIdentifiers,
-			},
-		},
-	)
-	assert.NoError(tb, err)
-
-	uploaderQuit = nil
+	uploaderDone = nil
 	uploadTaskChan = nil
 	uploader = nil
 }
 
 func TestS3Uploader_Upload(t *testing.T) {
-	BeforeEachUploadTest_S3Uploader(t)
+	server := BeforeEachUploadTest_S3Uploader(t)
 	defer AfterEachUploadTest_S3Uploader(t)
 
-	imageData := DownloadSampleImage(t)
+	data, err := ioutil.ReadFile("test/test_png.png")
+	assert.NoError(t, err)
+	imageData, _, err := image.Decode(bytes.NewReader(data))
+	assert.NoError(t, err)
 	task := &ImageUploadTask{
 		BaseImageTask: &BaseImageTask{
-			ImageData: imageData, OriginalFileName: "google_logo.png", HashedFileName: "abcd1234abcd", Extension: "png",
+			ImageData: imageData, OriginalFileName: "test_png.png", HashedFileName: "abcd1234abcd", Extension: "png",
 		},
 		UploadPath: uploadPathForTest,
 	}
-	err := uploader.Upload(task)
+	err = uploader.Upload(task)
 	assert.NoError(t, err)
 
-	resp, err := http.Get(fmt.Sprintf("%s%s/%s", Config.Storage.Aws.Endpoint, task.UploadPath, task.HashedFileName+"."+task.Extension))
+	resp, err := http.Get(fmt.Sprintf("%s/khumu-test/%s/%s", server.URL, task.UploadPath, task.HashedFileName+"."+task.Extension))
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
 }
 
 func TestDiskUploader_Start(t *testing.T) {
@@ -110,7 +96,9 @@ func TestDiskUploader_Start(t *testing.T) {
 	defer AfterEachUploadTest_DiskUploader(t)
 
 	imageData := DownloadSampleImage(t)
-	go uploader.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	uploaderDone.Add(1)
+	go uploader.Start(ctx)
 	task := &ImageUploadTask{
 		BaseImageTask: &BaseImageTask{
 			ImageData: imageData, OriginalFileName: "google_logo.png", HashedFileName: "abcd1234abcd", Extension: "png",
@@ -119,8 +107,29 @@ func TestDiskUploader_Start(t *testing.T) {
 	}
 
 	uploadTaskChan <- task
-	time.Sleep(time.Second * 3)
-	uploaderQuit <- struct{}{}
+	cancel()
+	uploaderDone.Wait()
 	_, err := os.Stat(path.Join(uploadPathForTest, "abcd1234abcd.png"))
 	assert.NoError(t, err)
 }
+
+// 종료 신호를 받으면 채널에 남은 작업과 재시도를 기다리는 작업을 모두 처리한 뒤 종료한다.
+func TestStorageUploader_Start_Drain(t *testing.T) {
+	storage := &flakyPutStorage{Storage: NewDiskStorage(t.TempDir(), 0), failures: 1}
+	taskChan := make(chan *ImageUploadTask, 2)
+	done := new(sync.WaitGroup)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	taskChan <- newTestUploadTask("drain-a")
+	taskChan <- newTestUploadTask("drain-b")
+
+	done.Add(1)
+	NewStorageUploader(taskChan, storage, done).Start(ctx)
+	done.Wait()
+	// 첫 번째 작업은 한 번 실패한 뒤 재시도된다.
+	assert.Equal(t, 3, storage.puts)
+	for _, key := range []string{"original/drain-a.png", "original/drain-b.png"} {
+		_, err := storage.Stat(key)
+		assert.NoError(t, err)
+	}
+}